@@ -0,0 +1,562 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/21strive/commonuser"
+	"github.com/21strive/commonuser/config"
+	"github.com/golang-jwt/jwt/v5"
+	_ "github.com/lib/pq" // PostgreSQL driver
+	"github.com/redis/go-redis/v9"
+)
+
+type options struct {
+	dbHost        string
+	dbPort        string
+	dbUser        string
+	dbPassword    string
+	dbName        string
+	sslMode       string
+	redisAddr     string
+	redisPassword string
+	redisDB       int
+	entityName    string
+	jwtSecret     string
+	jwtIssuer     string
+}
+
+type accountSelector struct {
+	username string
+	email    string
+	uuid     string
+	randId   string
+}
+
+type sessionView struct {
+	UUID         string    `json:"uuid"`
+	RandId       string    `json:"randId"`
+	CreatedAt    time.Time `json:"createdAt"`
+	LastActiveAt time.Time `json:"lastActiveAt"`
+	ExpiredAt    time.Time `json:"expiredAt"`
+	DeviceId     string    `json:"deviceId"`
+	DeviceType   string    `json:"deviceType"`
+	UserAgent    string    `json:"userAgent"`
+	Revoked      bool      `json:"revoked"`
+}
+
+var commands = map[string]func(ctx context.Context, args []string){
+	"create-account":     createAccount,
+	"set-password":       setPassword,
+	"set-username":       setUsername,
+	"set-status":         setStatus,
+	"list-accounts":      listAccounts,
+	"username-history":   usernameHistory,
+	"verify-email":       verifyEmail,
+	"list-sessions":      listSessions,
+	"revoke-session":     revokeSession,
+	"revoke-sessions":    revokeSessions,
+	"seed":               seed,
+	"decode-token":       decodeToken,
+	"backfill-usernames": backfillUsernames,
+	"backfill-emails":    backfillEmails,
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(1)
+	}
+
+	command, found := commands[os.Args[1]]
+	if !found {
+		usage()
+		os.Exit(1)
+	}
+
+	command(context.Background(), os.Args[2:])
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s <command> [options]\n\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "Operates user accounts. Every command prints JSON to stdout.\n\n")
+	fmt.Fprintf(os.Stderr, "Commands:\n")
+	fmt.Fprintf(os.Stderr, "  create-account   -username -email [-name]\n")
+	fmt.Fprintf(os.Stderr, "  set-password     <account>\n")
+	fmt.Fprintf(os.Stderr, "  set-username     <account> -new-username [-override]\n")
+	fmt.Fprintf(os.Stderr, "  username-history <account>\n")
+	fmt.Fprintf(os.Stderr, "  set-status       <account> -status active|suspended\n")
+	fmt.Fprintf(os.Stderr, "  list-accounts    [-status] [-username-prefix] [-email-prefix] [-email-verified true|false]\n")
+	fmt.Fprintf(os.Stderr, "                   [-created-after] [-created-before] [-limit] [-cursor]\n")
+	fmt.Fprintf(os.Stderr, "  verify-email     <account>\n")
+	fmt.Fprintf(os.Stderr, "  list-sessions    <account>\n")
+	fmt.Fprintf(os.Stderr, "  revoke-session   -session <session uuid>\n")
+	fmt.Fprintf(os.Stderr, "  revoke-sessions  <account>\n")
+	fmt.Fprintf(os.Stderr, "  seed             -by username|randid|uuid|email|phone -value\n")
+	fmt.Fprintf(os.Stderr, "  decode-token     -token\n")
+	fmt.Fprintf(os.Stderr, "  backfill-usernames [-batch]\n")
+	fmt.Fprintf(os.Stderr, "  backfill-emails  [-batch]\n\n")
+	fmt.Fprintf(os.Stderr, "<account> is one of -username, -email, -uuid or -randid.\n")
+	fmt.Fprintf(os.Stderr, "create-account and set-password read the account password from the first line of\n")
+	fmt.Fprintf(os.Stderr, "stdin, or from $COMMONUSER_ACCOUNT_PASSWORD when it is set.\n")
+	fmt.Fprintf(os.Stderr, "Run '%s <command> -h' for connection flags.\n", os.Args[0])
+}
+
+func connectionFlags(fs *flag.FlagSet) *options {
+	opts := &options{}
+	fs.StringVar(&opts.dbHost, "host", "localhost", "Database host")
+	fs.StringVar(&opts.dbPort, "port", "5432", "Database port")
+	fs.StringVar(&opts.dbUser, "user", "", "Database user")
+	fs.StringVar(&opts.dbPassword, "password", "", "Database password")
+	fs.StringVar(&opts.dbName, "db", "", "Database name")
+	fs.StringVar(&opts.sslMode, "ssl", "disable", "SSL mode (disable, require)")
+	fs.StringVar(&opts.redisAddr, "redis", "localhost:6379", "Redis address")
+	fs.StringVar(&opts.redisPassword, "redis-password", "", "Redis password")
+	fs.IntVar(&opts.redisDB, "redis-db", 0, "Redis database")
+	fs.StringVar(&opts.entityName, "entity", "", "Entity name (required)")
+	fs.StringVar(&opts.jwtSecret, "jwt-secret", os.Getenv("COMMONUSER_JWT_SECRET"), "JWT secret, defaults to $COMMONUSER_JWT_SECRET")
+	fs.StringVar(&opts.jwtIssuer, "jwt-issuer", "", "JWT issuer")
+	return opts
+}
+
+func accountFlags(fs *flag.FlagSet) *accountSelector {
+	selector := &accountSelector{}
+	fs.StringVar(&selector.username, "username", "", "Account username")
+	fs.StringVar(&selector.email, "email", "", "Account email")
+	fs.StringVar(&selector.uuid, "uuid", "", "Account uuid")
+	fs.StringVar(&selector.randId, "randid", "", "Account randId")
+	return selector
+}
+
+func connect(opts *options) *commonuser.App {
+	if opts.entityName == "" || opts.dbUser == "" || opts.dbName == "" {
+		fail(errors.New("missing required flags: -entity, -user and -db"))
+	}
+
+	connStr := fmt.Sprintf("host=%s port=%s user=%s dbname=%s sslmode=%s",
+		opts.dbHost, opts.dbPort, opts.dbUser, opts.dbName, opts.sslMode)
+	if opts.dbPassword != "" {
+		connStr += " password=" + opts.dbPassword
+	}
+
+	db, err := sql.Open("postgres", connStr)
+	if err != nil {
+		fail(err)
+	}
+	if err := db.Ping(); err != nil {
+		fail(err)
+	}
+
+	redisClient := redis.NewUniversalClient(&redis.UniversalOptions{
+		Addrs:    []string{opts.redisAddr},
+		Password: opts.redisPassword,
+		DB:       opts.redisDB,
+	})
+	if err := redisClient.Ping(context.Background()).Err(); err != nil {
+		fail(err)
+	}
+
+	app := commonuser.New(db, redisClient, config.DefaultConfig(opts.entityName, opts.jwtSecret, opts.jwtIssuer, time.Hour))
+	app.WithWriteDB(db)
+	return app
+}
+
+func findAccount(app *commonuser.App, selector *accountSelector) *commonuser.Account {
+	var account *commonuser.Account
+	var err error
+	switch {
+	case selector.username != "":
+		account, err = app.Account.Find.ByUsername(selector.username)
+	case selector.email != "":
+		account, err = app.Account.Find.ByEmail(selector.email)
+	case selector.uuid != "":
+		account, err = app.Account.Find.ByUUID(selector.uuid)
+	case selector.randId != "":
+		account, err = app.Account.Find.ByRandId(selector.randId)
+	default:
+		err = errors.New("one of -username, -email, -uuid or -randid is required")
+	}
+	if err != nil {
+		fail(err)
+	}
+	return account
+}
+
+func createAccount(ctx context.Context, args []string) {
+	fs := flag.NewFlagSet("create-account", flag.ExitOnError)
+	opts := connectionFlags(fs)
+	username := fs.String("username", "", "Username")
+	email := fs.String("email", "", "Email")
+	name := fs.String("name", "", "Display name")
+	fs.Parse(args)
+
+	if *email == "" {
+		fail(errors.New("-email is required"))
+	}
+	password := readAccountPassword()
+
+	app := connect(opts)
+	account := app.Account.New()
+	account.SetName(*name)
+	account.SetUsername(*username)
+	account.SetEmail(*email)
+	if err := account.SetPassword(password); err != nil {
+		fail(err)
+	}
+	if err := app.Account.Register(ctx, account); err != nil {
+		fail(err)
+	}
+
+	printJSON(account)
+}
+
+func setPassword(ctx context.Context, args []string) {
+	fs := flag.NewFlagSet("set-password", flag.ExitOnError)
+	opts := connectionFlags(fs)
+	selector := accountFlags(fs)
+	fs.Parse(args)
+	newPassword := readAccountPassword()
+
+	app := connect(opts)
+	account := findAccount(app, selector)
+	if err := account.SetPassword(newPassword); err != nil {
+		fail(err)
+	}
+	if err := app.Account.Update(ctx, account); err != nil {
+		fail(err)
+	}
+
+	printJSON(account)
+}
+
+func setUsername(ctx context.Context, args []string) {
+	fs := flag.NewFlagSet("set-username", flag.ExitOnError)
+	opts := connectionFlags(fs)
+	selector := accountFlags(fs)
+	newUsername := fs.String("new-username", "", "New username")
+	override := fs.Bool("override", false, "Skip the change cooldown and take over a held username")
+	fs.Parse(args)
+
+	if *newUsername == "" {
+		fail(errors.New("-new-username is required"))
+	}
+
+	app := connect(opts)
+	account := findAccount(app, selector)
+	var err error
+	if *override {
+		err = app.Account.OverrideUsername(ctx, account, *newUsername)
+	} else {
+		account.SetUsername(*newUsername)
+		err = app.Account.Update(ctx, account)
+	}
+	if err != nil {
+		fail(err)
+	}
+
+	printJSON(account)
+}
+
+func usernameHistory(ctx context.Context, args []string) {
+	fs := flag.NewFlagSet("username-history", flag.ExitOnError)
+	opts := connectionFlags(fs)
+	selector := accountFlags(fs)
+	fs.Parse(args)
+
+	app := connect(opts)
+	account := findAccount(app, selector)
+	history, err := app.Account.UsernameHistory(ctx, account)
+	if err != nil {
+		fail(err)
+	}
+
+	printJSON(history)
+}
+
+func setStatus(ctx context.Context, args []string) {
+	fs := flag.NewFlagSet("set-status", flag.ExitOnError)
+	opts := connectionFlags(fs)
+	selector := accountFlags(fs)
+	status := fs.String("status", "", "New account status")
+	fs.Parse(args)
+
+	if *status == "" {
+		fail(errors.New("-status is required"))
+	}
+
+	app := connect(opts)
+	account := findAccount(app, selector)
+	account.SetStatus(*status)
+	if err := app.Account.Update(ctx, account); err != nil {
+		fail(err)
+	}
+
+	printJSON(account)
+}
+
+func listAccounts(ctx context.Context, args []string) {
+	fs := flag.NewFlagSet("list-accounts", flag.ExitOnError)
+	opts := connectionFlags(fs)
+	status := fs.String("status", "", "Only accounts with this status")
+	usernamePrefix := fs.String("username-prefix", "", "Only usernames starting with this prefix")
+	emailPrefix := fs.String("email-prefix", "", "Only email addresses starting with this prefix")
+	emailVerified := fs.String("email-verified", "", "Only accounts whose email is (true) or is not (false) verified")
+	createdAfter := fs.String("created-after", "", "Only accounts created at or after this RFC 3339 time")
+	createdBefore := fs.String("created-before", "", "Only accounts created before this RFC 3339 time")
+	limit := fs.Int("limit", 20, "Accounts per page")
+	cursor := fs.String("cursor", "", "nextCursor of the previous page")
+	fs.Parse(args)
+
+	filter := commonuser.AccountFilter{
+		Status:         *status,
+		UsernamePrefix: *usernamePrefix,
+		EmailPrefix:    *emailPrefix,
+		Limit:          *limit,
+	}
+	if *emailVerified != "" {
+		verified, err := strconv.ParseBool(*emailVerified)
+		if err != nil {
+			fail(fmt.Errorf("-email-verified: %w", err))
+		}
+		filter.EmailVerified = &verified
+	}
+	if *createdAfter != "" {
+		after, err := time.Parse(time.RFC3339, *createdAfter)
+		if err != nil {
+			fail(fmt.Errorf("-created-after: %w", err))
+		}
+		filter.CreatedAfter = after
+	}
+	if *createdBefore != "" {
+		before, err := time.Parse(time.RFC3339, *createdBefore)
+		if err != nil {
+			fail(fmt.Errorf("-created-before: %w", err))
+		}
+		filter.CreatedBefore = before
+	}
+
+	app := connect(opts)
+	page, err := app.Account.List(ctx, filter, *cursor)
+	if err != nil {
+		fail(err)
+	}
+
+	printJSON(page)
+}
+
+func verifyEmail(ctx context.Context, args []string) {
+	fs := flag.NewFlagSet("verify-email", flag.ExitOnError)
+	opts := connectionFlags(fs)
+	selector := accountFlags(fs)
+	fs.Parse(args)
+
+	app := connect(opts)
+	account := findAccount(app, selector)
+	account.SetEmailVerified()
+	if err := app.Account.Update(ctx, account); err != nil {
+		fail(err)
+	}
+
+	printJSON(account)
+}
+
+func listSessions(ctx context.Context, args []string) {
+	fs := flag.NewFlagSet("list-sessions", flag.ExitOnError)
+	opts := connectionFlags(fs)
+	selector := accountFlags(fs)
+	fs.Parse(args)
+
+	app := connect(opts)
+	account := findAccount(app, selector)
+	sessions, err := app.Session().FindByAccount(ctx, account)
+	if err != nil {
+		fail(err)
+	}
+
+	views := make([]sessionView, 0, len(sessions))
+	for _, session := range sessions {
+		views = append(views, sessionView{
+			UUID:         session.GetUUID(),
+			RandId:       session.GetRandId(),
+			CreatedAt:    session.GetCreatedAt(),
+			LastActiveAt: session.LastActiveAt,
+			ExpiredAt:    session.ExpiredAt,
+			DeviceId:     session.DeviceId,
+			DeviceType:   session.DeviceType,
+			UserAgent:    session.UserAgent,
+			Revoked:      session.Revoked,
+		})
+	}
+
+	printJSON(views)
+}
+
+func revokeSession(ctx context.Context, args []string) {
+	fs := flag.NewFlagSet("revoke-session", flag.ExitOnError)
+	opts := connectionFlags(fs)
+	sessionUUID := fs.String("session", "", "Session uuid")
+	fs.Parse(args)
+
+	if *sessionUUID == "" {
+		fail(errors.New("-session is required"))
+	}
+
+	app := connect(opts)
+	if err := app.Session().Revoke(ctx, *sessionUUID); err != nil {
+		fail(err)
+	}
+
+	printJSON(map[string]string{"revoked": *sessionUUID})
+}
+
+func revokeSessions(ctx context.Context, args []string) {
+	fs := flag.NewFlagSet("revoke-sessions", flag.ExitOnError)
+	opts := connectionFlags(fs)
+	selector := accountFlags(fs)
+	fs.Parse(args)
+
+	app := connect(opts)
+	account := findAccount(app, selector)
+	revoked, err := app.Session().RevokeAll(ctx, account)
+	if err != nil {
+		fail(err)
+	}
+
+	printJSON(map[string]interface{}{"account": account.GetUUID(), "revoked": revoked})
+}
+
+func seed(ctx context.Context, args []string) {
+	fs := flag.NewFlagSet("seed", flag.ExitOnError)
+	opts := connectionFlags(fs)
+	by := fs.String("by", "", "Lookup key: username, randid, uuid, email or phone")
+	value := fs.String("value", "", "Lookup value")
+	fs.Parse(args)
+
+	if *value == "" {
+		fail(errors.New("-value is required"))
+	}
+
+	app := connect(opts)
+	var err error
+	switch *by {
+	case "username":
+		err = app.Account.SeedByUsername(ctx, *value)
+	case "randid":
+		err = app.Account.SeedByRandId(ctx, *value)
+	case "uuid":
+		err = app.Account.SeedByUUID(ctx, *value)
+	case "email":
+		err = app.Account.SeedByEmail(ctx, *value)
+	case "phone":
+		err = app.Account.SeedByPhone(ctx, *value)
+	default:
+		err = errors.New("-by must be one of username, randid, uuid, email or phone")
+	}
+	if err != nil {
+		fail(err)
+	}
+
+	printJSON(map[string]string{"seeded": *value, "by": *by})
+}
+
+func decodeToken(ctx context.Context, args []string) {
+	fs := flag.NewFlagSet("decode-token", flag.ExitOnError)
+	opts := connectionFlags(fs)
+	token := fs.String("token", "", "Access token")
+	fs.Parse(args)
+
+	if *token == "" {
+		fail(errors.New("-token is required"))
+	}
+
+	claims := &commonuser.UserClaims{}
+	if _, _, err := jwt.NewParser().ParseUnverified(*token, claims); err != nil {
+		fail(err)
+	}
+
+	app := connect(opts)
+	result := struct {
+		Claims *commonuser.UserClaims `json:"claims"`
+		Valid  bool                   `json:"valid"`
+		Error  string                 `json:"error,omitempty"`
+	}{Claims: claims, Valid: true}
+	if _, err := app.VerifyAccessToken(ctx, *token); err != nil {
+		result.Valid = false
+		result.Error = err.Error()
+	}
+
+	printJSON(result)
+}
+
+func backfillUsernames(ctx context.Context, args []string) {
+	fs := flag.NewFlagSet("backfill-usernames", flag.ExitOnError)
+	opts := connectionFlags(fs)
+	batchSize := fs.Int("batch", 500, "Accounts per batch")
+	fs.Parse(args)
+
+	app := connect(opts)
+	report, err := app.Account.BackfillUsernames(ctx, *batchSize)
+	if err != nil {
+		fail(err)
+	}
+
+	printJSON(report)
+}
+
+func backfillEmails(ctx context.Context, args []string) {
+	fs := flag.NewFlagSet("backfill-emails", flag.ExitOnError)
+	opts := connectionFlags(fs)
+	batchSize := fs.Int("batch", 500, "Accounts per batch")
+	fs.Parse(args)
+
+	app := connect(opts)
+	report, err := app.Account.BackfillEmails(ctx, *batchSize)
+	if err != nil {
+		fail(err)
+	}
+
+	printJSON(report)
+}
+
+// readAccountPassword takes the account password from
+// $COMMONUSER_ACCOUNT_PASSWORD or else the first line of stdin, so it stays out
+// of shell history and the process list.
+func readAccountPassword() string {
+	if password := os.Getenv("COMMONUSER_ACCOUNT_PASSWORD"); password != "" {
+		return password
+	}
+
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		fail(err)
+	}
+	password := strings.TrimRight(line, "\r\n")
+	if password == "" {
+		fail(errors.New("account password is required on stdin or in $COMMONUSER_ACCOUNT_PASSWORD"))
+	}
+	return password
+}
+
+func printJSON(v interface{}) {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(v); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func fail(err error) {
+	printJSON(map[string]string{"error": err.Error()})
+	os.Exit(1)
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"flag"
 	"fmt"
@@ -8,10 +9,19 @@ import (
 	"os"
 	"strings"
 
+	"github.com/21strive/commonuser"
+	"github.com/21strive/commonuser/internal/schema"
 	_ "github.com/lib/pq" // PostgreSQL driver
 )
 
 func main() {
+	// "migrate verify [options]" only reports schema drift
+	verify := len(os.Args) > 1 && os.Args[1] == "verify"
+	args := os.Args[1:]
+	if verify {
+		args = os.Args[2:]
+	}
+
 	var (
 		dbHost     = flag.String("host", "localhost", "Database host")
 		dbPort     = flag.String("port", "5432", "Database port")
@@ -20,11 +30,14 @@ func main() {
 		dbName     = flag.String("db", "", "Database name")
 		entityName = flag.String("entity", "", "Entity name (required)")
 		sslMode    = flag.String("ssl", "disable", "SSL mode (disable, require)")
+		dryRun     = flag.Bool("dry-run", false, "Print the pending SQL without executing it")
 	)
 
 	flag.Usage = func() {
-		fmt.Fprintf(os.Stderr, "Usage: %s [options]\n\n", os.Args[0])
-		fmt.Fprintf(os.Stderr, "Creates database tables for user management.\n\n")
+		fmt.Fprintf(os.Stderr, "Usage: %s [verify] [options]\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Creates or upgrades database tables for user management.\n")
+		fmt.Fprintf(os.Stderr, "Every pending migration of the entity is applied in one transaction.\n")
+		fmt.Fprintf(os.Stderr, "With verify, reports schema drift against the repositories instead.\n\n")
 		fmt.Fprintf(os.Stderr, "Required flags:\n")
 		fmt.Fprintf(os.Stderr, "  -entity string    Entity name (e.g., 'user', 'admin')\n")
 		fmt.Fprintf(os.Stderr, "  -user string      Database user\n")
@@ -34,10 +47,12 @@ func main() {
 		flag.PrintDefaults()
 		fmt.Fprintf(os.Stderr, "\nExample:\n")
 		fmt.Fprintf(os.Stderr, "  %s -entity=user -user=postgres -password=mypass -db=myapp\n", os.Args[0])
-		fmt.Fprintf(os.Stderr, "  %s -entity=admin -user=postgres -password=mypass -db=myapp -tables=account,reset,session\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s -entity=admin -user=postgres -password=mypass -db=myapp -host=db.internal -ssl=require\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s -entity=user -user=postgres -password=mypass -db=myapp -dry-run\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s verify -entity=user -user=postgres -password=mypass -db=myapp\n", os.Args[0])
 	}
 
-	flag.Parse()
+	flag.CommandLine.Parse(args)
 
 	// Validate required flags
 	if *entityName == "" || *dbUser == "" || *dbName == "" {
@@ -69,226 +84,69 @@ func main() {
 
 	fmt.Printf("Connected to database: %s\n", *dbName)
 
-	// Start transaction for atomic table creation
-	fmt.Println("Starting database transaction...")
-	tx, err := db.Begin()
-	if err != nil {
-		log.Fatalf("Failed to start transaction: %v", err)
+	if verify {
+		verifySchema(db, *entityName)
+		return
 	}
-	defer func() {
-		if r := recover(); r != nil {
-			tx.Rollback()
-			log.Fatalf("Transaction rolled back due to panic: %v", r)
-		}
-	}()
 
-	// CreateRequest tables within transaction
-	tables := []struct {
-		name       string
-		createFunc func(*sql.Tx, string) (bool, error)
-	}{
-		{"account", CreateAccountTableSQL},
-		{"reset password", CreateResetPasswordTableSQL},
-		{"update email", CreateUpdateEmailTableSQL},
-		{"session", CreateSessionTableSQL},
-		{"verification", CreateVerificationTableSQL},
-		{"provider", CreateProviderTableSQL},
-	}
-
-	for _, table := range tables {
-		fmt.Printf("Processing %s table for entity: %s\n", table.name, *entityName)
-		created, err := table.createFunc(tx, *entityName)
+	if *dryRun {
+		result, err := commonuser.MigrateDryRun(context.Background(), db, *entityName)
 		if err != nil {
-			tx.Rollback()
-			log.Fatalf("Failed to create %s table: %v", table.name, err)
-		}
-
-		if created {
-			fmt.Printf("✓ %s table created successfully\n", capitalizeWords(table.name))
-		} else {
-			fmt.Printf("⚠ %s table already exists - skipping creation\n", capitalizeWords(table.name))
+			log.Fatalf("Failed to plan migration: %v", err)
 		}
-	}
-
-	// Commit transaction
-	if err := tx.Commit(); err != nil {
-		log.Fatalf("Failed to commit transaction: %v", err)
-	}
-
-	fmt.Println("\nAll tables created successfully!")
-}
-
-func capitalizeWords(s string) string {
-	words := strings.Fields(s)
-	for i, word := range words {
-		if len(word) > 0 {
-			words[i] = strings.ToUpper(word[:1]) + word[1:]
+		if len(result.Applied) == 0 {
+			fmt.Println("Nothing to migrate.")
+			return
 		}
-	}
-	return strings.Join(words, " ")
-}
-
-func contains(slice []string, item string) bool {
-	for _, s := range slice {
-		if strings.TrimSpace(s) == item {
-			return true
+		for _, statement := range result.Statements {
+			fmt.Println(strings.TrimSpace(statement))
+			fmt.Println()
 		}
+		return
 	}
-	return false
-}
 
-func CreateResetPasswordTableSQL(tx *sql.Tx, entityName string) (bool, error) {
-	tableName := entityName + "_reset_password"
-	query := `CREATE TABLE IF NOT EXISTS ` + tableName + ` (
-		uuid VARCHAR(255) PRIMARY KEY,
-		randid VARCHAR(255) UNIQUE,
-		created_at TIMESTAMP DEFAULT NOW(),
-		updated_at TIMESTAMP DEFAULT NOW(),
-		account_uuid VARCHAR(255) NOT NULL,
-		token VARCHAR(255) UNIQUE NOT NULL,
-		expired_at TIMESTAMP
-    );
-    
-    CREATE INDEX IF NOT EXISTS idx_` + tableName + `_token ON ` + tableName + `(token);`
-
-	result, err := tx.Exec(query)
+	result, err := commonuser.Migrate(context.Background(), db, *entityName)
 	if err != nil {
-		return false, err
+		log.Fatalf("Migration failed, no changes were applied: %v", err)
 	}
-
-	rowsAffected, _ := result.RowsAffected()
-	return rowsAffected > 0, nil
-}
-
-func CreateAccountTableSQL(tx *sql.Tx, entityName string) (bool, error) {
-	query := `CREATE TABLE IF NOT EXISTS ` + entityName + ` (
-		uuid VARCHAR(255) PRIMARY KEY,
-		randid VARCHAR(255) UNIQUE,
-		created_at TIMESTAMP DEFAULT NOW(),
-		updated_at TIMESTAMP DEFAULT NOW(),
-		name VARCHAR(255),
-		username VARCHAR(255) UNIQUE,
-		password VARCHAR(255) NOT NULL,
-		email VARCHAR(255) UNIQUE NOT NULL,
-		avatar VARCHAR(255),
-		email_verified BOOLEAN DEFAULT FALSE
-    );
-    CREATE INDEX IF NOT EXISTS idx_` + entityName + `_email ON ` + entityName + `(email);
-	CREATE INDEX IF NOT EXISTS idx_` + entityName + `_randid ON ` + entityName + `(randid);
-	CREATE INDEX IF NOT EXISTS idx_` + entityName + `_uuid ON ` + entityName + `(uuid);
-    CREATE INDEX IF NOT EXISTS idx_` + entityName + `_username ON ` + entityName + `(username);`
-
-	result, err := tx.Exec(query)
-	if err != nil {
-		return false, err
+	if len(result.Applied) == 0 {
+		fmt.Println("⚠ Schema is already up to date - skipping")
+		return
 	}
-
-	rowsAffected, _ := result.RowsAffected()
-	return rowsAffected > 0, nil
-}
-
-func CreateUpdateEmailTableSQL(tx *sql.Tx, entityName string) (bool, error) {
-	tableName := entityName + "_update_email"
-	query := `CREATE TABLE IF NOT EXISTS ` + tableName + ` (
-		uuid UUID PRIMARY KEY DEFAULT gen_random_uuid(),
-		randid VARCHAR(255) UNIQUE,
-		created_at TIMESTAMP DEFAULT NOW(),
-		updated_at TIMESTAMP DEFAULT NOW(),
-		account_uuid UUID NOT NULL,
-		previous_email_address VARCHAR(255),
-		new_email_address VARCHAR(255) UNIQUE NOT NULL,
-		reset_token VARCHAR(255) NOT NULL,
-		revoke_token VARCHAR(255) NOT NULL,
-		processed BOOLEAN DEFAULT FALSE,
-		expired_at TIMESTAMP
-    );
-    CREATE INDEX IF NOT EXISTS idx_` + tableName + `_account_uuid ON ` + tableName + `(account_uuid);
-    CREATE INDEX IF NOT EXISTS idx_` + tableName + `_new_email_address ON ` + tableName + `(new_email_address);`
-
-	result, err := tx.Exec(query)
-	if err != nil {
-		return false, err
+	for _, migration := range result.Applied {
+		fmt.Printf("✓ %d %s\n", migration.Version, capitalizeWords(migration.Name))
 	}
 
-	rowsAffected, _ := result.RowsAffected()
-	return rowsAffected > 0, nil
+	fmt.Println("\nAll migrations applied successfully!")
 }
 
-func CreateSessionTableSQL(tx *sql.Tx, entityName string) (bool, error) {
-	tableName := entityName + "_session"
-	query := `CREATE TABLE IF NOT EXISTS ` + tableName + ` (
-       uuid VARCHAR(255) PRIMARY KEY,
-       randid VARCHAR(255) UNIQUE,
-       created_at TIMESTAMP DEFAULT NOW(),
-       updated_at TIMESTAMP DEFAULT NOW(),
-       last_active_at TIMESTAMP DEFAULT NOW(),
-       account_uuid VARCHAR(255) NOT NULL,
-       device_id VARCHAR(255),
-       device_type TEXT,
-       user_agent TEXT,
-       refresh_token VARCHAR(255) UNIQUE NOT NULL,
-       expired_at TIMESTAMP NOT NULL,
-       revoked BOOLEAN DEFAULT TRUE
-    );
-    CREATE INDEX IF NOT EXISTS idx_` + tableName + `_account_uuid ON ` + tableName + `(account_uuid);
-    CREATE INDEX IF NOT EXISTS idx_` + tableName + `_refresh_token ON ` + tableName + `(refresh_token);
-    CREATE INDEX IF NOT EXISTS idx_` + tableName + `_randid ON ` + tableName + `(randid);
-    CREATE INDEX IF NOT EXISTS idx_` + tableName + `_expired_at ON ` + tableName + `(expired_at);`
-
-	result, err := tx.Exec(query)
+func verifySchema(db *sql.DB, entityName string) {
+	report, err := schema.Check(context.Background(), db, entityName)
 	if err != nil {
-		return false, err
+		log.Fatalf("Failed to inspect schema: %v", err)
 	}
 
-	rowsAffected, _ := result.RowsAffected()
-	return rowsAffected > 0, nil
-}
-
-func CreateVerificationTableSQL(tx *sql.Tx, entityName string) (bool, error) {
-	tableName := entityName + "_verification"
-	query := `CREATE TABLE IF NOT EXISTS ` + tableName + ` (
-		uuid VARCHAR(255) PRIMARY KEY,
-		randid VARCHAR(255) UNIQUE,
-		created_at TIMESTAMP DEFAULT NOW(),
-		updated_at TIMESTAMP DEFAULT NOW(),
-		account_uuid VARCHAR(255) NOT NULL,
-		code VARCHAR(255) NOT NULL
-    );
-    CREATE INDEX IF NOT EXISTS idx_` + tableName + `_account_uuid ON ` + tableName + `(account_uuid);
-    CREATE INDEX IF NOT EXISTS idx_` + tableName + `_code ON ` + tableName + `(code);`
-
-	result, err := tx.Exec(query)
-	if err != nil {
-		return false, err
+	for _, issue := range report.Issues {
+		if issue.Kind == schema.ExtraColumn {
+			fmt.Printf("⚠ %s\n", issue)
+		} else {
+			fmt.Printf("✗ %s\n", issue)
+		}
 	}
 
-	rowsAffected, _ := result.RowsAffected()
-	return rowsAffected > 0, nil
+	if !report.OK() {
+		fmt.Println("\nSchema does not match the repositories.")
+		os.Exit(1)
+	}
+	fmt.Println("\nSchema matches the repositories.")
 }
 
-func CreateProviderTableSQL(tx *sql.Tx, entityName string) (bool, error) {
-	tableName := entityName + "_provider"
-	query := `CREATE TABLE IF NOT EXISTS ` + tableName + ` (
-		uuid VARCHAR(255) PRIMARY KEY,
-		randid VARCHAR(255) UNIQUE,
-		created_at TIMESTAMP DEFAULT NOW(),
-		updated_at TIMESTAMP DEFAULT NOW(),
-		name VARCHAR(255),
-		email VARCHAR(255),
-		sub VARCHAR(255),
-		issuer VARCHAR(255),
-		account_uuid VARCHAR(255)
-    );
-    CREATE INDEX IF NOT EXISTS idx_` + tableName + `_email ON ` + tableName + `(email);
-    CREATE INDEX IF NOT EXISTS idx_` + tableName + `_sub ON ` + tableName + `(sub);
-    CREATE INDEX IF NOT EXISTS idx_` + tableName + `_issuer ON ` + tableName + `(issuer);
-    CREATE INDEX IF NOT EXISTS idx_` + tableName + `_account_uuid ON ` + tableName + `(account_uuid);`
-
-	result, err := tx.Exec(query)
-	if err != nil {
-		return false, err
+func capitalizeWords(s string) string {
+	words := strings.Fields(s)
+	for i, word := range words {
+		if len(word) > 0 {
+			words[i] = strings.ToUpper(word[:1]) + word[1:]
+		}
 	}
-
-	rowsAffected, _ := result.RowsAffected()
-	return rowsAffected > 0, nil
+	return strings.Join(words, " ")
 }
@@ -2,14 +2,116 @@ package config
 
 import "time"
 
+type SessionLimitPolicy string
+
+const (
+	// EvictOldest revokes the least recently active sessions to make room.
+	EvictOldest SessionLimitPolicy = "evict_oldest"
+	// RejectNew refuses the sign in while the account is at its limit.
+	RejectNew SessionLimitPolicy = "reject_new"
+)
+
+// SessionLimit caps how many active sessions an account may hold, overall and
+// per device type. Zero means unlimited.
+type SessionLimit struct {
+	MaxSessions      int
+	MaxPerDeviceType map[string]int
+	Policy           SessionLimitPolicy
+}
+
+func (l SessionLimit) Enabled() bool {
+	return l.MaxSessions > 0 || len(l.MaxPerDeviceType) > 0
+}
+
+// Janitor controls the background sweep that deletes expired sessions and
+// stale tickets. Zero values fall back to the janitor's defaults.
+type Janitor struct {
+	Interval  time.Duration
+	BatchSize int
+}
+
+// Verification shapes email and phone verification codes and sign in codes. A code is CodeLength
+// characters drawn from CodeAlphabet, expires after CodeTTL and is burned
+// after MaxAttempts wrong guesses. ResendCooldown is the minimum time between
+// two codes for the same account.
+type Verification struct {
+	CodeLength     int
+	CodeAlphabet   string
+	CodeTTL        time.Duration
+	MaxAttempts    int
+	ResendCooldown time.Duration
+}
+
+// Username is the username policy. Usernames are MinLength to MaxLength
+// letters and digits, with Punctuation allowed after the first character.
+// Reserved names also block their lookalikes; nil uses the built-in list and
+// an empty slice reserves nothing. Zero values fall back to the defaults.
+//
+// ChangeCooldown is the minimum time between two username changes. A name
+// given up is held for HoldPeriod: nobody else can take it and it still
+// resolves to the account that moved away. Zero disables either.
+type Username struct {
+	MinLength      int
+	MaxLength      int
+	Punctuation    string
+	Reserved       []string
+	ChangeCooldown time.Duration
+	HoldPeriod     time.Duration
+}
+
+// Email controls how addresses are canonicalized for uniqueness and lookups.
+// ProviderRules also folds provider specific spellings, such as Gmail's
+// ignored dots and plus tags, onto one address.
+type Email struct {
+	ProviderRules bool
+}
+
+// Outbox controls the relay that moves events from <entity>_outbox to a Redis
+// Stream. Zero values fall back to the relay's defaults; an empty Stream is
+// "<entity>:events".
+type Outbox struct {
+	Stream       string
+	Interval     time.Duration
+	BatchSize    int
+	MaxAttempts  int
+	RetryBackoff time.Duration
+}
+
 type App struct {
 	RecordAge     time.Duration
 	PaginationAge time.Duration
+	// MissingAge is how long a lookup by username, email address, uuid, phone
+	// number or randId that found no account is remembered, so repeated misses
+	// do not reach the database. Writes that cache an account under a key clear
+	// the marker; a key that only appears in the database some other way reads
+	// as missing for up to MissingAge. Zero disables negative caching.
+	MissingAge time.Duration
+	// ReadThrough makes Fetch seed the cache from the database on a miss
+	// instead of returning AccountSeedRequired.
+	ReadThrough   bool
 	EntityName    string
 	TokenLifespan time.Duration
 	JWTSecret     string
 	JWTIssuer     string
 	JWTLifespan   time.Duration
+	// JWTAttributes names the account attributes copied into access tokens.
+	// Tokens carry them until they expire, so leave out anything that must
+	// not be stale or readable by the client.
+	JWTAttributes []string
+	SessionLimit  SessionLimit
+	// SessionIdleTimeout signs a session out after this long without activity.
+	// SessionMaxLifetime caps how long refreshing can keep a session alive.
+	// Zero disables either check.
+	SessionIdleTimeout time.Duration
+	SessionMaxLifetime time.Duration
+	Janitor            Janitor
+	Outbox             Outbox
+	Verification       Verification
+	Username           Username
+	Email              Email
+	// DefaultCountryCode is the calling code, without "+", assumed for phone
+	// numbers given in national format with a leading 0. Empty rejects them.
+	DefaultCountryCode string
 }
 
 func (a *App) GetRecordAge() time.Duration {
@@ -28,10 +130,27 @@ func DefaultConfig(entityName string, jwtSecret string, jwtIssuer string, jwtLif
 	return &App{
 		RecordAge:     time.Hour * 12,
 		PaginationAge: time.Hour * 24,
+		MissingAge:    time.Second * 30,
 		TokenLifespan: time.Hour * 24,
 		EntityName:    entityName,
 		JWTSecret:     jwtSecret,
 		JWTIssuer:     jwtIssuer,
 		JWTLifespan:   jwtLifespan,
+		SessionLimit:  SessionLimit{Policy: EvictOldest},
+		Janitor: Janitor{
+			Interval:  time.Minute * 10,
+			BatchSize: 500,
+		},
+		Verification: Verification{
+			CodeLength:     6,
+			CodeAlphabet:   "0123456789",
+			CodeTTL:        time.Minute * 15,
+			MaxAttempts:    5,
+			ResendCooldown: time.Minute,
+		},
+		Username: Username{
+			ChangeCooldown: time.Hour * 24 * 30,
+			HoldPeriod:     time.Hour * 24 * 14,
+		},
 	}
 }
@@ -0,0 +1,155 @@
+package cache
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"github.com/21strive/commonuser/internal/types"
+	"github.com/redis/go-redis/v9"
+	"strconv"
+	"strings"
+)
+
+// Pipeline holds the cache writes made inside a SQL transaction until the
+// transaction commits. It can be passed wherever the WithTransaction paths
+// take a redis.Pipeliner; finish it with Commit or Rollback, never Exec.
+type Pipeline struct {
+	redis.Pipeliner
+	client redis.UniversalClient
+	hooks  []TxHook
+}
+
+// TxHook is told how a transaction finished through a Pipeline ended.
+type TxHook interface {
+	Committed(ctx context.Context, tx types.SQLExecutor)
+	RolledBack(tx types.SQLExecutor)
+}
+
+// Commit commits tx and only then sends the queued cache writes. When the
+// commit fails the writes are dropped.
+func (p *Pipeline) Commit(ctx context.Context, tx *sql.Tx) error {
+	errCommit := tx.Commit()
+	if errCommit != nil {
+		p.Discard()
+		p.rolledBack(tx)
+		return errCommit
+	}
+	errFlush := Flush(ctx, p.client, p.Pipeliner)
+	for _, hook := range p.hooks {
+		hook.Committed(ctx, tx)
+	}
+	return errFlush
+}
+
+// Rollback drops the queued cache writes and rolls tx back.
+func (p *Pipeline) Rollback(tx *sql.Tx) error {
+	p.Discard()
+	p.rolledBack(tx)
+	return tx.Rollback()
+}
+
+func (p *Pipeline) rolledBack(tx *sql.Tx) {
+	for _, hook := range p.hooks {
+		hook.RolledBack(tx)
+	}
+}
+
+func NewPipeline(client redis.UniversalClient, hooks ...TxHook) *Pipeline {
+	return &Pipeline{Pipeliner: client.Pipeline(), client: client, hooks: hooks}
+}
+
+// Flush sends the writes queued on pipe after the SQL they mirror has been
+// committed. When some of them fail, the keys they touched are deleted so the
+// next read seeds them from the database instead of serving stale entries; an
+// error is only returned when that fallback fails too. Replies of redis.Nil
+// are not failures.
+func Flush(ctx context.Context, client redis.Cmdable, pipe redis.Pipeliner) error {
+	cmds, errExec := pipe.Exec(ctx)
+	if errExec == nil {
+		return nil
+	}
+
+	// Exec reports the first error only, which may be a redis.Nil in front of
+	// real failures
+	errFailed := firstFailure(cmds)
+	if errFailed == nil {
+		if errors.Is(errExec, redis.Nil) {
+			return nil
+		}
+		errFailed = errExec
+	}
+
+	keys := failedKeys(cmds)
+	if len(keys) == 0 {
+		return errFailed
+	}
+	errDel := client.Del(ctx, keys...).Err()
+	if errDel != nil {
+		return errors.Join(errFailed, errDel)
+	}
+	return nil
+}
+
+func failed(cmd redis.Cmder) bool {
+	return cmd.Err() != nil && !errors.Is(cmd.Err(), redis.Nil)
+}
+
+func firstFailure(cmds []redis.Cmder) error {
+	for _, cmd := range cmds {
+		if failed(cmd) {
+			return cmd.Err()
+		}
+	}
+	return nil
+}
+
+func failedKeys(cmds []redis.Cmder) []string {
+	var keys []string
+	for _, cmd := range cmds {
+		if !failed(cmd) {
+			continue
+		}
+		args := cmd.Args()
+		switch strings.ToLower(cmd.Name()) {
+		case "eval", "evalsha":
+			if len(args) < 3 {
+				continue
+			}
+			numKeys, errParse := strconv.Atoi(toString(args[2]))
+			if errParse != nil {
+				continue
+			}
+			for i := 3; i < 3+numKeys && i < len(args); i++ {
+				keys = appendKey(keys, args[i])
+			}
+		default:
+			if len(args) > 1 {
+				keys = appendKey(keys, args[1])
+			}
+		}
+	}
+	return keys
+}
+
+func appendKey(keys []string, arg interface{}) []string {
+	key := toString(arg)
+	if key == "" {
+		return keys
+	}
+	return append(keys, key)
+}
+
+func toString(arg interface{}) string {
+	switch value := arg.(type) {
+	case string:
+		return value
+	case []byte:
+		return string(value)
+	case int:
+		return strconv.Itoa(value)
+	case int64:
+		return strconv.FormatInt(value, 10)
+	default:
+		return ""
+	}
+}
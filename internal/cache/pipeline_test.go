@@ -0,0 +1,90 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"github.com/redis/go-redis/v9"
+	"net"
+	"sync"
+	"testing"
+)
+
+// scriptedHook answers commands without dialling: keys listed in replies get
+// that error, everything else succeeds. Deleted keys are recorded.
+type scriptedHook struct {
+	replies map[string]error
+	mu      sync.Mutex
+	deleted []string
+}
+
+func (h *scriptedHook) DialHook(next redis.DialHook) redis.DialHook {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return nil, errors.New("scriptedHook does not dial")
+	}
+}
+
+func (h *scriptedHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		if cmd.Name() == "del" {
+			h.mu.Lock()
+			for _, arg := range cmd.Args()[1:] {
+				h.deleted = append(h.deleted, toString(arg))
+			}
+			h.mu.Unlock()
+		}
+		return nil
+	}
+}
+
+func (h *scriptedHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		// like the client, report the first error of the pipeline
+		var first error
+		for _, cmd := range cmds {
+			if len(cmd.Args()) > 1 {
+				if err, found := h.replies[toString(cmd.Args()[1])]; found {
+					cmd.SetErr(err)
+					if first == nil {
+						first = err
+					}
+				}
+			}
+		}
+		return first
+	}
+}
+
+func TestFlush(t *testing.T) {
+	errDown := errors.New("READONLY You can't write against a read only replica")
+	tests := []struct {
+		name    string
+		replies map[string]error
+		deleted []string
+	}{
+		{name: "all succeed"},
+		{name: "nil reply only", replies: map[string]error{"a": redis.Nil}},
+		{name: "failure after a nil reply", replies: map[string]error{"a": redis.Nil, "c": errDown}, deleted: []string{"c"}},
+		{name: "failure before a nil reply", replies: map[string]error{"a": errDown, "c": redis.Nil}, deleted: []string{"a"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			hook := &scriptedHook{replies: test.replies}
+			client := redis.NewClient(&redis.Options{Addr: "127.0.0.1:0"})
+			client.AddHook(hook)
+
+			pipe := client.Pipeline()
+			pipe.Get(context.Background(), "a")
+			pipe.Set(context.Background(), "b", "1", 0)
+			pipe.Set(context.Background(), "c", "1", 0)
+
+			errFlush := Flush(context.Background(), client, pipe)
+			if errFlush != nil {
+				t.Fatalf("Flush() = %v", errFlush)
+			}
+			if len(hook.deleted) != len(test.deleted) || (len(test.deleted) > 0 && hook.deleted[0] != test.deleted[0]) {
+				t.Fatalf("deleted %v, want %v", hook.deleted, test.deleted)
+			}
+		})
+	}
+}
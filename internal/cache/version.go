@@ -0,0 +1,77 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"github.com/redis/go-redis/v9"
+	"math"
+	"strconv"
+	"time"
+)
+
+// setIfNewer only ever moves a counter forward, so a writer that read an
+// older row cannot undo a newer one. ARGV[2] is the TTL in milliseconds, 0
+// for none.
+var setIfNewer = redis.NewScript(`
+local current = redis.call('GET', KEYS[1])
+if current and tonumber(current) > tonumber(ARGV[1]) then
+	return 0
+end
+if tonumber(ARGV[2]) > 0 then
+	redis.call('SET', KEYS[1], ARGV[1], 'PX', ARGV[2])
+else
+	redis.call('SET', KEYS[1], ARGV[1])
+end
+return 1
+`)
+
+// SetIfNewer queues setting key to value unless it already holds a greater
+// one. Use it for counters that only grow, like token versions.
+func SetIfNewer(ctx context.Context, pipe redis.Scripter, key string, value int64, ttl time.Duration) *redis.Cmd {
+	return setIfNewer.Eval(ctx, pipe, []string{key}, value, ttl.Milliseconds())
+}
+
+// Versions remembers the latest version written for each cached entry.
+// Entries carry the version they were written with; one older than the
+// remembered version lost a race with a newer write and is treated as a miss.
+type Versions struct {
+	redis  redis.UniversalClient
+	prefix string
+	ttl    time.Duration
+}
+
+func (v *Versions) key(id string) string {
+	return v.prefix + id
+}
+
+// Set queues recording version for the entry, unless a newer one is recorded.
+func (v *Versions) Set(ctx context.Context, pipe redis.Pipeliner, id string, version int64) {
+	SetIfNewer(ctx, pipe, v.key(id), version, v.ttl)
+}
+
+// Tombstone queues marking every version of a deleted entry as stale, so a
+// late write cannot bring it back.
+func (v *Versions) Tombstone(ctx context.Context, pipe redis.Pipeliner, id string) {
+	SetIfNewer(ctx, pipe, v.key(id), math.MaxInt64, v.ttl)
+}
+
+// IsStale reports whether a newer version than version has been written for
+// the entry.
+func (v *Versions) IsStale(ctx context.Context, id string, version int64) (bool, error) {
+	latest, errGet := v.redis.Get(ctx, v.key(id)).Result()
+	if errGet != nil {
+		if errors.Is(errGet, redis.Nil) {
+			return false, nil
+		}
+		return false, errGet
+	}
+	latestVersion, errParse := strconv.ParseInt(latest, 10, 64)
+	if errParse != nil {
+		return false, errParse
+	}
+	return version < latestVersion, nil
+}
+
+func NewVersions(client redis.UniversalClient, prefix string, ttl time.Duration) *Versions {
+	return &Versions{redis: client, prefix: prefix, ttl: ttl}
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"github.com/21strive/commonuser/config"
+	"github.com/21strive/commonuser/internal/cache"
 	"github.com/21strive/commonuser/internal/model"
 
 	"github.com/21strive/redifu"
@@ -14,6 +15,10 @@ type AccountFetcher struct {
 	redis         redis.UniversalClient
 	base          *redifu.Base[*model.Account]
 	baseReference *redifu.Base[*model.AccountReference]
+	baseEmail     *redifu.Base[*model.AccountReference]
+	baseUUID      *redifu.Base[*model.AccountReference]
+	basePhone     *redifu.Base[*model.AccountReference]
+	versions      *cache.Versions
 	entityName    string
 }
 
@@ -21,8 +26,11 @@ func (af *AccountFetcher) Base() *redifu.Base[*model.Account] {
 	return af.base
 }
 
-func (af *AccountFetcher) FetchByUsername(ctx context.Context, username string) (*model.Account, error) {
-	isMissing, errCheck := af.baseReference.IsMissing(ctx, username)
+// fetchByReference resolves key through the reference base to the cached
+// account. It returns nil, nil when the reference or the account has not been
+// seeded, and AccountDoesNotExists when the key is remembered as missing.
+func (af *AccountFetcher) fetchByReference(ctx context.Context, baseReference *redifu.Base[*model.AccountReference], key string) (*model.Account, error) {
+	isMissing, errCheck := baseReference.IsMissing(ctx, key)
 	if errCheck != nil {
 		return nil, errCheck
 	}
@@ -30,22 +38,48 @@ func (af *AccountFetcher) FetchByUsername(ctx context.Context, username string)
 		return nil, model.AccountDoesNotExists
 	}
 
-	accountRef, errGetRef := af.baseReference.Get(ctx, username)
+	accountRef, errGetRef := baseReference.Get(ctx, key)
 	if errGetRef != nil {
+		if errors.Is(errGetRef, redis.Nil) {
+			return nil, nil
+		}
 		return nil, errGetRef
 	}
-	if accountRef.AccountRandId == "" {
+	if accountRef == nil || accountRef.AccountRandId == "" {
 		return nil, nil
 	}
 
-	account, err := af.base.Get(ctx, accountRef.AccountRandId)
-	if err != nil {
-		return nil, err
-	}
-	return account, nil
+	return af.FetchByRandId(ctx, accountRef.AccountRandId)
+}
+
+func (af *AccountFetcher) FetchByUsername(ctx context.Context, username string) (*model.Account, error) {
+	return af.fetchByReference(ctx, af.baseReference, username)
+}
+
+// FetchByEmail expects the email key, see Base.EmailKey.
+func (af *AccountFetcher) FetchByEmail(ctx context.Context, email string) (*model.Account, error) {
+	return af.fetchByReference(ctx, af.baseEmail, email)
+}
+
+func (af *AccountFetcher) FetchByUUID(ctx context.Context, uuid string) (*model.Account, error) {
+	return af.fetchByReference(ctx, af.baseUUID, uuid)
+}
+
+func (af *AccountFetcher) FetchByPhone(ctx context.Context, phone string) (*model.Account, error) {
+	return af.fetchByReference(ctx, af.basePhone, phone)
 }
 
+// FetchByRandId returns nil, nil when the account has not been seeded or the
+// cached copy is older than the latest write.
 func (af *AccountFetcher) FetchByRandId(ctx context.Context, randId string) (*model.Account, error) {
+	isMissing, errCheck := af.base.IsMissing(ctx, randId)
+	if errCheck != nil {
+		return nil, errCheck
+	}
+	if isMissing {
+		return nil, model.AccountDoesNotExists
+	}
+
 	account, err := af.base.Get(ctx, randId)
 	if err != nil {
 		if errors.Is(err, redis.Nil) {
@@ -53,6 +87,17 @@ func (af *AccountFetcher) FetchByRandId(ctx context.Context, randId string) (*mo
 		}
 		return nil, err
 	}
+	if account == nil {
+		return nil, nil
+	}
+
+	stale, errCheck := af.versions.IsStale(ctx, randId, account.Revision)
+	if errCheck != nil {
+		return nil, errCheck
+	}
+	if stale {
+		return nil, nil
+	}
 	return account, nil
 }
 
@@ -64,11 +109,15 @@ func (af *AccountFetcher) AccountExists(ctx context.Context, randId string) erro
 	return af.base.Exists(ctx, randId)
 }
 
-func NewAccountFetchers(redis redis.UniversalClient, baseAccount *redifu.Base[*model.Account], baseReference *redifu.Base[*model.AccountReference], app *config.App) *AccountFetcher {
+func NewAccountFetchers(redis redis.UniversalClient, baseAccount *redifu.Base[*model.Account], baseReference *redifu.Base[*model.AccountReference], baseEmail *redifu.Base[*model.AccountReference], baseUUID *redifu.Base[*model.AccountReference], basePhone *redifu.Base[*model.AccountReference], versions *cache.Versions, app *config.App) *AccountFetcher {
 	return &AccountFetcher{
 		redis:         redis,
 		base:          baseAccount,
 		baseReference: baseReference,
+		baseEmail:     baseEmail,
+		baseUUID:      baseUUID,
+		basePhone:     basePhone,
+		versions:      versions,
 		entityName:    app.EntityName,
 	}
 }
@@ -2,8 +2,10 @@ package fetcher
 
 import (
 	"context"
+	"errors"
 	"github.com/21strive/commonuser/internal/model"
 	"github.com/21strive/redifu"
+	"github.com/redis/go-redis/v9"
 )
 
 type SessionFetcher struct {
@@ -13,6 +15,9 @@ type SessionFetcher struct {
 func (sf *SessionFetcher) FetchByRandId(ctx context.Context, randId string) (*model.Session, error) {
 	session, err := sf.base.Get(ctx, randId)
 	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			return nil, nil
+		}
 		return nil, err
 	}
 	return session, nil
@@ -22,7 +22,6 @@ func (jh *JWTHandler) ParseJWT(jwtToken string, expectedStruct interface{ jwt.Cl
 		return []byte(jh.jwtSecret), nil
 	})
 	if err != nil {
-		fmt.Println(err)
 		return nil, err
 	}
 
@@ -1,6 +1,9 @@
 package jwt_impl
 
-import "github.com/golang-jwt/jwt/v5"
+import (
+	"encoding/json"
+	"github.com/golang-jwt/jwt/v5"
+)
 
 type UserClaims struct {
 	UUID      string `json:"uuid"` // user uuid
@@ -8,8 +11,14 @@ type UserClaims struct {
 	Name      string `json:"name"`
 	Username  string `json:"username,omitempty"`
 	Email     string `json:"email,omitempty"`
+	Phone     string `json:"phone,omitempty"`
 	Avatar    string `json:"avatar,omitempty"`
 	Verified  bool   `json:"verified"`
 	SessionID string `json:"sessionid"`
+	// TokenVersion is the account's token version when the token was issued;
+	// tokens carrying an older version than the account's are rejected.
+	TokenVersion int64 `json:"tokenVersion"`
+	// Attributes are the account attributes listed in config.App.JWTAttributes.
+	Attributes map[string]json.RawMessage `json:"attributes,omitempty"`
 	jwt.RegisteredClaims
 }
@@ -1,11 +1,14 @@
 package model
 
 import (
+	"encoding/json"
 	"errors"
+	"fmt"
 	"github.com/21strive/commonuser/internal/jwt_impl"
 	"github.com/21strive/redifu"
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/matthewhartstonge/argon2"
+	"strings"
 	"time"
 )
 
@@ -13,6 +16,17 @@ var AccountDoesNotExists = errors.New("account does not exists")
 var AccountSeedRequired = errors.New("account seed is required")
 var Unauthorized = errors.New("unauthorized")
 var InvalidSession = errors.New("invalid session")
+var TokenRevoked = fmt.Errorf("%w: token revoked", Unauthorized)
+var AccountSuspended = fmt.Errorf("%w: account suspended", Unauthorized)
+var InvalidPhoneNumber = errors.New("invalid phone number")
+var IdentifierRequired = errors.New("an email address or phone number is required")
+var PhoneRequired = errors.New("account has no phone number")
+
+// Account statuses. A status change revokes the account's access tokens.
+const (
+	StatusActive    = "active"
+	StatusSuspended = "suspended"
+)
 
 type AssociatedAccount struct {
 	Name     string `json:"name,omitempty" db:"-"`
@@ -23,13 +37,29 @@ type AssociatedAccount struct {
 }
 
 type Base struct {
-	Name              string              `json:"name,omitempty" db:"name"`
-	Username          string              `json:"username,omitempty" db:"username"`
-	Password          string              `json:"-" db:"password"`
-	Email             string              `json:"email,omitempty" db:"email"`
-	Avatar            string              `json:"avatar,omitempty" db:"avatar"`
-	EmailVerified     bool                `json:"email_verified,omitempty" db:"email_verified"`
+	Name              string `json:"name,omitempty" db:"name"`
+	Username          string `json:"username,omitempty" db:"username"`
+	UsernameCanonical string `json:"usernameCanonical,omitempty" db:"username_canonical"`
+	UsernameSkeleton  string `json:"-" db:"username_skeleton"`
+	Password          string `json:"-" db:"password"`
+	Email             string `json:"email,omitempty" db:"email"`
+	EmailCanonical    string `json:"emailCanonical,omitempty" db:"email_canonical"`
+	Avatar            string `json:"avatar,omitempty" db:"avatar"`
+	EmailVerified     bool   `json:"email_verified,omitempty" db:"email_verified"`
+	Phone             string `json:"phone,omitempty" db:"phone"`
+	PhoneVerified     bool   `json:"phone_verified,omitempty" db:"phone_verified"`
+	TokenVersion      int64  `json:"tokenVersion,omitempty" db:"token_version"`
+	Status            string `json:"status,omitempty" db:"status"`
+	// Revision counts the writes to the row; cached copies carry the revision
+	// they were read at.
+	Revision int64 `json:"revision,omitempty" db:"revision"`
+	// Attributes are the app defined profile fields, a JSON object. Read and
+	// write them with GetAttributes and SetAttributes.
+	Attributes        json.RawMessage     `json:"attributes,omitempty" db:"attributes"`
 	AssociatedAccount []AssociatedAccount `json:"associatedAccount,omitempty" db:"-"`
+	// MovedFrom is the username the account was looked up by when it has since
+	// moved to another one, see config.Username.HoldPeriod.
+	MovedFrom string `json:"-" db:"-"`
 }
 
 func (b *Base) SetName(name string) {
@@ -40,6 +70,20 @@ func (b *Base) SetUsername(username string) {
 	b.Username = username
 }
 
+// UsernameKey is what the username reference is cached under: the canonical
+// form, or the raw username for rows that predate canonical usernames.
+func (b *Base) UsernameKey() string {
+	if b.UsernameCanonical != "" {
+		return b.UsernameCanonical
+	}
+	return b.Username
+}
+
+// IsMoved reports whether the account was found under a username it gave up.
+func (b *Base) IsMoved() bool {
+	return b.MovedFrom != ""
+}
+
 func (b *Base) SetPassword(password string) error {
 	argon := argon2.DefaultConfig()
 	encoded, err := argon.HashEncoded([]byte(password))
@@ -66,10 +110,39 @@ func (b *Base) SetEmail(email string) {
 	b.Email = email
 }
 
+// EmailKey is what the account is looked up by email with: the canonical
+// form, or the raw address for rows that predate canonical emails.
+func (b *Base) EmailKey() string {
+	if b.EmailCanonical != "" {
+		return b.EmailCanonical
+	}
+	return b.Email
+}
+
 func (b *Base) SetEmailVerified() {
 	b.EmailVerified = true
 }
 
+// SetPhone stores phone as given; AccountOps normalizes it to E.164 on
+// register and update.
+func (b *Base) SetPhone(phone string) {
+	b.Phone = phone
+}
+
+func (b *Base) SetPhoneVerified() {
+	b.PhoneVerified = true
+}
+
+func (b *Base) SetStatus(status string) {
+	b.Status = status
+}
+
+// IsActive reports whether the account may sign in. Cached copies from before
+// statuses carry none and count as active.
+func (b *Base) IsActive() bool {
+	return b.Status == "" || b.Status == StatusActive
+}
+
 func (b *Base) SetAvatar(avatar string) {
 	b.Avatar = avatar
 }
@@ -78,6 +151,11 @@ func (b *Base) SetAssociatedAccount(associatedAccount AssociatedAccount) {
 	b.AssociatedAccount = append(b.AssociatedAccount, associatedAccount)
 }
 
+// BumpTokenVersion invalidates every access token issued before the call.
+func (b *Base) BumpTokenVersion() {
+	b.TokenVersion++
+}
+
 func (b *Base) IsPasswordExist() bool {
 	return b.Password != ""
 }
@@ -87,19 +165,45 @@ type Account struct {
 	Base
 }
 
-func (asql *Account) GenerateAccessToken(jwtSecret string, jwtTokenIssuer string, jwtTokenLifeSpan time.Duration, sessionID string) (string, error) {
+// Clone returns a copy of the account that shares no state with it.
+func (asql *Account) Clone() *Account {
+	clone := &Account{Base: asql.Base}
+	if asql.Record != nil {
+		record := *asql.Record
+		if record.Foundation != nil {
+			foundation := *record.Foundation
+			record.Foundation = &foundation
+		}
+		clone.Record = &record
+	}
+	clone.Attributes = append(json.RawMessage(nil), asql.Attributes...)
+	clone.AssociatedAccount = append([]AssociatedAccount(nil), asql.AssociatedAccount...)
+	return clone
+}
+
+// GenerateAccessToken signs an access token for the session. claimAttributes
+// names the attributes copied into the token, see config.App.JWTAttributes.
+func (asql *Account) GenerateAccessToken(jwtSecret string, jwtTokenIssuer string, jwtTokenLifeSpan time.Duration, sessionID string, claimAttributes []string) (string, error) {
+	attributes, errAttributes := asql.claimAttributes(claimAttributes)
+	if errAttributes != nil {
+		return "", errAttributes
+	}
+
 	timeNow := time.Now().UTC()
 	expirestAt := timeNow.Add(jwtTokenLifeSpan)
 
 	userClaims := jwt_impl.UserClaims{
-		UUID:      asql.GetUUID(),
-		RandId:    asql.GetRandId(),
-		Name:      asql.Name,
-		Username:  asql.Username,
-		Email:     asql.Email,
-		Avatar:    asql.Avatar,
-		Verified:  asql.EmailVerified,
-		SessionID: sessionID,
+		UUID:         asql.GetUUID(),
+		RandId:       asql.GetRandId(),
+		Name:         asql.Name,
+		Username:     asql.Username,
+		Email:        asql.Email,
+		Avatar:       asql.Avatar,
+		Verified:     asql.EmailVerified,
+		Phone:        asql.Phone,
+		SessionID:    sessionID,
+		TokenVersion: asql.TokenVersion,
+		Attributes:   attributes,
 		RegisteredClaims: jwt.RegisteredClaims{
 			Issuer: jwtTokenIssuer,
 			IssuedAt: &jwt.NumericDate{
@@ -120,11 +224,49 @@ func (asql *Account) GenerateAccessToken(jwtSecret string, jwtTokenIssuer string
 	return tokenString, nil
 }
 
+// NormalizePhone returns phone in E.164 form, e.g. "+628123456789". Spaces,
+// dashes, dots and parentheses are ignored and a "00" prefix is read as "+".
+// A national number with a leading 0 takes defaultCountryCode; without one it
+// is rejected.
+func NormalizePhone(phone string, defaultCountryCode string) (string, error) {
+	var digits strings.Builder
+	for i, r := range strings.TrimSpace(phone) {
+		switch {
+		case r >= '0' && r <= '9':
+			digits.WriteRune(r)
+		case r == '+' && i == 0:
+			digits.WriteRune(r)
+		case r == ' ' || r == '-' || r == '.' || r == '(' || r == ')':
+		default:
+			return "", InvalidPhoneNumber
+		}
+	}
+
+	normalized := digits.String()
+	switch {
+	case strings.HasPrefix(normalized, "+"):
+	case strings.HasPrefix(normalized, "00"):
+		normalized = "+" + normalized[2:]
+	case strings.HasPrefix(normalized, "0") && defaultCountryCode != "":
+		normalized = "+" + strings.TrimPrefix(defaultCountryCode, "+") + normalized[1:]
+	default:
+		return "", InvalidPhoneNumber
+	}
+
+	// E.164 allows at most 15 digits and no leading zero in the country code
+	subscriber := normalized[1:]
+	if len(subscriber) < 8 || len(subscriber) > 15 || subscriber[0] == '0' {
+		return "", InvalidPhoneNumber
+	}
+	return normalized, nil
+}
+
 func NewAccount() *Account {
 	account := &Account{
 		Base: Base{},
 	}
 	account.EmailVerified = false
+	account.Status = StatusActive
 	redifu.InitRecord(account)
 	return account
 }
@@ -0,0 +1,81 @@
+package model
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+var InvalidCursor = errors.New("invalid cursor")
+
+const (
+	DefaultAccountPageSize = 20
+	MaxAccountPageSize     = 100
+)
+
+// AccountFilter narrows AccountOps.List. Zero fields match every account;
+// the prefixes are matched case insensitively.
+type AccountFilter struct {
+	EmailVerified  *bool     `json:"emailVerified,omitempty"`
+	PhoneVerified  *bool     `json:"phoneVerified,omitempty"`
+	CreatedAfter   time.Time `json:"createdAfter,omitempty"`
+	CreatedBefore  time.Time `json:"createdBefore,omitempty"`
+	UsernamePrefix string    `json:"usernamePrefix,omitempty"`
+	EmailPrefix    string    `json:"emailPrefix,omitempty"`
+	Status         string    `json:"status,omitempty"`
+	Limit          int       `json:"limit,omitempty"`
+}
+
+func (f *AccountFilter) PageSize() int {
+	if f.Limit <= 0 {
+		return DefaultAccountPageSize
+	}
+	if f.Limit > MaxAccountPageSize {
+		return MaxAccountPageSize
+	}
+	return f.Limit
+}
+
+// CacheKey identifies the page of accounts matching the filter after cursor.
+func (f *AccountFilter) CacheKey(cursor string) string {
+	encoded, _ := json.Marshal(f)
+	sum := sha256.Sum256(append(encoded, cursor...))
+	return hex.EncodeToString(sum[:16])
+}
+
+// AccountPage is one page of AccountOps.List, newest accounts first. Pass
+// NextCursor to get the page after it; it is empty on the last page.
+type AccountPage struct {
+	Accounts   []*Account `json:"accounts"`
+	NextCursor string     `json:"nextCursor,omitempty"`
+}
+
+// AccountCursor is the position after the last account of a page.
+type AccountCursor struct {
+	CreatedAt time.Time
+	UUID      string
+}
+
+func (c AccountCursor) Encode() string {
+	return base64.RawURLEncoding.EncodeToString([]byte(c.CreatedAt.UTC().Format(time.RFC3339Nano) + "|" + c.UUID))
+}
+
+func DecodeAccountCursor(cursor string) (*AccountCursor, error) {
+	decoded, errDecode := base64.RawURLEncoding.DecodeString(cursor)
+	if errDecode != nil {
+		return nil, InvalidCursor
+	}
+	createdAt, uuid, found := strings.Cut(string(decoded), "|")
+	if !found || uuid == "" {
+		return nil, InvalidCursor
+	}
+	parsed, errParse := time.Parse(time.RFC3339Nano, createdAt)
+	if errParse != nil {
+		return nil, InvalidCursor
+	}
+	return &AccountCursor{CreatedAt: parsed, UUID: uuid}, nil
+}
@@ -0,0 +1,57 @@
+package model
+
+import (
+	"encoding/base64"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestAccountCursorRoundTrip(t *testing.T) {
+	tests := []struct {
+		name   string
+		cursor AccountCursor
+	}{
+		{name: "utc", cursor: AccountCursor{CreatedAt: time.Date(2024, 3, 1, 12, 30, 0, 0, time.UTC), UUID: "0b1c6f2e-8d3a-4a57-9a0e-3f1d2c4b5a69"}},
+		{name: "nanoseconds", cursor: AccountCursor{CreatedAt: time.Date(2024, 3, 1, 12, 30, 0, 123456789, time.UTC), UUID: "a"}},
+		{name: "other zone", cursor: AccountCursor{CreatedAt: time.Date(2024, 3, 1, 19, 30, 0, 0, time.FixedZone("WIB", 7*60*60)), UUID: "b"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			decoded, err := DecodeAccountCursor(test.cursor.Encode())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !decoded.CreatedAt.Equal(test.cursor.CreatedAt) || decoded.UUID != test.cursor.UUID {
+				t.Fatalf("decoded %v/%q, want %v/%q", decoded.CreatedAt, decoded.UUID, test.cursor.CreatedAt, test.cursor.UUID)
+			}
+		})
+	}
+}
+
+func TestDecodeAccountCursorInvalid(t *testing.T) {
+	encode := func(raw string) string {
+		return base64.RawURLEncoding.EncodeToString([]byte(raw))
+	}
+	tests := []struct {
+		name   string
+		cursor string
+	}{
+		{name: "empty", cursor: ""},
+		{name: "not base64", cursor: "not a cursor!"},
+		{name: "padded base64", cursor: base64.URLEncoding.EncodeToString([]byte("2024-03-01T12:30:00Z|a"))},
+		{name: "no separator", cursor: encode("2024-03-01T12:30:00Z")},
+		{name: "no uuid", cursor: encode("2024-03-01T12:30:00Z|")},
+		{name: "bad time", cursor: encode("yesterday|a")},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := DecodeAccountCursor(test.cursor)
+			if !errors.Is(err, InvalidCursor) {
+				t.Fatalf("DecodeAccountCursor(%q) = %v, want InvalidCursor", test.cursor, err)
+			}
+		})
+	}
+}
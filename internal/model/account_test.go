@@ -0,0 +1,49 @@
+package model
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestNormalizePhone(t *testing.T) {
+	tests := []struct {
+		name               string
+		phone              string
+		defaultCountryCode string
+		want               string
+		err                error
+	}{
+		{name: "e164", phone: "+628123456789", want: "+628123456789"},
+		{name: "separators", phone: "+62 (812) 3456-78.9", want: "+628123456789"},
+		{name: "surrounding space", phone: "  +628123456789  ", want: "+628123456789"},
+		{name: "00 prefix", phone: "00628123456789", want: "+628123456789"},
+		{name: "00 prefix ignores default", phone: "00628123456789", defaultCountryCode: "1", want: "+628123456789"},
+		{name: "default country code", phone: "08123456789", defaultCountryCode: "62", want: "+628123456789"},
+		{name: "default country code with plus", phone: "0812-3456-789", defaultCountryCode: "+62", want: "+628123456789"},
+		{name: "national without default", phone: "08123456789", err: InvalidPhoneNumber},
+		{name: "no prefix", phone: "628123456789", defaultCountryCode: "62", err: InvalidPhoneNumber},
+		{name: "shortest", phone: "+12345678", want: "+12345678"},
+		{name: "too short", phone: "+1234567", err: InvalidPhoneNumber},
+		{name: "longest", phone: "+123456789012345", want: "+123456789012345"},
+		{name: "too long", phone: "+1234567890123456", err: InvalidPhoneNumber},
+		{name: "too long after default", phone: "012345678901234", defaultCountryCode: "62", err: InvalidPhoneNumber},
+		{name: "leading zero country code", phone: "+0123456789", err: InvalidPhoneNumber},
+		{name: "leading zero after 00", phone: "000123456789", err: InvalidPhoneNumber},
+		{name: "letter", phone: "+62812345678a", err: InvalidPhoneNumber},
+		{name: "slash", phone: "+62/8123456789", err: InvalidPhoneNumber},
+		{name: "inner plus", phone: "62+8123456789", err: InvalidPhoneNumber},
+		{name: "empty", phone: "", defaultCountryCode: "62", err: InvalidPhoneNumber},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := NormalizePhone(test.phone, test.defaultCountryCode)
+			if !errors.Is(err, test.err) || (test.err == nil && err != nil) {
+				t.Fatalf("NormalizePhone(%q, %q) error = %v, want %v", test.phone, test.defaultCountryCode, err, test.err)
+			}
+			if got != test.want {
+				t.Fatalf("NormalizePhone(%q, %q) = %q, want %q", test.phone, test.defaultCountryCode, got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,68 @@
+package model
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+)
+
+var InvalidAttributes = errors.New("attributes must encode to a JSON object")
+
+// GetAttributes decodes the account's custom profile fields into T, usually a
+// struct of the app's own with json tags. An account without attributes
+// yields the zero T.
+func GetAttributes[T any](account *Account) (T, error) {
+	var attributes T
+	if len(account.Attributes) == 0 {
+		return attributes, nil
+	}
+	errUnmarshal := json.Unmarshal(account.Attributes, &attributes)
+	return attributes, errUnmarshal
+}
+
+// SetAttributes replaces the account's custom profile fields with attributes.
+// They are persisted by the next Create or Update.
+func SetAttributes[T any](account *Account, attributes T) error {
+	encoded, errMarshal := json.Marshal(attributes)
+	if errMarshal != nil {
+		return errMarshal
+	}
+	if !bytes.HasPrefix(encoded, []byte("{")) {
+		return InvalidAttributes
+	}
+	account.Attributes = encoded
+	return nil
+}
+
+// AttributesJSON is the value stored in the attributes column.
+func (b *Base) AttributesJSON() string {
+	if len(b.Attributes) == 0 {
+		return "{}"
+	}
+	return string(b.Attributes)
+}
+
+// claimAttributes picks keys out of the attributes for the access token. Keys
+// the account has no value for are left out.
+func (b *Base) claimAttributes(keys []string) (map[string]json.RawMessage, error) {
+	if len(keys) == 0 || len(b.Attributes) == 0 {
+		return nil, nil
+	}
+
+	var all map[string]json.RawMessage
+	errUnmarshal := json.Unmarshal(b.Attributes, &all)
+	if errUnmarshal != nil {
+		return nil, errUnmarshal
+	}
+
+	claims := make(map[string]json.RawMessage, len(keys))
+	for _, key := range keys {
+		if value, found := all[key]; found {
+			claims[key] = value
+		}
+	}
+	if len(claims) == 0 {
+		return nil, nil
+	}
+	return claims, nil
+}
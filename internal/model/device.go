@@ -0,0 +1,20 @@
+package model
+
+// SignIn is the outcome of a successful login. NewDevice is set the first
+// time a device id signs in to the account and NewDeviceType the first time
+// its device type does. Neither is set on the account's very first sign in,
+// nor when the client sent no device id.
+type SignIn struct {
+	AccessToken   string     `json:"accessToken"`
+	RefreshToken  string     `json:"refreshToken"`
+	SessionRandId string     `json:"sessionRandId"`
+	Device        DeviceInfo `json:"device"`
+	NewDevice     bool       `json:"newDevice"`
+	NewDeviceType bool       `json:"newDeviceType"`
+}
+
+// IsUnrecognised reports whether the sign in came from a device the account
+// has not used before and is worth telling the user about.
+func (s *SignIn) IsUnrecognised() bool {
+	return s.NewDevice || s.NewDeviceType
+}
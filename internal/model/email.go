@@ -0,0 +1,135 @@
+package model
+
+import (
+	"errors"
+	"github.com/21strive/commonuser/config"
+	"golang.org/x/net/idna"
+	"sort"
+	"strings"
+)
+
+var InvalidEmail = errors.New("invalid email address")
+var EmailTaken = errors.New("email address is taken")
+
+type emailRule struct {
+	ignoreDots bool
+	plusTags   bool
+	domain     string
+}
+
+// providerRules lists mailbox providers that deliver several spellings of an
+// address to the same inbox. Changing them needs a migration rebuilding the
+// idx_<entity>_email_legacy index, which is built from
+// ProviderCanonicalEmailSQL.
+var providerRules = map[string]emailRule{
+	"gmail.com":      {ignoreDots: true, plusTags: true, domain: "gmail.com"},
+	"googlemail.com": {ignoreDots: true, plusTags: true, domain: "gmail.com"},
+	"outlook.com":    {plusTags: true},
+	"hotmail.com":    {plusTags: true},
+	"live.com":       {plusTags: true},
+	"icloud.com":     {plusTags: true},
+	"me.com":         {plusTags: true, domain: "icloud.com"},
+	"fastmail.com":   {plusTags: true},
+	"proton.me":      {plusTags: true},
+	"protonmail.com": {plusTags: true, domain: "proton.me"},
+}
+
+// EmailPolicy canonicalizes email addresses for uniqueness and lookups. The
+// canonical form is lowercase with an ASCII (punycode) domain; with provider
+// rules enabled, "J.Doe+news@GoogleMail.com" also becomes "jdoe@gmail.com".
+type EmailPolicy struct {
+	providerRules bool
+}
+
+func (p *EmailPolicy) Canonical(email string) (string, error) {
+	at := strings.LastIndex(email, "@")
+	if at <= 0 || at == len(email)-1 {
+		return "", InvalidEmail
+	}
+	local := strings.ToLower(strings.TrimSpace(email[:at]))
+	domain, errDomain := idna.Lookup.ToASCII(strings.TrimSuffix(strings.TrimSpace(email[at+1:]), "."))
+	if errDomain != nil || local == "" || !strings.Contains(domain, ".") {
+		return "", InvalidEmail
+	}
+
+	if rule, found := providerRules[domain]; found && p.providerRules {
+		if rule.plusTags {
+			if plus := strings.Index(local, "+"); plus > 0 {
+				local = local[:plus]
+			}
+		}
+		if rule.ignoreDots {
+			local = strings.ReplaceAll(local, ".", "")
+		}
+		if rule.domain != "" {
+			domain = rule.domain
+		}
+	}
+	return local + "@" + domain, nil
+}
+
+// LookupKey is the key email is looked up by. Addresses the policy cannot
+// parse are looked up as given.
+func (p *EmailPolicy) LookupKey(email string) string {
+	canonical, errCanonical := p.Canonical(email)
+	if errCanonical != nil {
+		return email
+	}
+	return canonical
+}
+
+// Apply validates the account's email address and fills in its canonical
+// form. Accounts without an email address are left alone.
+func (p *EmailPolicy) Apply(account *Account) error {
+	account.Email = strings.TrimSpace(account.Email)
+	if account.Email == "" {
+		account.EmailCanonical = ""
+		return nil
+	}
+
+	canonical, errCanonical := p.Canonical(account.Email)
+	if errCanonical != nil {
+		return errCanonical
+	}
+	account.EmailCanonical = canonical
+	return nil
+}
+
+// ProviderCanonicalEmailSQL is the SQL counterpart of Canonical with provider
+// rules enabled, for comparing rows stored before canonical emails. The
+// domain is lowercased but not converted to punycode.
+func ProviderCanonicalEmailSQL(column string) string {
+	address := "lower(" + column + "::text)"
+	local := "substring(" + address + " from '^(.*)@')"
+	domain := "substring(" + address + " from '@([^@]*)$')"
+
+	domains := make([]string, 0, len(providerRules))
+	for name := range providerRules {
+		domains = append(domains, name)
+	}
+	sort.Strings(domains)
+
+	var expression strings.Builder
+	expression.WriteString("CASE " + domain)
+	for _, name := range domains {
+		rule := providerRules[name]
+		folded := local
+		if rule.plusTags {
+			folded = "regexp_replace(" + folded + `, '^([^+]+)\+.*$', '\1')`
+		}
+		if rule.ignoreDots {
+			folded = "replace(" + folded + ", '.', '')"
+		}
+		target := name
+		if rule.domain != "" {
+			target = rule.domain
+		}
+		expression.WriteString(" WHEN '" + name + "' THEN " + folded + " || '@" + target + "'")
+	}
+	expression.WriteString(" ELSE " + address + " END")
+	return expression.String()
+}
+
+func NewEmailPolicy(cfg config.Email) *EmailPolicy {
+	return &EmailPolicy{providerRules: cfg.ProviderRules}
+}
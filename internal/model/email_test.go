@@ -0,0 +1,82 @@
+package model
+
+import (
+	"errors"
+	"github.com/21strive/commonuser/config"
+	"github.com/21strive/item"
+	"github.com/21strive/redifu"
+	"testing"
+)
+
+func TestEmailPolicyCanonical(t *testing.T) {
+	tests := []struct {
+		name          string
+		email         string
+		providerRules bool
+		canonical     string
+		err           error
+	}{
+		{name: "lowercase", email: "user@example.com", canonical: "user@example.com"},
+		{name: "mixed case", email: "User@Example.COM", canonical: "user@example.com"},
+		{name: "surrounding space", email: " user@example.com ", canonical: "user@example.com"},
+		{name: "trailing dot", email: "user@example.com.", canonical: "user@example.com"},
+		{name: "unicode domain", email: "user@bücher.de", canonical: "user@xn--bcher-kva.de"},
+		{name: "rules off", email: "J.Doe+news@GoogleMail.com", canonical: "j.doe+news@googlemail.com"},
+		{name: "gmail", email: "J.Doe+news@GoogleMail.com", providerRules: true, canonical: "jdoe@gmail.com"},
+		{name: "plus tag only", email: "j.doe+news@outlook.com", providerRules: true, canonical: "j.doe@outlook.com"},
+		{name: "domain alias", email: "jdoe@me.com", providerRules: true, canonical: "jdoe@icloud.com"},
+		{name: "other provider", email: "j.doe+news@example.com", providerRules: true, canonical: "j.doe+news@example.com"},
+		{name: "no at", email: "userexample.com", err: InvalidEmail},
+		{name: "no local part", email: "@example.com", err: InvalidEmail},
+		{name: "no domain", email: "user@", err: InvalidEmail},
+		{name: "single label domain", email: "user@localhost", err: InvalidEmail},
+		{name: "blank local part", email: "  @example.com", err: InvalidEmail},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			policy := NewEmailPolicy(config.Email{ProviderRules: test.providerRules})
+			canonical, err := policy.Canonical(test.email)
+			if !errors.Is(err, test.err) || (test.err == nil && err != nil) {
+				t.Fatalf("Canonical(%q) error = %v, want %v", test.email, err, test.err)
+			}
+			if canonical != test.canonical {
+				t.Fatalf("Canonical(%q) = %q, want %q", test.email, canonical, test.canonical)
+			}
+		})
+	}
+}
+
+func TestEmailPolicyLookupKey(t *testing.T) {
+	policy := NewEmailPolicy(config.Email{ProviderRules: true})
+	if key := policy.LookupKey("J.Doe@Gmail.com"); key != "jdoe@gmail.com" {
+		t.Fatalf("LookupKey = %q, want %q", key, "jdoe@gmail.com")
+	}
+	// addresses the policy cannot parse are looked up as given
+	if key := policy.LookupKey("Not An Address"); key != "Not An Address" {
+		t.Fatalf("LookupKey = %q, want it unchanged", key)
+	}
+}
+
+func TestEmailPolicyApply(t *testing.T) {
+	policy := NewEmailPolicy(config.Email{})
+	account := &Account{Record: &redifu.Record{Foundation: &item.Foundation{}}}
+
+	account.Email = " User@Example.com "
+	if err := policy.Apply(account); err != nil {
+		t.Fatal(err)
+	}
+	if account.Email != "User@Example.com" || account.EmailCanonical != "user@example.com" {
+		t.Fatalf("Apply left %q/%q", account.Email, account.EmailCanonical)
+	}
+
+	account.Email = ""
+	if err := policy.Apply(account); err != nil || account.EmailCanonical != "" {
+		t.Fatalf("Apply without an address = %v, left %q", err, account.EmailCanonical)
+	}
+
+	account.Email = "invalid"
+	if err := policy.Apply(account); !errors.Is(err, InvalidEmail) {
+		t.Fatalf("Apply(%q) = %v, want InvalidEmail", account.Email, err)
+	}
+}
@@ -0,0 +1,16 @@
+package model
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// OutboxMessage is an event waiting in <entity>_outbox to be relayed.
+type OutboxMessage struct {
+	Id        int64           `json:"id"`
+	EventName string          `json:"eventName"`
+	Payload   json.RawMessage `json:"payload"`
+	CreatedAt time.Time       `json:"createdAt"`
+	Attempts  int             `json:"attempts"`
+	LastError string          `json:"lastError,omitempty"`
+}
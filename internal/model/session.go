@@ -5,11 +5,19 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"errors"
+	"fmt"
 	"github.com/21strive/redifu"
 	"time"
 )
 
 var SessionNotFound = errors.New("session not found")
+var SessionLimitReached = errors.New("session limit reached")
+
+// The reasons a session stops being valid. Each wraps InvalidSession.
+var SessionExpired = fmt.Errorf("%w: session has expired", InvalidSession)
+var SessionRevoked = fmt.Errorf("%w: session has been revoked", InvalidSession)
+var SessionIdleTimeout = fmt.Errorf("%w: signed out due to inactivity", InvalidSession)
+var SessionLifetimeExceeded = fmt.Errorf("%w: session reached its maximum lifetime", InvalidSession)
 
 type DeviceInfo struct {
 	DeviceId   string `json:"deviceId"`
@@ -29,6 +37,35 @@ type Session struct {
 	Revoked        bool      `json:"revoked"`
 }
 
+// SessionDevice is the part of a session that is safe to show to its owner.
+type SessionDevice struct {
+	RandId       string    `json:"randId"`
+	DeviceId     string    `json:"deviceId"`
+	DeviceType   string    `json:"deviceType"`
+	UserAgent    string    `json:"userAgent"`
+	CreatedAt    time.Time `json:"createdAt"`
+	LastActiveAt time.Time `json:"lastActiveAt"`
+	Current      bool      `json:"current"`
+}
+
+type SessionList struct {
+	Devices []SessionDevice `json:"devices"`
+	Page    int             `json:"page"`
+	HasMore bool            `json:"hasMore"`
+}
+
+func (s *Session) Device(currentSessionRandId string) SessionDevice {
+	return SessionDevice{
+		RandId:       s.GetRandId(),
+		DeviceId:     s.DeviceId,
+		DeviceType:   s.DeviceType,
+		UserAgent:    s.UserAgent,
+		CreatedAt:    s.GetCreatedAt(),
+		LastActiveAt: s.LastActiveAt,
+		Current:      s.GetRandId() == currentSessionRandId,
+	}
+}
+
 func (s *Session) SetLastActiveAt(lastActiveAt time.Time) {
 	s.LastActiveAt = lastActiveAt
 }
@@ -68,6 +105,17 @@ func (s *Session) SetLifeSpan(refreshTokenLifeSpan time.Duration) {
 	s.ExpiredAt = expiredAt
 }
 
+// CapLifeSpan keeps ExpiredAt within maxLifetime of the session's creation.
+func (s *Session) CapLifeSpan(maxLifetime time.Duration) {
+	if maxLifetime <= 0 {
+		return
+	}
+	deadline := s.GetCreatedAt().Add(maxLifetime)
+	if s.ExpiredAt.After(deadline) {
+		s.ExpiredAt = deadline
+	}
+}
+
 func (s *Session) Revoke() {
 	s.Revoked = true
 }
@@ -76,14 +124,30 @@ func (s *Session) MarkActivity() {
 	s.LastActiveAt = time.Now().UTC()
 }
 
-func (s *Session) IsValid() bool {
-	if s.ExpiredAt.Before(time.Now().UTC()) {
-		return false
-	}
+// Validate returns the reason the session can no longer be used, or nil.
+// A zero idleTimeout or maxLifetime skips that check.
+func (s *Session) Validate(idleTimeout time.Duration, maxLifetime time.Duration) error {
+	timeNow := time.Now().UTC()
 	if s.Revoked {
-		return false
+		return SessionRevoked
+	}
+	if maxLifetime > 0 && timeNow.After(s.GetCreatedAt().Add(maxLifetime)) {
+		return SessionLifetimeExceeded
+	}
+	if idleTimeout > 0 && timeNow.After(s.LastActiveAt.Add(idleTimeout)) {
+		return SessionIdleTimeout
 	}
-	return true
+	if s.ExpiredAt.Before(timeNow) {
+		return SessionExpired
+	}
+	return nil
+}
+
+// IsValid reports whether the session is neither revoked nor expired. It
+// does not know the idle timeout or maximum lifetime; use Validate with the
+// configured values to apply them too.
+func (s *Session) IsValid() bool {
+	return s.Validate(0, 0) == nil
 }
 
 func NewSession() *Session {
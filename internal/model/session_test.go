@@ -0,0 +1,116 @@
+package model
+
+import (
+	"errors"
+	"github.com/21strive/item"
+	"github.com/21strive/redifu"
+	"testing"
+	"time"
+)
+
+func testSession(createdAt time.Time, lastActiveAt time.Time, expiredAt time.Time, revoked bool) *Session {
+	session := &Session{Record: &redifu.Record{Foundation: &item.Foundation{}}}
+	session.SetCreatedAt(createdAt)
+	session.LastActiveAt = lastActiveAt
+	session.ExpiredAt = expiredAt
+	session.Revoked = revoked
+	return session
+}
+
+func TestSessionValidate(t *testing.T) {
+	now := time.Now().UTC()
+	tests := []struct {
+		name        string
+		session     *Session
+		idleTimeout time.Duration
+		maxLifetime time.Duration
+		want        error
+	}{
+		{
+			name:    "active",
+			session: testSession(now.Add(-time.Hour), now, now.Add(time.Hour), false),
+		},
+		{
+			name:    "revoked",
+			session: testSession(now.Add(-time.Hour), now, now.Add(time.Hour), true),
+			want:    SessionRevoked,
+		},
+		{
+			name:    "revoked wins over expired",
+			session: testSession(now.Add(-time.Hour), now, now.Add(-time.Minute), true),
+			want:    SessionRevoked,
+		},
+		{
+			name:        "lifetime exceeded",
+			session:     testSession(now.Add(-48*time.Hour), now, now.Add(time.Hour), false),
+			maxLifetime: 24 * time.Hour,
+			want:        SessionLifetimeExceeded,
+		},
+		{
+			name:        "lifetime exceeded wins over idle",
+			session:     testSession(now.Add(-48*time.Hour), now.Add(-2*time.Hour), now.Add(time.Hour), false),
+			idleTimeout: time.Hour,
+			maxLifetime: 24 * time.Hour,
+			want:        SessionLifetimeExceeded,
+		},
+		{
+			name:        "idle timeout",
+			session:     testSession(now.Add(-3*time.Hour), now.Add(-2*time.Hour), now.Add(time.Hour), false),
+			idleTimeout: time.Hour,
+			want:        SessionIdleTimeout,
+		},
+		{
+			name:        "idle timeout wins over expired",
+			session:     testSession(now.Add(-3*time.Hour), now.Add(-2*time.Hour), now.Add(-time.Minute), false),
+			idleTimeout: time.Hour,
+			want:        SessionIdleTimeout,
+		},
+		{
+			name:    "expired",
+			session: testSession(now.Add(-time.Hour), now, now.Add(-time.Minute), false),
+			want:    SessionExpired,
+		},
+		{
+			name:        "zero limits skip the checks",
+			session:     testSession(now.Add(-48*time.Hour), now.Add(-2*time.Hour), now.Add(time.Hour), false),
+			idleTimeout: 0,
+			maxLifetime: 0,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.session.Validate(test.idleTimeout, test.maxLifetime)
+			if !errors.Is(err, test.want) || (test.want == nil && err != nil) {
+				t.Fatalf("Validate() = %v, want %v", err, test.want)
+			}
+			if test.want != nil && !errors.Is(err, InvalidSession) {
+				t.Fatalf("Validate() = %v, want it to wrap InvalidSession", err)
+			}
+			withoutLimits := test.session.Validate(0, 0)
+			if test.session.IsValid() != (withoutLimits == nil) {
+				t.Fatalf("IsValid() disagrees with Validate(0, 0) = %v", withoutLimits)
+			}
+		})
+	}
+}
+
+func TestSessionRefreshMovesExpiry(t *testing.T) {
+	now := time.Now().UTC()
+	session := testSession(now.Add(-2*time.Hour), now, now.Add(-time.Minute), false)
+	if !errors.Is(session.Validate(0, 0), SessionExpired) {
+		t.Fatalf("expected the session to start expired")
+	}
+
+	session.SetLifeSpan(time.Hour)
+	session.CapLifeSpan(24 * time.Hour)
+	if err := session.Validate(0, 0); err != nil {
+		t.Fatalf("Validate() after refresh = %v, want nil", err)
+	}
+
+	session.SetLifeSpan(48 * time.Hour)
+	session.CapLifeSpan(24 * time.Hour)
+	if want := session.GetCreatedAt().Add(24 * time.Hour); !session.ExpiredAt.Equal(want) {
+		t.Fatalf("ExpiredAt = %v, want it capped at %v", session.ExpiredAt, want)
+	}
+}
@@ -0,0 +1,177 @@
+package model
+
+import (
+	"errors"
+	"fmt"
+	"github.com/21strive/commonuser/config"
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
+	"strings"
+	"time"
+	"unicode"
+)
+
+var InvalidUsername = errors.New("invalid username")
+var UsernameReserved = errors.New("username is reserved")
+var UsernameTaken = errors.New("username is taken")
+var UsernameConfusable = fmt.Errorf("%w: too similar to an existing username", UsernameTaken)
+var UsernameHeld = fmt.Errorf("%w: recently given up by another account", UsernameTaken)
+var UsernameChangeTooSoon = errors.New("username was changed too recently")
+
+const (
+	DefaultUsernameMinLength   = 3
+	DefaultUsernameMaxLength   = 30
+	DefaultUsernamePunctuation = "._-"
+)
+
+// DefaultReservedUsernames are names that could pass for the service itself.
+var DefaultReservedUsernames = []string{
+	"admin", "administrator", "root", "system", "support", "help", "security",
+	"staff", "moderator", "official", "api", "www", "mail", "noreply", "null",
+}
+
+// confusables folds characters that render like a Latin letter or digit onto
+// it. It covers the Cyrillic and Greek lookalikes seen in impersonation
+// attempts rather than the full Unicode confusables table.
+var confusables = map[rune]string{
+	'а': "a", 'в': "b", 'е': "e", 'ё': "e", 'һ': "h", 'і': "l", 'ї': "l", 'ј': "j",
+	'к': "k", 'м': "m", 'н': "h", 'о': "o", 'р': "p", 'с': "c", 'т': "t", 'у': "y",
+	'х': "x", 'ѕ': "s", 'ԁ': "d", 'ԛ': "q", 'ԝ': "w", 'ɡ': "g", 'ı': "l",
+	'α': "a", 'β': "b", 'ε': "e", 'η': "n", 'ι': "l", 'κ': "k", 'ν': "v", 'ο': "o",
+	'ρ': "p", 'τ': "t", 'υ': "u", 'χ': "x", 'ω': "w",
+	'0': "o", '1': "l", 'i': "l", '5': "s", '$': "s",
+}
+
+// UsernamePolicy canonicalizes usernames and decides which ones are allowed.
+//
+// The canonical form is NFKC normalized and case folded, so "Alice" and
+// "ＡＬＩＣＥ" are the same name. The skeleton further strips accents and
+// separators and folds lookalike characters, so "alice", "al1ce" and "аlice"
+// with a Cyrillic "а" share one and only one of them can be registered.
+type UsernamePolicy struct {
+	minLength   int
+	maxLength   int
+	punctuation string
+	reserved    map[string]bool
+}
+
+// Canonical returns the canonical form of username, or InvalidUsername when it
+// is too short, too long or contains characters outside the allowed set.
+func (p *UsernamePolicy) Canonical(username string) (string, error) {
+	folded := p.Fold(username)
+
+	length := 0
+	for i, r := range folded {
+		switch {
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+		case unicode.Is(unicode.Mn, r) && i > 0:
+		case strings.ContainsRune(p.punctuation, r) && i > 0:
+		default:
+			return "", InvalidUsername
+		}
+		length++
+	}
+	if length < p.minLength || length > p.maxLength {
+		return "", InvalidUsername
+	}
+	return folded, nil
+}
+
+// Fold normalizes and case folds username without validating it, e.g. to
+// match a prefix against canonical usernames.
+func (p *UsernamePolicy) Fold(username string) string {
+	return norm.NFKC.String(cases.Fold().String(norm.NFKC.String(strings.TrimSpace(username))))
+}
+
+// LookupKey is the key username is stored and cached under. Names the policy
+// rejects are looked up as given, so legacy usernames stay reachable.
+func (p *UsernamePolicy) LookupKey(username string) string {
+	canonical, errCanonical := p.Canonical(username)
+	if errCanonical != nil {
+		return username
+	}
+	return canonical
+}
+
+// Skeleton maps a canonical username to the key confusable names share.
+func (p *UsernamePolicy) Skeleton(canonical string) string {
+	var skeleton strings.Builder
+	for _, r := range norm.NFD.String(canonical) {
+		if unicode.Is(unicode.Mn, r) || strings.ContainsRune(p.punctuation, r) {
+			continue
+		}
+		if replacement, found := confusables[r]; found {
+			skeleton.WriteString(replacement)
+			continue
+		}
+		skeleton.WriteRune(r)
+	}
+	return strings.ReplaceAll(skeleton.String(), "rn", "m")
+}
+
+// Apply validates the account's username and fills in its canonical form and
+// skeleton. Accounts without a username are left alone.
+func (p *UsernamePolicy) Apply(account *Account) error {
+	if account.Username == "" {
+		account.UsernameCanonical = ""
+		account.UsernameSkeleton = ""
+		return nil
+	}
+
+	canonical, errCanonical := p.Canonical(account.Username)
+	if errCanonical != nil {
+		return errCanonical
+	}
+	skeleton := p.Skeleton(canonical)
+	if p.reserved[skeleton] {
+		return UsernameReserved
+	}
+
+	account.Username = norm.NFKC.String(strings.TrimSpace(account.Username))
+	account.UsernameCanonical = canonical
+	account.UsernameSkeleton = skeleton
+	return nil
+}
+
+// UsernameChange is a username an account gave up. Until HeldUntil nobody
+// else can take it and it still resolves to the account.
+type UsernameChange struct {
+	AccountUUID       string    `json:"accountUUID"`
+	Username          string    `json:"username"`
+	UsernameCanonical string    `json:"usernameCanonical"`
+	UsernameSkeleton  string    `json:"-"`
+	ChangedAt         time.Time `json:"changedAt"`
+	HeldUntil         time.Time `json:"heldUntil"`
+}
+
+func (c *UsernameChange) IsHeld() bool {
+	return time.Now().UTC().Before(c.HeldUntil)
+}
+
+func NewUsernamePolicy(cfg config.Username) *UsernamePolicy {
+	policy := &UsernamePolicy{
+		minLength:   cfg.MinLength,
+		maxLength:   cfg.MaxLength,
+		punctuation: cfg.Punctuation,
+		reserved:    make(map[string]bool),
+	}
+	if policy.minLength <= 0 {
+		policy.minLength = DefaultUsernameMinLength
+	}
+	if policy.maxLength <= 0 {
+		policy.maxLength = DefaultUsernameMaxLength
+	}
+	if policy.punctuation == "" {
+		policy.punctuation = DefaultUsernamePunctuation
+	}
+
+	reserved := cfg.Reserved
+	if reserved == nil {
+		reserved = DefaultReservedUsernames
+	}
+	for _, name := range reserved {
+		canonical := norm.NFKC.String(cases.Fold().String(norm.NFKC.String(name)))
+		policy.reserved[policy.Skeleton(canonical)] = true
+	}
+	return policy
+}
@@ -0,0 +1,102 @@
+package model
+
+import (
+	"errors"
+	"github.com/21strive/commonuser/config"
+	"github.com/21strive/item"
+	"github.com/21strive/redifu"
+	"strings"
+	"testing"
+)
+
+func TestUsernamePolicyCanonical(t *testing.T) {
+	policy := NewUsernamePolicy(config.Username{})
+	tests := []struct {
+		name      string
+		username  string
+		canonical string
+		skeleton  string
+		err       error
+	}{
+		{name: "lowercase", username: "alice", canonical: "alice", skeleton: "allce"},
+		{name: "mixed case", username: "Alice", canonical: "alice", skeleton: "allce"},
+		{name: "fullwidth", username: "ＡＬＩＣＥ", canonical: "alice", skeleton: "allce"},
+		{name: "surrounding space", username: "  bob  ", canonical: "bob", skeleton: "bob"},
+		{name: "case folding", username: "Straße", canonical: "strasse", skeleton: "strasse"},
+		{name: "accent", username: "José", canonical: "josé", skeleton: "jose"},
+		{name: "inner punctuation", username: "al.ice", canonical: "al.ice", skeleton: "allce"},
+		{name: "digit lookalike", username: "al1ce", canonical: "al1ce", skeleton: "allce"},
+		{name: "cyrillic lookalike", username: "аlice", canonical: "аlice", skeleton: "allce"},
+		{name: "leading digit", username: "0scar", canonical: "0scar", skeleton: "oscar"},
+		{name: "rn folds to m", username: "modern", canonical: "modern", skeleton: "modem"},
+		{name: "minimum length", username: "abc", canonical: "abc", skeleton: "abc"},
+		{name: "maximum length", username: strings.Repeat("b", DefaultUsernameMaxLength), canonical: strings.Repeat("b", DefaultUsernameMaxLength), skeleton: strings.Repeat("b", DefaultUsernameMaxLength)},
+		{name: "too short", username: "ab", err: InvalidUsername},
+		{name: "too long", username: strings.Repeat("b", DefaultUsernameMaxLength+1), err: InvalidUsername},
+		{name: "leading punctuation", username: ".alice", err: InvalidUsername},
+		{name: "inner space", username: "ali ce", err: InvalidUsername},
+		{name: "disallowed symbol", username: "al@ice", err: InvalidUsername},
+		{name: "empty", username: "", err: InvalidUsername},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			canonical, err := policy.Canonical(test.username)
+			if !errors.Is(err, test.err) || (test.err == nil && err != nil) {
+				t.Fatalf("Canonical(%q) error = %v, want %v", test.username, err, test.err)
+			}
+			if test.err != nil {
+				return
+			}
+			if canonical != test.canonical {
+				t.Fatalf("Canonical(%q) = %q, want %q", test.username, canonical, test.canonical)
+			}
+			if skeleton := policy.Skeleton(canonical); skeleton != test.skeleton {
+				t.Fatalf("Skeleton(%q) = %q, want %q", canonical, skeleton, test.skeleton)
+			}
+		})
+	}
+}
+
+func TestUsernamePolicyLookupKey(t *testing.T) {
+	policy := NewUsernamePolicy(config.Username{})
+	if key := policy.LookupKey("Alice"); key != "alice" {
+		t.Fatalf("LookupKey(%q) = %q, want %q", "Alice", key, "alice")
+	}
+	// legacy usernames the policy rejects are looked up as given
+	if key := policy.LookupKey("Al Ice"); key != "Al Ice" {
+		t.Fatalf("LookupKey(%q) = %q, want it unchanged", "Al Ice", key)
+	}
+}
+
+func TestUsernamePolicyApply(t *testing.T) {
+	policy := NewUsernamePolicy(config.Username{})
+	tests := []struct {
+		name     string
+		username string
+		err      error
+	}{
+		{name: "allowed", username: "Alice"},
+		{name: "reserved", username: "Admin", err: UsernameReserved},
+		{name: "reserved lookalike", username: "adm1n", err: UsernameReserved},
+		{name: "invalid", username: "a", err: InvalidUsername},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			account := &Account{Record: &redifu.Record{Foundation: &item.Foundation{}}}
+			account.Username = test.username
+			err := policy.Apply(account)
+			if !errors.Is(err, test.err) || (test.err == nil && err != nil) {
+				t.Fatalf("Apply(%q) = %v, want %v", test.username, err, test.err)
+			}
+		})
+	}
+
+	account := &Account{Record: &redifu.Record{Foundation: &item.Foundation{}}}
+	account.UsernameCanonical = "stale"
+	account.UsernameSkeleton = "stale"
+	if err := policy.Apply(account); err != nil || account.UsernameCanonical != "" || account.UsernameSkeleton != "" {
+		t.Fatalf("Apply without a username = %v, left %q/%q", err, account.UsernameCanonical, account.UsernameSkeleton)
+	}
+}
@@ -3,47 +3,109 @@ package model
 import (
 	"crypto/rand"
 	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/hex"
 	"errors"
+	"fmt"
 	"math/big"
+	"time"
 
 	"github.com/21strive/redifu"
 )
 
 var VerificationNotFound = errors.New("Verification not found")
 var InvalidVerificationCode = errors.New("Invalid verification code")
+var VerificationCodeExpired = fmt.Errorf("%w: code has expired", InvalidVerificationCode)
+var VerificationAttemptsExceeded = fmt.Errorf("%w: too many failed attempts", InvalidVerificationCode)
+var VerificationResendTooSoon = errors.New("verification code was sent too recently")
+
+const (
+	DefaultCodeLength   = 6
+	DefaultCodeAlphabet = "0123456789"
+)
+
+// Purpose tells apart the codes an account can have pending at the same time.
+type Purpose string
+
+const (
+	VerifyEmail Purpose = "email"
+	VerifyPhone Purpose = "phone"
+	PhoneSignIn Purpose = "phone_sign_in"
+)
 
 type Verification struct {
 	*redifu.Record
-	AccountUUID string `db:"accountuuid"`
-	Code        string `db:"code"`
+	AccountUUID string    `db:"accountuuid"`
+	Purpose     Purpose   `db:"purpose"`
+	Code        string    `db:"code"`
+	ExpiresAt   time.Time `db:"expires_at"`
+	Attempts    int       `db:"attempts"`
 }
 
 func (v *Verification) SetAccount(account *Account) {
 	v.AccountUUID = account.GetUUID()
 }
 
-func (v *Verification) SetCode() string {
-	numericString := ""
-	for i := int64(0); i < 4; i++ {
-		digit, _ := rand.Int(rand.Reader, big.NewInt(10))
-		numericString += digit.String()
+func (v *Verification) SetPurpose(purpose Purpose) {
+	v.Purpose = purpose
+}
+
+// SetCode replaces the code with a new random one of length characters drawn
+// from alphabet, valid for ttl, and resets the attempt counter. Only the hash
+// is kept; the plain code is returned for delivery.
+func (v *Verification) SetCode(length int, alphabet string, ttl time.Duration) (string, error) {
+	if length <= 0 {
+		length = DefaultCodeLength
+	}
+	if alphabet == "" {
+		alphabet = DefaultCodeAlphabet
 	}
 
-	hash := sha256.Sum256([]byte(numericString))
+	symbols := []rune(alphabet)
+	code := make([]rune, length)
+	for i := range code {
+		index, err := rand.Int(rand.Reader, big.NewInt(int64(len(symbols))))
+		if err != nil {
+			return "", err
+		}
+		code[i] = symbols[index.Int64()]
+	}
+
+	hash := sha256.Sum256([]byte(string(code)))
 	v.Code = hex.EncodeToString(hash[:])
+	v.ExpiresAt = time.Now().UTC().Add(ttl)
+	v.Attempts = 0
+
+	return string(code), nil
+}
 
-	return numericString
+func (v *Verification) IsExpired() bool {
+	return time.Now().UTC().After(v.ExpiresAt)
 }
 
-func (v *Verification) Validate(code string) bool {
+// Validate checks code against the stored hash in constant time. A code past
+// its expiry is rejected without comparing. The attempt limit is enforced by
+// reserving an attempt in the database before calling it.
+func (v *Verification) Validate(code string) error {
+	if v.IsExpired() {
+		return VerificationCodeExpired
+	}
+
 	hash := sha256.Sum256([]byte(code))
 	stringifiedHash := hex.EncodeToString(hash[:])
-	return stringifiedHash == v.Code
+	if subtle.ConstantTimeCompare([]byte(stringifiedHash), []byte(v.Code)) != 1 {
+		return InvalidVerificationCode
+	}
+	return nil
+}
+
+// CanResend reports whether cooldown has passed since the code was issued.
+func (v *Verification) CanResend(cooldown time.Duration) bool {
+	return time.Now().UTC().Sub(v.GetUpdatedAt()) >= cooldown
 }
 
 func NewVerification() *Verification {
-	verification := &Verification{}
+	verification := &Verification{Purpose: VerifyEmail}
 	redifu.InitRecord(verification)
 	return verification
 }
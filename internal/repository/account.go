@@ -3,22 +3,47 @@ package repository
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"github.com/21strive/commonuser/config"
+	"github.com/21strive/commonuser/internal/cache"
 	"github.com/21strive/commonuser/internal/model"
 	"github.com/21strive/commonuser/internal/types"
 	"github.com/21strive/redifu"
 	"github.com/redis/go-redis/v9"
+	"strconv"
+	"strings"
+	"time"
 )
 
+const accountColumns = "uuid, randid, created_at, updated_at, name, COALESCE(username, ''), password, COALESCE(email, ''), avatar, email_verified, token_version, COALESCE(phone, ''), phone_verified, COALESCE(username_canonical, ''), COALESCE(username_skeleton, ''), COALESCE(email_canonical, ''), status, revision, attributes"
+
+// MissingBases remember lookups that found no account. Each shares the key
+// format of the base it stands in for but expires after config.App.MissingAge;
+// a nil base disables negative caching for its lookup.
+type MissingBases struct {
+	Account  *redifu.Base[*model.Account]
+	Username *redifu.Base[*model.AccountReference]
+	Email    *redifu.Base[*model.AccountReference]
+	UUID     *redifu.Base[*model.AccountReference]
+	Phone    *redifu.Base[*model.AccountReference]
+}
+
 type AccountRepository struct {
+	readDB             *sql.DB
 	redis              redis.UniversalClient
 	base               *redifu.Base[*model.Account]
 	baseReference      *redifu.Base[*model.AccountReference]
+	baseEmailReference *redifu.Base[*model.AccountReference]
+	baseUUIDReference  *redifu.Base[*model.AccountReference]
+	basePhoneReference *redifu.Base[*model.AccountReference]
+	missing            MissingBases
+	versions           *cache.Versions
 	findByUsernameStmt *sql.Stmt
 	findByRandIdStmt   *sql.Stmt
 	findByEmailStmt    *sql.Stmt
 	findByUUIDStmt     *sql.Stmt
+	findByPhoneStmt    *sql.Stmt
 	app                *config.App
 }
 
@@ -31,6 +56,7 @@ func (ar *AccountRepository) Close() {
 	ar.findByRandIdStmt.Close()
 	ar.findByEmailStmt.Close()
 	ar.findByUUIDStmt.Close()
+	ar.findByPhoneStmt.Close()
 }
 
 func (ar *AccountRepository) Create(ctx context.Context, pipe redis.Pipeliner, db types.SQLExecutor, account *model.Account) error {
@@ -43,8 +69,16 @@ func (ar *AccountRepository) Create(ctx context.Context, pipe redis.Pipeliner, d
 		username, 
 		password, 
 		email, 	
-		avatar
-	) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`
+		avatar,
+		token_version,
+		phone,
+		phone_verified,
+		username_canonical,
+		username_skeleton,
+		email_canonical,
+		status,
+		attributes
+	) VALUES ($1, $2, $3, $4, $5, NULLIF($6, ''), $7, NULLIF($8, ''), $9, $10, NULLIF($11, ''), $12, NULLIF($13, ''), NULLIF($14, ''), NULLIF($15, ''), $16, $17)`
 	_, errInsert := db.ExecContext(ctx,
 		query,
 		account.GetUUID(),
@@ -56,6 +90,14 @@ func (ar *AccountRepository) Create(ctx context.Context, pipe redis.Pipeliner, d
 		account.Password,
 		account.Email,
 		account.Avatar,
+		account.TokenVersion,
+		account.Phone,
+		account.PhoneVerified,
+		account.UsernameCanonical,
+		account.UsernameSkeleton,
+		account.EmailCanonical,
+		account.Status,
+		account.AttributesJSON(),
 	)
 
 	if errInsert != nil {
@@ -68,30 +110,33 @@ func (ar *AccountRepository) Create(ctx context.Context, pipe redis.Pipeliner, d
 		selfPipe = true
 	}
 
+	ar.versions.Set(ctx, pipe, account.GetRandId(), account.Revision)
 	errSetAcc := ar.base.WithPipeline(pipe).Set(ctx, account)
 	if errSetAcc != nil {
 		return errSetAcc
 	}
 
-	accountReference := model.NewReference()
-	accountReference.SetAccountRandId(account.GetRandId())
-	errSetReference := ar.baseReference.WithPipeline(pipe).Set(ctx, accountReference, account.Username)
+	errSetReference := ar.setReferences(ctx, pipe, account)
 	if errSetReference != nil {
 		return errSetReference
 	}
+	ar.setTokenVersion(ctx, pipe, account)
+	ar.invalidatePages(ctx, pipe)
 
 	if selfPipe {
-		_, errExec := pipe.Exec(ctx)
-		return errExec
+		return cache.Flush(ctx, ar.redis, pipe)
 	}
 
 	return nil
 }
 
-func (ar *AccountRepository) Update(ctx context.Context, pipe redis.Pipeliner, db types.SQLExecutor, account *model.Account) error {
+// Update writes account. The token version is never taken from account, a
+// copy read before a revocation would bring revoked tokens back; it is raised
+// in place when revokeTokens is set and read back into account.
+func (ar *AccountRepository) Update(ctx context.Context, pipe redis.Pipeliner, db types.SQLExecutor, account *model.Account, revokeTokens bool) error {
 	query := "UPDATE " + ar.app.EntityName +
-		" SET updated_at = $1, name = $2, username = $3, password = $4, email = $5, avatar = $6, email_verified = $7 WHERE uuid = $8"
-	_, errUpdate := db.ExecContext(ctx,
+		" SET updated_at = $1, name = $2, username = NULLIF($3, ''), password = $4, email = NULLIF($5, ''), avatar = $6, email_verified = $7, token_version = CASE WHEN $8 THEN token_version + 1 ELSE token_version END, phone = NULLIF($9, ''), phone_verified = $10, username_canonical = NULLIF($11, ''), username_skeleton = NULLIF($12, ''), email_canonical = NULLIF($13, ''), status = $14, attributes = $15, revision = revision + 1 WHERE uuid = $16 RETURNING revision, token_version"
+	errUpdate := db.QueryRowContext(ctx,
 		query,
 		account.GetUpdatedAt(),
 		account.Name,
@@ -100,191 +145,321 @@ func (ar *AccountRepository) Update(ctx context.Context, pipe redis.Pipeliner, d
 		account.Email,
 		account.Avatar,
 		account.EmailVerified,
-		account.GetUUID())
+		revokeTokens,
+		account.Phone,
+		account.PhoneVerified,
+		account.UsernameCanonical,
+		account.UsernameSkeleton,
+		account.EmailCanonical,
+		account.Status,
+		account.AttributesJSON(),
+		account.GetUUID()).Scan(&account.Revision, &account.TokenVersion)
 	if errUpdate != nil {
+		if errUpdate == sql.ErrNoRows {
+			return model.AccountDoesNotExists
+		}
 		return errUpdate
 	}
 
-	var errSetAcc error
+	var selfPipe bool
 	if pipe == nil {
-		errSetAcc = ar.base.Set(ctx, account)
-	} else {
-		errSetAcc = ar.base.WithPipeline(pipe).Set(ctx, account)
+		pipe = ar.redis.Pipeline()
+		selfPipe = true
 	}
 
+	ar.versions.Set(ctx, pipe, account.GetRandId(), account.Revision)
+	errSetAcc := ar.base.WithPipeline(pipe).Set(ctx, account)
 	if errSetAcc != nil {
 		return errSetAcc
 	}
+	ar.setTokenVersion(ctx, pipe, account)
+	ar.invalidatePages(ctx, pipe)
+
+	if selfPipe {
+		return cache.Flush(ctx, ar.redis, pipe)
+	}
 
 	return nil
 }
 
-func (ar *AccountRepository) UpdateReference(ctx context.Context, pipe redis.Pipeliner, account *model.Account, oldUsername string, newUsername string) error {
-	ref, errGet := ar.baseReference.Get(ctx, oldUsername)
-	if errGet != nil {
-		return errGet
+// BumpTokenVersion raises the stored token version without touching the rest
+// of the row, and returns the new version. The cached account goes stale and
+// is read back from the database next time.
+func (ar *AccountRepository) BumpTokenVersion(ctx context.Context, pipe redis.Pipeliner, db types.SQLExecutor, account *model.Account) (int64, error) {
+	query := "UPDATE " + ar.app.EntityName +
+		" SET token_version = token_version + 1, revision = revision + 1, updated_at = $1 WHERE uuid = $2 RETURNING token_version, revision"
+	var tokenVersion, revision int64
+	errUpdate := db.QueryRowContext(ctx, query, time.Now().UTC(), account.GetUUID()).Scan(&tokenVersion, &revision)
+	if errUpdate != nil {
+		if errUpdate == sql.ErrNoRows {
+			return 0, model.AccountDoesNotExists
+		}
+		return 0, errUpdate
 	}
 
 	var selfPipe bool
 	if pipe == nil {
 		pipe = ar.redis.Pipeline()
+		selfPipe = true
 	}
 
-	err := ar.baseReference.WithPipeline(pipe).Del(ctx, ref)
-	if err != nil {
-		return err
+	ar.versions.Set(ctx, pipe, account.GetRandId(), revision)
+	cache.SetIfNewer(ctx, pipe, ar.tokenVersionKey(account.GetUUID()), tokenVersion, ar.app.RecordAge)
+
+	if selfPipe {
+		return tokenVersion, cache.Flush(ctx, ar.redis, pipe)
+	}
+
+	return tokenVersion, nil
+}
+
+func (ar *AccountRepository) tokenVersionKey(accountUUID string) string {
+	return ar.app.EntityName + ":token-version:" + accountUUID
+}
+
+// setTokenVersion never lowers the cached version, so a write that read the
+// account before a revocation cannot bring revoked tokens back.
+func (ar *AccountRepository) setTokenVersion(ctx context.Context, pipe redis.Pipeliner, account *model.Account) {
+	cache.SetIfNewer(ctx, pipe, ar.tokenVersionKey(account.GetUUID()), account.TokenVersion, ar.app.RecordAge)
+}
+
+// GetTokenVersion reads the account's current token version from its Redis
+// mirror, falling back to SQL and re-seeding the mirror on a miss.
+func (ar *AccountRepository) GetTokenVersion(ctx context.Context, accountUUID string) (int64, error) {
+	version, errGet := ar.redis.Get(ctx, ar.tokenVersionKey(accountUUID)).Int64()
+	if errGet == nil {
+		return version, nil
+	}
+	if !errors.Is(errGet, redis.Nil) {
+		return 0, errGet
+	}
+
+	account, errFind := ar.FindByUUID(accountUUID)
+	if errFind != nil {
+		return 0, errFind
+	}
+	updated, errSet := cache.SetIfNewer(ctx, ar.redis, ar.tokenVersionKey(accountUUID), account.TokenVersion, ar.app.RecordAge).Int()
+	if errSet != nil {
+		return 0, errSet
+	}
+	if updated == 0 {
+		// a revocation got there first
+		return ar.redis.Get(ctx, ar.tokenVersionKey(accountUUID)).Int64()
+	}
+
+	return account.TokenVersion, nil
+}
+
+func (ar *AccountRepository) setUsernameReference(ctx context.Context, pipe redis.Pipeliner, account *model.Account) error {
+	if account.UsernameKey() == "" {
+		return nil
 	}
 
 	accountReference := model.NewReference()
 	accountReference.SetAccountRandId(account.GetRandId())
-	errSet := ar.baseReference.WithPipeline(pipe).Set(ctx, accountReference, newUsername)
+	errSet := ar.baseReference.WithPipeline(pipe).Set(ctx, accountReference, account.UsernameKey())
 	if errSet != nil {
 		return errSet
 	}
+	return clearMissing(ctx, pipe, ar.missing.Username, account.UsernameKey())
+}
 
-	if selfPipe {
-		_, errExec := pipe.Exec(ctx)
-		return errExec
-	}
+// setReferences caches every key the account is looked up by: its username,
+// email address, uuid and phone number, and clears any of them remembered as
+// missing.
+func (ar *AccountRepository) setReferences(ctx context.Context, pipe redis.Pipeliner, account *model.Account) error {
+	accountReference := model.NewReference()
+	accountReference.SetAccountRandId(account.GetRandId())
 
-	return nil
-}
+	errSetUsernameRef := ar.setUsernameReference(ctx, pipe, account)
+	if errSetUsernameRef != nil {
+		return errSetUsernameRef
+	}
+	if account.EmailKey() != "" {
+		errSetEmailRef := ar.baseEmailReference.WithPipeline(pipe).Set(ctx, accountReference, account.EmailKey())
+		if errSetEmailRef != nil {
+			return errSetEmailRef
+		}
+	}
+	errSetUUIDRef := ar.baseUUIDReference.WithPipeline(pipe).Set(ctx, accountReference, account.GetUUID())
+	if errSetUUIDRef != nil {
+		return errSetUUIDRef
+	}
+	if account.Phone != "" {
+		errSetPhoneRef := ar.basePhoneReference.WithPipeline(pipe).Set(ctx, accountReference, account.Phone)
+		if errSetPhoneRef != nil {
+			return errSetPhoneRef
+		}
+	}
 
-func (ar *AccountRepository) Delete(ctx context.Context, pipe redis.Pipeliner, db types.SQLExecutor, account *model.Account) error {
-	query := "DELETE FROM " + ar.app.EntityName + " WHERE uuid = $1"
-	_, errDelete := db.ExecContext(ctx, query, account.GetUUID())
-	if errDelete != nil {
-		return errDelete
+	errClearAccount := clearMissing(ctx, pipe, ar.missing.Account, account.GetRandId())
+	if errClearAccount != nil {
+		return errClearAccount
+	}
+	errClearEmail := clearMissing(ctx, pipe, ar.missing.Email, account.EmailKey())
+	if errClearEmail != nil {
+		return errClearEmail
+	}
+	errClearUUID := clearMissing(ctx, pipe, ar.missing.UUID, account.GetUUID())
+	if errClearUUID != nil {
+		return errClearUUID
 	}
+	return clearMissing(ctx, pipe, ar.missing.Phone, account.Phone)
+}
 
+// seed caches the account together with all of its references.
+func (ar *AccountRepository) seed(ctx context.Context, pipe redis.Pipeliner, account *model.Account) error {
 	var selfPipe bool
 	if pipe == nil {
 		pipe = ar.redis.Pipeline()
+		selfPipe = true
 	}
 
-	errDelAcc := ar.base.WithPipeline(pipe).Del(ctx, account)
-	if errDelAcc != nil {
-		return errDelAcc
+	ar.versions.Set(ctx, pipe, account.GetRandId(), account.Revision)
+	errSetAcc := ar.base.WithPipeline(pipe).Set(ctx, account)
+	if errSetAcc != nil {
+		return errSetAcc
 	}
 
-	referenceExists := true
-	ref, errGet := ar.baseReference.Get(ctx, account.Username)
-	if errGet != nil {
-		if errGet == redis.Nil {
-			referenceExists = false
-		} else {
-			return errGet
-		}
-	}
-	if referenceExists {
-		err := ar.baseReference.WithPipeline(pipe).Del(ctx, ref)
-		if err != nil {
-			return err
-		}
+	errSetReference := ar.setReferences(ctx, pipe, account)
+	if errSetReference != nil {
+		return errSetReference
 	}
 
 	if selfPipe {
-		_, errExec := pipe.Exec(ctx)
-		return errExec
+		return cache.Flush(ctx, ar.redis, pipe)
 	}
 
 	return nil
 }
 
-func (ar *AccountRepository) FindByUsername(username string) (*model.Account, error) {
-	return AccountRowScanner(ar.findByUsernameStmt.QueryRow(username))
-}
-
-func (ar *AccountRepository) SeedByUsername(ctx context.Context, pipe redis.Pipeliner, username string) error {
-	account, err := ar.FindByUsername(username)
-	if err != nil {
-		return err
-	}
-	if account == nil {
-		errSetBlank := ar.baseReference.MarkAsMissing(ctx, username)
+// markMissing remembers that no account is found under key. missing is nil
+// when negative caching is disabled.
+func markMissing[T redifu.SQLItemBlueprint](ctx context.Context, missing *redifu.Base[T], key string, errFind error) error {
+	if errors.Is(errFind, model.AccountDoesNotExists) && missing != nil {
+		errSetBlank := missing.MarkAsMissing(ctx, key)
 		if errSetBlank != nil {
 			return errSetBlank
 		}
+	}
+	return errFind
+}
 
-		return model.AccountDoesNotExists
+// clearMissing forgets that no account was found under key, in the pipeline
+// that caches the account there.
+func clearMissing[T redifu.SQLItemBlueprint](ctx context.Context, pipe redis.Pipeliner, missing *redifu.Base[T], key string) error {
+	if missing == nil || key == "" {
+		return nil
 	}
+	return missing.WithPipeline(pipe).DelMissing(ctx, key)
+}
 
+// UpdateReference moves the username reference from oldKey to the account's
+// current username key. oldKey may be empty when a username is added.
+func (ar *AccountRepository) UpdateReference(ctx context.Context, pipe redis.Pipeliner, account *model.Account, oldKey string) error {
 	var selfPipe bool
 	if pipe == nil {
 		pipe = ar.redis.Pipeline()
 		selfPipe = true
 	}
 
-	errSetAcc := ar.base.WithPipeline(pipe).Set(ctx, account)
-	if errSetAcc != nil {
-		return errSetAcc
+	if oldKey != "" {
+		err := ar.baseReference.WithPipeline(pipe).Del(ctx, model.NewReference(), oldKey)
+		if err != nil {
+			return err
+		}
 	}
 
-	accountReference := model.NewReference()
-	accountReference.SetAccountRandId(account.GetRandId())
-	errSetReference := ar.baseReference.WithPipeline(pipe).Set(ctx, accountReference, account.Username)
-	if errSetReference != nil {
-		return errSetReference
+	errSet := ar.setUsernameReference(ctx, pipe, account)
+	if errSet != nil {
+		return errSet
 	}
 
 	if selfPipe {
-		_, errExec := pipe.Exec(ctx)
-		return errExec
+		return cache.Flush(ctx, ar.redis, pipe)
 	}
 
 	return nil
 }
 
-func (ar *AccountRepository) FindByRandId(randId string) (*model.Account, error) {
-	return AccountRowScanner(ar.findByRandIdStmt.QueryRow(randId))
-}
+// UpdatePhoneReference moves the phone reference from oldPhone to newPhone.
+// Either may be empty when a phone number is added or removed.
+func (ar *AccountRepository) UpdatePhoneReference(ctx context.Context, pipe redis.Pipeliner, account *model.Account, oldPhone string, newPhone string) error {
+	var selfPipe bool
+	if pipe == nil {
+		pipe = ar.redis.Pipeline()
+		selfPipe = true
+	}
 
-func (ar *AccountRepository) SeedByRandId(ctx context.Context, pipe redis.Pipeliner, randId string) error {
-	account, err := ar.FindByRandId(randId)
-	if err != nil {
-		if errors.Is(err, model.AccountDoesNotExists) {
-			errSetBlank := ar.baseReference.MarkAsMissing(ctx, randId)
-			if errSetBlank != nil {
-				return errSetBlank
-			}
+	if oldPhone != "" {
+		err := ar.basePhoneReference.WithPipeline(pipe).Del(ctx, model.NewReference(), oldPhone)
+		if err != nil {
+			return err
+		}
+	}
+
+	if newPhone != "" {
+		accountReference := model.NewReference()
+		accountReference.SetAccountRandId(account.GetRandId())
+		errSet := ar.basePhoneReference.WithPipeline(pipe).Set(ctx, accountReference, newPhone)
+		if errSet != nil {
+			return errSet
+		}
+		errClear := clearMissing(ctx, pipe, ar.missing.Phone, newPhone)
+		if errClear != nil {
+			return errClear
 		}
-		return err
 	}
 
+	if selfPipe {
+		return cache.Flush(ctx, ar.redis, pipe)
+	}
+
+	return nil
+}
+
+// UpdateEmailReference moves the email reference from oldKey to newKey,
+// both as returned by EmailKey. Either may be empty when an email address is
+// added or removed.
+func (ar *AccountRepository) UpdateEmailReference(ctx context.Context, pipe redis.Pipeliner, account *model.Account, oldKey string, newKey string) error {
 	var selfPipe bool
 	if pipe == nil {
 		pipe = ar.redis.Pipeline()
 		selfPipe = true
 	}
 
-	errSetAcc := ar.base.WithPipeline(pipe).Set(ctx, account)
-	if errSetAcc != nil {
-		return errSetAcc
+	if oldKey != "" {
+		err := ar.baseEmailReference.WithPipeline(pipe).Del(ctx, model.NewReference(), oldKey)
+		if err != nil {
+			return err
+		}
 	}
 
-	accountReference := model.NewReference()
-	accountReference.SetAccountRandId(account.GetRandId())
-	errSetReference := ar.baseReference.WithPipeline(pipe).Set(ctx, accountReference, account.Username)
-	if errSetReference != nil {
-		return errSetReference
+	if newKey != "" {
+		accountReference := model.NewReference()
+		accountReference.SetAccountRandId(account.GetRandId())
+		errSet := ar.baseEmailReference.WithPipeline(pipe).Set(ctx, accountReference, newKey)
+		if errSet != nil {
+			return errSet
+		}
+		errClear := clearMissing(ctx, pipe, ar.missing.Email, newKey)
+		if errClear != nil {
+			return errClear
+		}
 	}
 
 	if selfPipe {
-		_, errExec := pipe.Exec(ctx)
-		return errExec
+		return cache.Flush(ctx, ar.redis, pipe)
 	}
 
 	return nil
 }
 
-func (ar *AccountRepository) FindByEmail(email string) (*model.Account, error) {
-	return AccountRowScanner(ar.findByEmailStmt.QueryRow(email))
-}
-
-func (ar *AccountRepository) SeedByEmail(ctx context.Context, pipe redis.Pipeliner, email string) error {
-	account, err := ar.FindByEmail(email)
-	if err != nil {
-		return err
+func (ar *AccountRepository) Delete(ctx context.Context, pipe redis.Pipeliner, db types.SQLExecutor, account *model.Account) error {
+	query := "DELETE FROM " + ar.app.EntityName + " WHERE uuid = $1"
+	_, errDelete := db.ExecContext(ctx, query, account.GetUUID())
+	if errDelete != nil {
+		return errDelete
 	}
 
 	var selfPipe bool
@@ -293,32 +468,204 @@ func (ar *AccountRepository) SeedByEmail(ctx context.Context, pipe redis.Pipelin
 		selfPipe = true
 	}
 
-	errSetAcc := ar.base.WithPipeline(pipe).Set(ctx, account)
-	if errSetAcc != nil {
-		return errSetAcc
+	ar.versions.Tombstone(ctx, pipe, account.GetRandId())
+	errDelAcc := ar.base.WithPipeline(pipe).Del(ctx, account)
+	if errDelAcc != nil {
+		return errDelAcc
 	}
 
-	accountReference := model.NewReference()
-	accountReference.SetAccountRandId(account.GetRandId())
-	errSetReference := ar.baseReference.WithPipeline(pipe).Set(ctx, accountReference, account.Username)
-	if errSetReference != nil {
-		return errSetReference
+	if account.UsernameKey() != "" {
+		errDelRef := ar.baseReference.WithPipeline(pipe).Del(ctx, model.NewReference(), account.UsernameKey())
+		if errDelRef != nil {
+			return errDelRef
+		}
+	}
+	if account.EmailKey() != "" {
+		errDelEmailRef := ar.baseEmailReference.WithPipeline(pipe).Del(ctx, model.NewReference(), account.EmailKey())
+		if errDelEmailRef != nil {
+			return errDelEmailRef
+		}
 	}
+	errDelUUIDRef := ar.baseUUIDReference.WithPipeline(pipe).Del(ctx, model.NewReference(), account.GetUUID())
+	if errDelUUIDRef != nil {
+		return errDelUUIDRef
+	}
+	if account.Phone != "" {
+		errDelPhoneRef := ar.basePhoneReference.WithPipeline(pipe).Del(ctx, model.NewReference(), account.Phone)
+		if errDelPhoneRef != nil {
+			return errDelPhoneRef
+		}
+	}
+	pipe.Del(ctx, ar.tokenVersionKey(account.GetUUID()))
+	ar.invalidatePages(ctx, pipe)
 
 	if selfPipe {
-		_, errExec := pipe.Exec(ctx)
-		return errExec
+		return cache.Flush(ctx, ar.redis, pipe)
 	}
 
 	return nil
 }
 
+// FindByUsername looks an account up by its canonical username. Rows that
+// have not been backfilled yet match on the lowercased username instead.
+func (ar *AccountRepository) FindByUsername(username string) (*model.Account, error) {
+	return AccountRowScanner(ar.findByUsernameStmt.QueryRow(username))
+}
+
+// UsernameConflict reports UsernameTaken when another account holds the
+// canonical username and UsernameConfusable when one holds a lookalike.
+// Rows that have not been backfilled yet have no skeleton and are compared by
+// their lowercased username.
+func (ar *AccountRepository) UsernameConflict(ctx context.Context, db types.SQLExecutor, account *model.Account) error {
+	query := "SELECT COALESCE(username_canonical, lower(username)) FROM " + ar.app.EntityName +
+		" WHERE (username_canonical = $1 OR username_skeleton = $2 OR (username_canonical IS NULL AND lower(username) = $1))" +
+		" AND uuid <> $3 LIMIT 1"
+	var canonical string
+	errScan := db.QueryRowContext(ctx, query, account.UsernameCanonical, account.UsernameSkeleton, account.GetUUID()).Scan(&canonical)
+	if errScan != nil {
+		if errScan == sql.ErrNoRows {
+			return nil
+		}
+		return errScan
+	}
+	if canonical == account.UsernameCanonical {
+		return model.UsernameTaken
+	}
+	return model.UsernameConfusable
+}
+
+// FindWithoutCanonicalUsername returns up to limit accounts, ordered by uuid
+// after afterUUID, whose username predates canonical usernames.
+func (ar *AccountRepository) FindWithoutCanonicalUsername(ctx context.Context, db types.SQLExecutor, afterUUID string, limit int) ([]*model.Account, error) {
+	query := "SELECT uuid, randid, username FROM " + ar.app.EntityName +
+		" WHERE username_canonical IS NULL AND username IS NOT NULL AND uuid::text > $1 ORDER BY uuid::text LIMIT $2"
+	rows, errQuery := db.QueryContext(ctx, query, afterUUID, limit)
+	if errQuery != nil {
+		return nil, errQuery
+	}
+	defer rows.Close()
+
+	var accounts []*model.Account
+	for rows.Next() {
+		account := model.NewAccount()
+		errScan := rows.Scan(&account.UUID, &account.RandId, &account.Base.Username)
+		if errScan != nil {
+			return nil, errScan
+		}
+		accounts = append(accounts, account)
+	}
+	return accounts, rows.Err()
+}
+
+func (ar *AccountRepository) SetCanonicalUsername(ctx context.Context, db types.SQLExecutor, account *model.Account) error {
+	query := "UPDATE " + ar.app.EntityName + " SET username = $1, username_canonical = $2, username_skeleton = $3 WHERE uuid = $4"
+	_, errUpdate := db.ExecContext(ctx, query, account.Username, account.UsernameCanonical, account.UsernameSkeleton, account.GetUUID())
+	return errUpdate
+}
+
+// EmailConflict reports EmailTaken when another account holds canonical, the
+// canonical form of an email address. Rows that have not been backfilled yet
+// are canonicalized in SQL, see legacyEmailMatch.
+func (ar *AccountRepository) EmailConflict(ctx context.Context, db types.SQLExecutor, canonical string, exceptUUID string) error {
+	query := "SELECT 1 FROM " + ar.app.EntityName +
+		" WHERE (email_canonical = $1 OR (email_canonical IS NULL AND " + legacyEmailMatch(ar.app, "$1") + ")) AND uuid <> $2 LIMIT 1"
+	var found int
+	errScan := db.QueryRowContext(ctx, query, canonical, exceptUUID).Scan(&found)
+	if errScan != nil {
+		if errScan == sql.ErrNoRows {
+			return nil
+		}
+		return errScan
+	}
+	return model.EmailTaken
+}
+
+// FindWithoutCanonicalEmail returns up to limit accounts, ordered by uuid
+// after afterUUID, whose email address predates canonical emails.
+func (ar *AccountRepository) FindWithoutCanonicalEmail(ctx context.Context, db types.SQLExecutor, afterUUID string, limit int) ([]*model.Account, error) {
+	query := "SELECT uuid, randid, email FROM " + ar.app.EntityName +
+		" WHERE email_canonical IS NULL AND email IS NOT NULL AND uuid::text > $1 ORDER BY uuid::text LIMIT $2"
+	rows, errQuery := db.QueryContext(ctx, query, afterUUID, limit)
+	if errQuery != nil {
+		return nil, errQuery
+	}
+	defer rows.Close()
+
+	var accounts []*model.Account
+	for rows.Next() {
+		account := model.NewAccount()
+		errScan := rows.Scan(&account.UUID, &account.RandId, &account.Base.Email)
+		if errScan != nil {
+			return nil, errScan
+		}
+		accounts = append(accounts, account)
+	}
+	return accounts, rows.Err()
+}
+
+func (ar *AccountRepository) SetCanonicalEmail(ctx context.Context, db types.SQLExecutor, account *model.Account) error {
+	query := "UPDATE " + ar.app.EntityName + " SET email_canonical = $1 WHERE uuid = $2"
+	_, errUpdate := db.ExecContext(ctx, query, account.EmailCanonical, account.GetUUID())
+	return errUpdate
+}
+
+func (ar *AccountRepository) SeedByUsername(ctx context.Context, pipe redis.Pipeliner, username string) error {
+	account, err := ar.FindByUsername(username)
+	if err != nil {
+		return markMissing(ctx, ar.missing.Username, username, err)
+	}
+	return ar.seed(ctx, pipe, account)
+}
+
+func (ar *AccountRepository) FindByRandId(randId string) (*model.Account, error) {
+	return AccountRowScanner(ar.findByRandIdStmt.QueryRow(randId))
+}
+
+func (ar *AccountRepository) SeedByRandId(ctx context.Context, pipe redis.Pipeliner, randId string) error {
+	account, err := ar.FindByRandId(randId)
+	if err != nil {
+		return markMissing(ctx, ar.missing.Account, randId, err)
+	}
+	return ar.seed(ctx, pipe, account)
+}
+
+// FindByEmail looks an account up by its canonical email address. Rows that
+// have not been backfilled yet are canonicalized in SQL, see legacyEmailMatch.
+func (ar *AccountRepository) FindByEmail(email string) (*model.Account, error) {
+	return AccountRowScanner(ar.findByEmailStmt.QueryRow(email))
+}
+
+func (ar *AccountRepository) SeedByEmail(ctx context.Context, pipe redis.Pipeliner, email string) error {
+	account, err := ar.FindByEmail(email)
+	if err != nil {
+		return markMissing(ctx, ar.missing.Email, email, err)
+	}
+	return ar.seed(ctx, pipe, account)
+}
+
 func (ar *AccountRepository) FindByUUID(uuid string) (*model.Account, error) {
 	return AccountRowScanner(ar.findByUUIDStmt.QueryRow(uuid))
 }
 
+// FindByUUIDForUpdate reads the account from db and locks its row until db
+// commits, so the row it is compared against cannot change underneath.
+func (ar *AccountRepository) FindByUUIDForUpdate(ctx context.Context, db types.SQLExecutor, uuid string) (*model.Account, error) {
+	query := "SELECT " + accountColumns + " FROM " + ar.app.EntityName + " WHERE uuid = $1 FOR UPDATE"
+	return AccountRowScanner(db.QueryRowContext(ctx, query, uuid))
+}
+
 func (ar *AccountRepository) SeedByUUID(ctx context.Context, pipe redis.Pipeliner, uuid string) error {
 	account, err := ar.FindByUUID(uuid)
+	if err != nil {
+		return markMissing(ctx, ar.missing.UUID, uuid, err)
+	}
+	return ar.seed(ctx, pipe, account)
+}
+
+// SeedMovedReference caches the account under a username it gave up but
+// still holds, so fetching by the old username resolves to it.
+func (ar *AccountRepository) SeedMovedReference(ctx context.Context, pipe redis.Pipeliner, accountUUID string, oldKey string) error {
+	account, err := ar.FindByUUID(accountUUID)
 	if err != nil {
 		return err
 	}
@@ -329,29 +676,206 @@ func (ar *AccountRepository) SeedByUUID(ctx context.Context, pipe redis.Pipeline
 		selfPipe = true
 	}
 
-	errSetAcc := ar.base.WithPipeline(pipe).Set(ctx, account)
-	if errSetAcc != nil {
-		return errSetAcc
+	errSeed := ar.seed(ctx, pipe, account)
+	if errSeed != nil {
+		return errSeed
 	}
 
 	accountReference := model.NewReference()
 	accountReference.SetAccountRandId(account.GetRandId())
-	errSetReference := ar.baseReference.WithPipeline(pipe).Set(ctx, accountReference, account.Username)
+	errSetReference := ar.baseReference.WithPipeline(pipe).Set(ctx, accountReference, oldKey)
 	if errSetReference != nil {
 		return errSetReference
 	}
 
 	if selfPipe {
-		_, errExec := pipe.Exec(ctx)
-		return errExec
+		return cache.Flush(ctx, ar.redis, pipe)
 	}
 
 	return nil
 }
 
-func AccountRowScanner(row *sql.Row) (*model.Account, error) {
+func (ar *AccountRepository) FindByPhone(phone string) (*model.Account, error) {
+	return AccountRowScanner(ar.findByPhoneStmt.QueryRow(phone))
+}
+
+func (ar *AccountRepository) SeedByPhone(ctx context.Context, pipe redis.Pipeliner, phone string) error {
+	account, err := ar.FindByPhone(phone)
+	if err != nil {
+		return markMissing(ctx, ar.missing.Phone, phone, err)
+	}
+	return ar.seed(ctx, pipe, account)
+}
+
+func (ar *AccountRepository) pageGenerationKey() string {
+	return ar.app.EntityName + ":accounts:generation"
+}
+
+// invalidatePages moves cached account pages to a new generation, leaving
+// the old ones to expire.
+func (ar *AccountRepository) invalidatePages(ctx context.Context, pipe redis.Pipeliner) {
+	pipe.Incr(ctx, ar.pageGenerationKey())
+}
+
+// PageKey returns the cache key of a page in the current generation. Take it
+// before reading the page from the database, so a page read while accounts
+// change is stored under a generation nobody asks for anymore.
+func (ar *AccountRepository) PageKey(ctx context.Context, cacheKey string) (string, error) {
+	generation, errGet := ar.redis.Get(ctx, ar.pageGenerationKey()).Int64()
+	if errGet != nil && !errors.Is(errGet, redis.Nil) {
+		return "", errGet
+	}
+	return ar.app.EntityName + ":accounts:" + strconv.FormatInt(generation, 10) + ":" + cacheKey, nil
+}
+
+type cachedPage struct {
+	RandIds    []string `json:"randIds"`
+	NextCursor string   `json:"nextCursor,omitempty"`
+}
+
+// GetPage returns nil when the page is not cached or one of its accounts has
+// expired from the cache.
+func (ar *AccountRepository) GetPage(ctx context.Context, pageKey string) (*model.AccountPage, error) {
+	raw, errGet := ar.redis.Get(ctx, pageKey).Bytes()
+	if errGet != nil {
+		if errors.Is(errGet, redis.Nil) {
+			return nil, nil
+		}
+		return nil, errGet
+	}
+
+	var cached cachedPage
+	errUnmarshal := json.Unmarshal(raw, &cached)
+	if errUnmarshal != nil {
+		return nil, errUnmarshal
+	}
+
+	page := &model.AccountPage{Accounts: make([]*model.Account, 0, len(cached.RandIds)), NextCursor: cached.NextCursor}
+	for _, randId := range cached.RandIds {
+		account, errGetAcc := ar.base.Get(ctx, randId)
+		if errors.Is(errGetAcc, redis.Nil) || (errGetAcc == nil && account == nil) {
+			return nil, nil
+		}
+		if errGetAcc != nil {
+			return nil, errGetAcc
+		}
+		stale, errCheck := ar.versions.IsStale(ctx, randId, account.Revision)
+		if errCheck != nil {
+			return nil, errCheck
+		}
+		if stale {
+			return nil, nil
+		}
+		page.Accounts = append(page.Accounts, account)
+	}
+	return page, nil
+}
+
+// SetPage caches the page for PaginationAge, with its accounts in the
+// account base.
+func (ar *AccountRepository) SetPage(ctx context.Context, pageKey string, page *model.AccountPage) error {
+	cached := cachedPage{RandIds: make([]string, 0, len(page.Accounts)), NextCursor: page.NextCursor}
+	pipe := ar.redis.Pipeline()
+	for _, account := range page.Accounts {
+		ar.versions.Set(ctx, pipe, account.GetRandId(), account.Revision)
+		errSetAcc := ar.base.WithPipeline(pipe).Set(ctx, account)
+		if errSetAcc != nil {
+			return errSetAcc
+		}
+		cached.RandIds = append(cached.RandIds, account.GetRandId())
+	}
+
+	raw, errMarshal := json.Marshal(cached)
+	if errMarshal != nil {
+		return errMarshal
+	}
+	pipe.Set(ctx, pageKey, raw, ar.app.PaginationAge)
+
+	return cache.Flush(ctx, ar.redis, pipe)
+}
+
+// legacyEmailMatch compares the address of a row without a canonical email to
+// the canonical address in param, using the index migrations build for it.
+// Without provider rules the canonical form is the case-insensitive address
+// the unique email index covers.
+func legacyEmailMatch(app *config.App, param string) string {
+	if app.Email.ProviderRules {
+		return model.ProviderCanonicalEmailSQL("email") + " = " + param
+	}
+	return "email = " + param + "::citext"
+}
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// FindPage returns up to limit accounts matching filter, newest first,
+// starting after the cursor when one is given. Prefixes are expected folded
+// to lower case.
+func (ar *AccountRepository) FindPage(ctx context.Context, filter model.AccountFilter, after *model.AccountCursor, limit int) ([]*model.Account, error) {
+	var conditions []string
+	var args []interface{}
+	where := func(condition string, values ...interface{}) {
+		for _, value := range values {
+			args = append(args, value)
+			condition = strings.Replace(condition, "?", "$"+strconv.Itoa(len(args)), 1)
+		}
+		conditions = append(conditions, condition)
+	}
+
+	if filter.EmailVerified != nil {
+		where("email_verified = ?", *filter.EmailVerified)
+	}
+	if filter.PhoneVerified != nil {
+		where("phone_verified = ?", *filter.PhoneVerified)
+	}
+	if !filter.CreatedAfter.IsZero() {
+		where("created_at >= ?", filter.CreatedAfter)
+	}
+	if !filter.CreatedBefore.IsZero() {
+		where("created_at < ?", filter.CreatedBefore)
+	}
+	if filter.UsernamePrefix != "" {
+		where("COALESCE(username_canonical, LOWER(username)) LIKE ?", likeEscaper.Replace(filter.UsernamePrefix)+"%")
+	}
+	if filter.EmailPrefix != "" {
+		where("LOWER(email) LIKE ?", likeEscaper.Replace(filter.EmailPrefix)+"%")
+	}
+	if filter.Status != "" {
+		where("status = ?", filter.Status)
+	}
+	if after != nil {
+		where("(created_at, uuid) < (?, ?)", after.CreatedAt, after.UUID)
+	}
+
+	query := "SELECT " + accountColumns + " FROM " + ar.app.EntityName
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	args = append(args, limit)
+	query += " ORDER BY created_at DESC, uuid DESC LIMIT $" + strconv.Itoa(len(args))
+
+	rows, errQuery := ar.readDB.QueryContext(ctx, query, args...)
+	if errQuery != nil {
+		return nil, errQuery
+	}
+	defer rows.Close()
+
+	var accounts []*model.Account
+	for rows.Next() {
+		account, errScan := AccountRowScanner(rows)
+		if errScan != nil {
+			return nil, errScan
+		}
+		accounts = append(accounts, account)
+	}
+	return accounts, rows.Err()
+}
+
+func AccountRowScanner(scanner interface {
+	Scan(dest ...interface{}) error
+}) (*model.Account, error) {
 	account := model.NewAccount()
-	err := row.Scan(
+	var attributes []byte
+	err := scanner.Scan(
 		&account.UUID,
 		&account.RandId,
 		&account.CreatedAt,
@@ -362,6 +886,15 @@ func AccountRowScanner(row *sql.Row) (*model.Account, error) {
 		&account.Base.Email,
 		&account.Base.Avatar,
 		&account.Base.EmailVerified,
+		&account.Base.TokenVersion,
+		&account.Base.Phone,
+		&account.Base.PhoneVerified,
+		&account.Base.UsernameCanonical,
+		&account.Base.UsernameSkeleton,
+		&account.Base.EmailCanonical,
+		&account.Base.Status,
+		&account.Base.Revision,
+		&attributes,
 	)
 
 	if err != nil {
@@ -370,45 +903,59 @@ func AccountRowScanner(row *sql.Row) (*model.Account, error) {
 		}
 		return nil, err
 	}
+	account.Attributes = attributes
 
 	return account, nil
 }
 
-func NewAccountRepository(readDB *sql.DB, redis redis.UniversalClient, baseAccount *redifu.Base[*model.Account], baseReference *redifu.Base[*model.AccountReference], app *config.App) *AccountRepository {
+func NewAccountRepository(readDB *sql.DB, redis redis.UniversalClient, baseAccount *redifu.Base[*model.Account], baseReference *redifu.Base[*model.AccountReference], baseEmailReference *redifu.Base[*model.AccountReference], baseUUIDReference *redifu.Base[*model.AccountReference], basePhoneReference *redifu.Base[*model.AccountReference], missing MissingBases, versions *cache.Versions, app *config.App) *AccountRepository {
 	var errPrepare error
 	findByUsernameStmt, errPrepare := readDB.Prepare(
-		"SELECT uuid, randid, created_at, updated_at, name, username, password, email, avatar, email_verified FROM " +
-			app.EntityName + " WHERE username = $1")
+		"SELECT " + accountColumns + " FROM " +
+			app.EntityName + " WHERE username_canonical = $1 OR (username_canonical IS NULL AND lower(username) = lower($1))")
 	if errPrepare != nil {
 		panic(errPrepare)
 	}
 	findByRandId, errPrepare := readDB.Prepare(
-		"SELECT uuid, randid, created_at, updated_at, name, username, password, email, avatar, email_verified FROM " +
+		"SELECT " + accountColumns + " FROM " +
 			app.EntityName + " WHERE randId = $1")
 	if errPrepare != nil {
 		panic(errPrepare)
 	}
 	findByEmailStmt, errPrepare := readDB.Prepare("" +
-		"SELECT uuid, randid, created_at, updated_at, name, username, password, email, avatar, email_verified FROM " +
-		app.EntityName + " WHERE email = $1")
+		"SELECT " + accountColumns + " FROM " +
+		app.EntityName + " WHERE email_canonical = $1 OR (email_canonical IS NULL AND " + legacyEmailMatch(app, "$1") + ")")
 	if errPrepare != nil {
 		panic(errPrepare)
 	}
 	findByUUIDStmt, errPrepare := readDB.Prepare(
-		"SELECT uuid, randid, created_at, updated_at, name, username, password, email, avatar, email_verified FROM " +
+		"SELECT " + accountColumns + " FROM " +
 			app.EntityName + " WHERE uuid = $1")
 	if errPrepare != nil {
 		panic(errPrepare)
 	}
+	findByPhoneStmt, errPrepare := readDB.Prepare(
+		"SELECT " + accountColumns + " FROM " +
+			app.EntityName + " WHERE phone = $1")
+	if errPrepare != nil {
+		panic(errPrepare)
+	}
 
 	return &AccountRepository{
+		readDB:             readDB,
 		base:               baseAccount,
 		baseReference:      baseReference,
+		baseEmailReference: baseEmailReference,
+		baseUUIDReference:  baseUUIDReference,
+		basePhoneReference: basePhoneReference,
+		missing:            missing,
+		versions:           versions,
 		redis:              redis,
 		findByUsernameStmt: findByUsernameStmt,
 		findByRandIdStmt:   findByRandId,
 		findByEmailStmt:    findByEmailStmt,
 		findByUUIDStmt:     findByUUIDStmt,
+		findByPhoneStmt:    findByPhoneStmt,
 		app:                app,
 	}
 }
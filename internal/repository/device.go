@@ -0,0 +1,52 @@
+package repository
+
+import (
+	"context"
+	"github.com/21strive/commonuser/config"
+	"github.com/21strive/commonuser/internal/model"
+	"github.com/21strive/commonuser/internal/types"
+	"time"
+)
+
+type DeviceRepository struct {
+	app *config.App
+}
+
+// Record remembers the device for the account and reports whether the
+// device id and its device type were seen before. Both are reported as known
+// when the account has no devices yet, so the first sign in does not count
+// as a new one.
+func (dr *DeviceRepository) Record(ctx context.Context, db types.SQLExecutor, accountUUID string, device *model.DeviceInfo) (bool, bool, error) {
+	tableName := dr.app.EntityName + "_device"
+
+	var knownDevices, knownOfType int
+	errCount := db.QueryRowContext(ctx,
+		`SELECT COUNT(*), COUNT(*) FILTER (WHERE device_type = $2) FROM `+tableName+` WHERE account_uuid = $1`,
+		accountUUID, device.DeviceType).Scan(&knownDevices, &knownOfType)
+	if errCount != nil {
+		return false, false, errCount
+	}
+
+	// xmax is zero only for a freshly inserted row
+	var inserted bool
+	timeNow := time.Now().UTC()
+	errUpsert := db.QueryRowContext(ctx,
+		`INSERT INTO `+tableName+` (account_uuid, device_id, device_type, user_agent, first_seen_at, last_seen_at) 
+		 VALUES ($1, $2, $3, $4, $5, $5) 
+		 ON CONFLICT (account_uuid, device_id) DO UPDATE SET device_type = EXCLUDED.device_type, 
+		 user_agent = EXCLUDED.user_agent, last_seen_at = EXCLUDED.last_seen_at 
+		 RETURNING (xmax = 0)`,
+		accountUUID, device.DeviceId, device.DeviceType, device.UserAgent, timeNow).Scan(&inserted)
+	if errUpsert != nil {
+		return false, false, errUpsert
+	}
+
+	if knownDevices == 0 {
+		return false, false, nil
+	}
+	return inserted, knownOfType == 0, nil
+}
+
+func NewDeviceRepository(app *config.App) *DeviceRepository {
+	return &DeviceRepository{app: app}
+}
@@ -0,0 +1,21 @@
+package repository
+
+import (
+	"context"
+	"github.com/21strive/commonuser/internal/types"
+)
+
+// execCount runs a statement and returns the number of rows it affected.
+func execCount(ctx context.Context, db types.SQLExecutor, query string, args ...interface{}) (int, error) {
+	result, errExec := db.ExecContext(ctx, query, args...)
+	if errExec != nil {
+		return 0, errExec
+	}
+
+	affected, errAffected := result.RowsAffected()
+	if errAffected != nil {
+		return 0, errAffected
+	}
+
+	return int(affected), nil
+}
@@ -0,0 +1,73 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"github.com/21strive/commonuser/config"
+	"github.com/21strive/commonuser/internal/model"
+	"github.com/21strive/commonuser/internal/types"
+	"time"
+)
+
+type OutboxRepository struct {
+	app *config.App
+}
+
+func (ob *OutboxRepository) Append(ctx context.Context, db types.SQLExecutor, eventName string, payload []byte) error {
+	tableName := ob.app.EntityName + "_outbox"
+	query := `INSERT INTO ` + tableName + ` (event_name, payload) VALUES ($1, $2)`
+	_, errInsert := db.ExecContext(ctx, query, eventName, payload)
+	return errInsert
+}
+
+// ClaimDue locks up to limit messages that are due for delivery, oldest
+// first. Rows locked by another relay are skipped, so the lock lasts until db
+// commits or rolls back.
+func (ob *OutboxRepository) ClaimDue(ctx context.Context, db types.SQLExecutor, limit int) ([]*model.OutboxMessage, error) {
+	tableName := ob.app.EntityName + "_outbox"
+	query := `SELECT id, event_name, payload, created_at, attempts, last_error FROM ` + tableName + ` 
+			  WHERE next_attempt_at <= NOW() ORDER BY id LIMIT $1 FOR UPDATE SKIP LOCKED`
+	rows, errQuery := db.QueryContext(ctx, query, limit)
+	if errQuery != nil {
+		return nil, errQuery
+	}
+	defer rows.Close()
+
+	var messages []*model.OutboxMessage
+	for rows.Next() {
+		message := &model.OutboxMessage{}
+		var lastError sql.NullString
+		errScan := rows.Scan(
+			&message.Id,
+			&message.EventName,
+			&message.Payload,
+			&message.CreatedAt,
+			&message.Attempts,
+			&lastError,
+		)
+		if errScan != nil {
+			return nil, errScan
+		}
+		message.LastError = lastError.String
+		messages = append(messages, message)
+	}
+
+	return messages, rows.Err()
+}
+
+func (ob *OutboxRepository) Delete(ctx context.Context, db types.SQLExecutor, id int64) error {
+	tableName := ob.app.EntityName + "_outbox"
+	_, errDelete := db.ExecContext(ctx, `DELETE FROM `+tableName+` WHERE id = $1`, id)
+	return errDelete
+}
+
+func (ob *OutboxRepository) Reschedule(ctx context.Context, db types.SQLExecutor, message *model.OutboxMessage, nextAttemptAt time.Time) error {
+	tableName := ob.app.EntityName + "_outbox"
+	query := `UPDATE ` + tableName + ` SET attempts = $1, next_attempt_at = $2, last_error = $3 WHERE id = $4`
+	_, errUpdate := db.ExecContext(ctx, query, message.Attempts, nextAttemptAt, message.LastError, message.Id)
+	return errUpdate
+}
+
+func NewOutboxRepository(app *config.App) *OutboxRepository {
+	return &OutboxRepository{app: app}
+}
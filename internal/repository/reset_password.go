@@ -69,11 +69,20 @@ func (ar *ResetPasswordRepository) DeleteAllRequests(ctx context.Context, db typ
 	return nil
 }
 
+// PurgeExpired deletes up to batchSize expired reset password tickets and
+// returns how many rows were deleted.
+func (ar *ResetPasswordRepository) PurgeExpired(ctx context.Context, db types.SQLExecutor, batchSize int) (int, error) {
+	tableName := ar.app.EntityName + "_reset_password"
+	query := `DELETE FROM ` + tableName + ` WHERE uuid IN (
+			  SELECT uuid FROM ` + tableName + ` WHERE expired_at < NOW() LIMIT $1 FOR UPDATE SKIP LOCKED)`
+	return execCount(ctx, db, query, batchSize)
+}
+
 func NewResetPasswordRepository(readDB *sql.DB, app *config.App) *ResetPasswordRepository {
 	tableName := app.EntityName + "_reset_password"
 
 	// always find the most recent ticket
-	findByAccountStmt, errPrepare := readDB.Prepare("SELECT * FROM " + tableName + " WHERE account_uuid = $1 ORDER BY created_at DESC LIMIT 1")
+	findByAccountStmt, errPrepare := readDB.Prepare("SELECT uuid, randid, created_at, updated_at, account_uuid, token, expired_at FROM " + tableName + " WHERE account_uuid = $1 ORDER BY created_at DESC LIMIT 1")
 	if errPrepare != nil {
 		panic(errPrepare)
 	}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"database/sql"
 	"github.com/21strive/commonuser/config"
+	"github.com/21strive/commonuser/internal/cache"
 	"github.com/21strive/commonuser/internal/model"
 	"github.com/21strive/commonuser/internal/types"
 	"github.com/21strive/redifu"
@@ -12,12 +13,15 @@ import (
 )
 
 type SessionRepository struct {
-	base                  *redifu.Base[*model.Session]
-	entityName            string
-	tableName             string
-	findByRandIdStmt      *sql.Stmt
-	findByUUIDStmt        *sql.Stmt
-	findByAccountUUIDStmt *sql.Stmt
+	base                    *redifu.Base[*model.Session]
+	redis                   redis.UniversalClient
+	app                     *config.App
+	entityName              string
+	tableName               string
+	findByRandIdStmt        *sql.Stmt
+	findByUUIDStmt          *sql.Stmt
+	findByAccountUUIDStmt   *sql.Stmt
+	findActiveByAccountStmt *sql.Stmt
 }
 
 func (sm *SessionRepository) GetBase() *redifu.Base[*model.Session] {
@@ -46,39 +50,120 @@ func (sm *SessionRepository) Create(ctx context.Context, pipe redis.Pipeliner, d
 		return err
 	}
 
-	if pipe == nil {
-		return sm.base.Set(ctx, session)
-	} else {
-		return sm.base.WithPipeline(pipe).Set(ctx, session)
-	}
+	return sm.set(ctx, pipe, session)
 }
 
 func (sm *SessionRepository) Update(ctx context.Context, pipe redis.Pipeliner, db types.SQLExecutor, session *model.Session) error {
 	session.SetUpdatedAt(time.Now().UTC())
 	tableName := sm.entityName + "_session"
 	query := `UPDATE ` + tableName + ` SET updated_at = $1, last_active_at = $2, 
-			  revoked = $3, refresh_token = $4 WHERE uuid = $5`
+			  revoked = $3, refresh_token = $4, expired_at = $5 WHERE uuid = $6`
 	_, err := db.ExecContext(ctx,
 		query,
 		session.GetUpdatedAt(),
 		session.LastActiveAt,
 		session.Revoked,
 		session.RefreshToken,
+		session.ExpiredAt,
 		session.GetUUID(),
 	)
 	if err != nil {
 		return err
 	}
 
-	if pipe == nil {
-		return sm.base.Set(ctx, session)
-	} else {
+	return sm.set(ctx, pipe, session)
+}
+
+// set caches a session after its row was written. Without a pipeline the write
+// goes through cache.Flush, so a failure drops the entry instead of leaving
+// the previous one behind.
+func (sm *SessionRepository) set(ctx context.Context, pipe redis.Pipeliner, session *model.Session) error {
+	if pipe != nil {
 		return sm.base.WithPipeline(pipe).Set(ctx, session)
 	}
+
+	pipe = sm.redis.Pipeline()
+	errSet := sm.base.WithPipeline(pipe).Set(ctx, session)
+	if errSet != nil {
+		return errSet
+	}
+	return cache.Flush(ctx, sm.redis, pipe)
+}
+
+// RevokeByAccount revokes every live session of the account except
+// exceptRandId (empty to revoke them all) in one statement, then drops the
+// revoked sessions from the cache in a single pipeline. It returns the randIds
+// of the revoked sessions.
+func (sm *SessionRepository) RevokeByAccount(ctx context.Context, pipe redis.Pipeliner, db types.SQLExecutor, accountUUID string, exceptRandId string) ([]string, error) {
+	tableName := sm.entityName + "_session"
+	query := `UPDATE ` + tableName + ` SET revoked = true, updated_at = $1 
+			  WHERE account_uuid = $2 AND revoked = false AND randid <> $3 RETURNING randid`
+	rows, errQuery := db.QueryContext(ctx, query, time.Now().UTC(), accountUUID, exceptRandId)
+	if errQuery != nil {
+		return nil, errQuery
+	}
+	defer rows.Close()
+
+	var randIds []string
+	for rows.Next() {
+		var randId string
+		if errScan := rows.Scan(&randId); errScan != nil {
+			return nil, errScan
+		}
+		randIds = append(randIds, randId)
+	}
+	if errRows := rows.Err(); errRows != nil {
+		return nil, errRows
+	}
+	if len(randIds) == 0 {
+		return randIds, nil
+	}
+
+	var selfPipe bool
+	if pipe == nil {
+		pipe = sm.redis.Pipeline()
+		selfPipe = true
+	}
+
+	for _, randId := range randIds {
+		errDel := sm.base.WithPipeline(pipe).Del(ctx, model.NewSession(), randId)
+		if errDel != nil {
+			return nil, errDel
+		}
+	}
+
+	if selfPipe {
+		errFlush := cache.Flush(ctx, sm.redis, pipe)
+		if errFlush != nil {
+			return nil, errFlush
+		}
+	}
+
+	return randIds, nil
 }
 
 func (sm *SessionRepository) scanSession(ctx context.Context, pipe redis.Pipeliner, scanner interface {
 	Scan(dest ...interface{}) error
+}) (*model.Session, error) {
+	session, err := SessionRowScanner(scanner)
+	if err != nil {
+		return nil, err
+	}
+
+	if pipe == nil {
+		err = sm.base.Set(ctx, session)
+	} else {
+		err = sm.base.WithPipeline(pipe).Set(ctx, session)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return session, nil
+}
+
+func SessionRowScanner(scanner interface {
+	Scan(dest ...interface{}) error
 }) (*model.Session, error) {
 	session := model.NewSession()
 	err := scanner.Scan(
@@ -102,31 +187,16 @@ func (sm *SessionRepository) scanSession(ctx context.Context, pipe redis.Pipelin
 		return nil, err
 	}
 
-	if pipe == nil {
-		err = sm.base.Set(ctx, session)
-	} else {
-		err = sm.base.WithPipeline(pipe).Set(ctx, session)
-	}
-	if err != nil {
-		return nil, err
-	}
-
 	return session, nil
 }
 
 func (sm *SessionRepository) FindByRandId(ctx context.Context, pipe redis.Pipeliner, randId string) (*model.Session, error) {
-	row, errQuery := sm.findByRandIdStmt.QueryContext(ctx, randId)
-	if errQuery != nil {
-		return nil, errQuery
-	}
+	row := sm.findByRandIdStmt.QueryRowContext(ctx, randId)
 	return sm.scanSession(ctx, pipe, row)
 }
 
 func (sm *SessionRepository) FindByUUID(ctx context.Context, pipe redis.Pipeliner, uuid string) (*model.Session, error) {
-	row, errQuery := sm.findByUUIDStmt.QueryContext(ctx, uuid)
-	if errQuery != nil {
-		return nil, errQuery
-	}
+	row := sm.findByUUIDStmt.QueryRowContext(ctx, uuid)
 	return sm.scanSession(ctx, pipe, row)
 }
 
@@ -150,6 +220,78 @@ func (sm *SessionRepository) FindManyByAccount(ctx context.Context, pipe redis.P
 	return sessions, nil
 }
 
+// activeCutoffs returns the oldest last_active_at and created_at a session
+// may have under the idle timeout and maximum lifetime.
+func (sm *SessionRepository) activeCutoffs() (time.Time, time.Time) {
+	var activeSince, createdSince time.Time
+	timeNow := time.Now().UTC()
+	if sm.app.SessionIdleTimeout > 0 {
+		activeSince = timeNow.Add(-sm.app.SessionIdleTimeout)
+	}
+	if sm.app.SessionMaxLifetime > 0 {
+		createdSince = timeNow.Add(-sm.app.SessionMaxLifetime)
+	}
+	return activeSince, createdSince
+}
+
+// FindActiveByAccount pages through the sessions that are neither revoked nor
+// expired, most recently active first. Unlike the other finders it leaves the
+// cache untouched.
+func (sm *SessionRepository) FindActiveByAccount(ctx context.Context, accountUUID string, limit int, offset int) ([]*model.Session, error) {
+	activeSince, createdSince := sm.activeCutoffs()
+	rows, errQuery := sm.findActiveByAccountStmt.QueryContext(ctx, accountUUID, activeSince, createdSince, limit, offset)
+	if errQuery != nil {
+		return nil, errQuery
+	}
+	defer rows.Close()
+
+	var sessions []*model.Session
+	for rows.Next() {
+		session, errScan := SessionRowScanner(rows)
+		if errScan != nil {
+			return nil, errScan
+		}
+
+		sessions = append(sessions, session)
+	}
+
+	return sessions, rows.Err()
+}
+
+// LockActiveByAccount serialises session creation for one account until db
+// commits, then returns the account's active sessions, least recently active
+// first. db must be a transaction for the lock to outlive this call.
+func (sm *SessionRepository) LockActiveByAccount(ctx context.Context, db types.SQLExecutor, accountUUID string) ([]*model.Session, error) {
+	_, errLock := db.ExecContext(ctx, "SELECT pg_advisory_xact_lock(hashtext($1))", sm.entityName+":session:"+accountUUID)
+	if errLock != nil {
+		return nil, errLock
+	}
+
+	tableName := sm.entityName + "_session"
+	activeSince, createdSince := sm.activeCutoffs()
+	rows, errQuery := db.QueryContext(ctx, `SELECT uuid, randid, created_at, updated_at, last_active_at, account_uuid, device_id, device_type, 
+       				 user_agent, refresh_token, expired_at, revoked FROM `+tableName+` 
+       				 WHERE account_uuid = $1 AND revoked = false AND expired_at > NOW() 
+       				 AND last_active_at > $2 AND created_at > $3 
+       				 ORDER BY last_active_at ASC, uuid`, accountUUID, activeSince, createdSince)
+	if errQuery != nil {
+		return nil, errQuery
+	}
+	defer rows.Close()
+
+	var sessions []*model.Session
+	for rows.Next() {
+		session, errScan := SessionRowScanner(rows)
+		if errScan != nil {
+			return nil, errScan
+		}
+
+		sessions = append(sessions, session)
+	}
+
+	return sessions, rows.Err()
+}
+
 func (sm *SessionRepository) SeedByRandId(ctx context.Context, pipe redis.Pipeliner, randId string) error {
 	sessionFromDB, errFind := sm.FindByRandId(ctx, pipe, randId)
 	if errFind != nil {
@@ -174,6 +316,53 @@ func (sm *SessionRepository) PurgeInvalid(ctx context.Context, db types.SQLExecu
 	return nil
 }
 
+// PurgeExpired deletes up to batchSize sessions that can no longer be used,
+// whether expired, revoked, idle or past their lifetime, and drops them from
+// the cache. It returns how many rows were deleted.
+func (sm *SessionRepository) PurgeExpired(ctx context.Context, db types.SQLExecutor, batchSize int) (int, error) {
+	tableName := sm.entityName + "_session"
+	activeSince, createdSince := sm.activeCutoffs()
+	query := `DELETE FROM ` + tableName + ` WHERE uuid IN (
+			  SELECT uuid FROM ` + tableName + ` 
+			  WHERE expired_at < NOW() OR revoked = true OR last_active_at < $1 OR created_at < $2 
+			  LIMIT $3 FOR UPDATE SKIP LOCKED) RETURNING randid`
+	rows, errQuery := db.QueryContext(ctx, query, activeSince, createdSince, batchSize)
+	if errQuery != nil {
+		return 0, errQuery
+	}
+	defer rows.Close()
+
+	var randIds []string
+	for rows.Next() {
+		var randId string
+		if errScan := rows.Scan(&randId); errScan != nil {
+			return 0, errScan
+		}
+		randIds = append(randIds, randId)
+	}
+	if errRows := rows.Err(); errRows != nil {
+		return 0, errRows
+	}
+	if len(randIds) == 0 {
+		return 0, nil
+	}
+
+	pipe := sm.redis.Pipeline()
+	for _, randId := range randIds {
+		errDel := sm.base.WithPipeline(pipe).Del(ctx, model.NewSession(), randId)
+		if errDel != nil {
+			return len(randIds), errDel
+		}
+	}
+	// the rows are gone whether or not the cache follows
+	errFlush := cache.Flush(ctx, sm.redis, pipe)
+	if errFlush != nil {
+		return len(randIds), errFlush
+	}
+
+	return len(randIds), nil
+}
+
 func NewSessionRepository(readDB *sql.DB, redis redis.UniversalClient, baseSession *redifu.Base[*model.Session], app *config.App) *SessionRepository {
 	tableName := app.EntityName + "_session"
 	findByRandIdStmt, errPrepare := readDB.Prepare(`SELECT uuid, randid, created_at, updated_at, last_active_at, account_uuid, device_id, device_type, 
@@ -185,12 +374,23 @@ func NewSessionRepository(readDB *sql.DB, redis redis.UniversalClient, baseSessi
 	if errPrepare != nil {
 		panic(errPrepare)
 	}
+	findActiveByAccountStmt, errPrepare := readDB.Prepare(`SELECT uuid, randid, created_at, updated_at, last_active_at, account_uuid, device_id, device_type, 
+       				 user_agent, refresh_token, expired_at, revoked FROM ` + tableName + ` 
+       				 WHERE account_uuid = $1 AND revoked = false AND expired_at > NOW() 
+       				 AND last_active_at > $2 AND created_at > $3 
+       				 ORDER BY last_active_at DESC, uuid LIMIT $4 OFFSET $5`)
+	if errPrepare != nil {
+		panic(errPrepare)
+	}
 
 	return &SessionRepository{
-		base:                  baseSession,
-		entityName:            app.EntityName,
-		findByRandIdStmt:      findByRandIdStmt,
-		findByUUIDStmt:        findByUUIDStmt,
-		findByAccountUUIDStmt: findManyByAccountStmt,
+		base:                    baseSession,
+		redis:                   redis,
+		app:                     app,
+		entityName:              app.EntityName,
+		findByRandIdStmt:        findByRandIdStmt,
+		findByUUIDStmt:          findByUUIDStmt,
+		findByAccountUUIDStmt:   findManyByAccountStmt,
+		findActiveByAccountStmt: findActiveByAccountStmt,
 	}
 }
@@ -0,0 +1,223 @@
+package repository
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/hex"
+	"github.com/21strive/commonuser/config"
+	"github.com/21strive/commonuser/internal/model"
+	"github.com/21strive/commonuser/internal/schema"
+	"github.com/21strive/item"
+	"github.com/21strive/redifu"
+	_ "github.com/lib/pq"
+	"github.com/redis/go-redis/v9"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingDriver accepts every statement, remembers what was executed and
+// answers queries with no rows.
+type recordingDriver struct {
+	mu    sync.Mutex
+	execs []recordedExec
+}
+
+type recordedExec struct {
+	query string
+	args  []driver.Value
+}
+
+func (d *recordingDriver) Open(string) (driver.Conn, error) { return &recordingConn{driver: d}, nil }
+
+type recordingConn struct{ driver *recordingDriver }
+
+func (c *recordingConn) Prepare(query string) (driver.Stmt, error) {
+	return &recordingStmt{driver: c.driver, query: query}, nil
+}
+func (c *recordingConn) Close() error              { return nil }
+func (c *recordingConn) Begin() (driver.Tx, error) { return c, nil }
+func (c *recordingConn) Commit() error             { return nil }
+func (c *recordingConn) Rollback() error           { return nil }
+
+type recordingStmt struct {
+	driver *recordingDriver
+	query  string
+}
+
+func (s *recordingStmt) Close() error  { return nil }
+func (s *recordingStmt) NumInput() int { return -1 }
+func (s *recordingStmt) Exec(args []driver.Value) (driver.Result, error) {
+	s.driver.mu.Lock()
+	defer s.driver.mu.Unlock()
+	s.driver.execs = append(s.driver.execs, recordedExec{query: s.query, args: args})
+	return driver.RowsAffected(1), nil
+}
+func (s *recordingStmt) Query([]driver.Value) (driver.Rows, error) { return emptyRows{}, nil }
+
+type emptyRows struct{}
+
+func (emptyRows) Columns() []string         { return nil }
+func (emptyRows) Close() error              { return nil }
+func (emptyRows) Next([]driver.Value) error { return io.EOF }
+
+var registerRecorder sync.Once
+
+func openRecorder(t *testing.T) (*sql.DB, *recordingDriver) {
+	recorder := &recordingDriver{}
+	registerRecorder.Do(func() {
+		sql.Register("commonuser-recorder", &recorderRouter{})
+	})
+	name := t.Name()
+	recorders.Store(name, recorder)
+	t.Cleanup(func() { recorders.Delete(name) })
+
+	db, errOpen := sql.Open("commonuser-recorder", name)
+	if errOpen != nil {
+		t.Fatal(errOpen)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db, recorder
+}
+
+// recorderRouter hands each test its own recordingDriver, keyed by the DSN.
+type recorderRouter struct{}
+
+var recorders sync.Map
+
+func (recorderRouter) Open(name string) (driver.Conn, error) {
+	recorder, _ := recorders.Load(name)
+	return recorder.(*recordingDriver).Open(name)
+}
+
+func testSession(accountUUID string) *model.Session {
+	session := &model.Session{Record: &redifu.Record{Foundation: &item.Foundation{}}}
+	session.SetUUID()
+	session.SetRandId()
+	timeNow := time.Now().UTC()
+	session.SetCreatedAt(timeNow.Add(-2 * time.Hour))
+	session.SetUpdatedAt(timeNow.Add(-2 * time.Hour))
+	session.SetAccountUUID(accountUUID)
+	session.SetLastActiveAt(timeNow)
+	session.ExpiredAt = timeNow.Add(-time.Minute)
+	return session
+}
+
+func newTestSessionRepository(db *sql.DB, entityName string) (*SessionRepository, redis.Pipeliner) {
+	// never dialled, the cache writes are queued on a pipeline that is dropped
+	client := redis.NewClient(&redis.Options{Addr: "127.0.0.1:0"})
+	app := config.DefaultConfig(entityName, "secret", "test", time.Minute)
+	base := redifu.NewBase[*model.Session](client, entityName+":session:%s", time.Minute)
+	return NewSessionRepository(db, client, base, app), client.Pipeline()
+}
+
+func TestSessionUpdatePersistsExpiry(t *testing.T) {
+	db, recorder := openRecorder(t)
+	sessionRepository, pipe := newTestSessionRepository(db, "user")
+	defer pipe.Discard()
+
+	session := testSession("account")
+	session.SetLifeSpan(time.Hour)
+	errUpdate := sessionRepository.Update(context.Background(), pipe, db, session)
+	if errUpdate != nil {
+		t.Fatal(errUpdate)
+	}
+
+	if len(recorder.execs) != 1 {
+		t.Fatalf("got %d statements, want 1", len(recorder.execs))
+	}
+	exec := recorder.execs[0]
+	if !strings.Contains(exec.query, "expired_at = $5") {
+		t.Fatalf("update does not set expired_at: %s", exec.query)
+	}
+	if expiredAt, _ := exec.args[4].(time.Time); !expiredAt.Equal(session.ExpiredAt) {
+		t.Fatalf("expired_at = %v, want %v", exec.args[4], session.ExpiredAt)
+	}
+	if exec.args[5] != session.GetUUID() {
+		t.Fatalf("uuid = %v, want %v", exec.args[5], session.GetUUID())
+	}
+}
+
+// TestRefreshedSessionSurvivesPurge needs a scratch database, for example
+// COMMONUSER_TEST_DATABASE_URL=postgres://localhost/commonuser_test?sslmode=disable.
+func TestRefreshedSessionSurvivesPurge(t *testing.T) {
+	databaseURL := os.Getenv("COMMONUSER_TEST_DATABASE_URL")
+	if databaseURL == "" {
+		t.Skip("COMMONUSER_TEST_DATABASE_URL is not set")
+	}
+	ctx := context.Background()
+
+	db, errOpen := sql.Open("postgres", databaseURL)
+	if errOpen != nil {
+		t.Fatal(errOpen)
+	}
+	defer db.Close()
+
+	suffix := make([]byte, 4)
+	_, _ = rand.Read(suffix)
+	entityName := "sweep_" + hex.EncodeToString(suffix)
+	if _, errMigrate := schema.Migrate(ctx, db, entityName, false); errMigrate != nil {
+		t.Fatal(errMigrate)
+	}
+	t.Cleanup(func() { dropEntity(db, entityName) })
+
+	sessionRepository, pipe := newTestSessionRepository(db, entityName)
+	defer pipe.Discard()
+
+	account := testSession("")
+	_, errInsert := db.ExecContext(ctx, `INSERT INTO `+entityName+` (uuid, randid, password, email) VALUES ($1, $2, '', $3)`,
+		account.GetUUID(), account.GetRandId(), account.GetRandId()+"@example.com")
+	if errInsert != nil {
+		t.Fatal(errInsert)
+	}
+
+	// created with an expiry that has passed, then refreshed
+	session := testSession(account.GetUUID())
+	if errCreate := sessionRepository.Create(ctx, pipe, db, session); errCreate != nil {
+		t.Fatal(errCreate)
+	}
+	session.SetLifeSpan(time.Hour)
+	session.MarkActivity()
+	if errUpdate := sessionRepository.Update(ctx, pipe, db, session); errUpdate != nil {
+		t.Fatal(errUpdate)
+	}
+
+	purged, errPurge := sessionRepository.PurgeExpired(ctx, db, 100)
+	if errPurge != nil {
+		t.Fatal(errPurge)
+	}
+	if purged != 0 {
+		t.Fatalf("purged %d sessions, want the refreshed one kept", purged)
+	}
+
+	active, errFind := sessionRepository.FindActiveByAccount(ctx, account.GetUUID(), 10, 0)
+	if errFind != nil {
+		t.Fatal(errFind)
+	}
+	if len(active) != 1 || active[0].GetUUID() != session.GetUUID() {
+		t.Fatalf("active sessions = %d, want the refreshed one", len(active))
+	}
+}
+
+func dropEntity(db *sql.DB, entityName string) {
+	rows, errQuery := db.Query(`SELECT tablename FROM pg_tables WHERE schemaname = current_schema() AND (tablename = $1 OR tablename LIKE $1 || '\_%')`, entityName)
+	if errQuery != nil {
+		return
+	}
+	var tables []string
+	for rows.Next() {
+		var table string
+		if rows.Scan(&table) == nil {
+			tables = append(tables, table)
+		}
+	}
+	rows.Close()
+	if len(tables) > 0 {
+		_, _ = db.Exec(`DROP TABLE IF EXISTS ` + strings.Join(tables, ", ") + ` CASCADE`)
+	}
+}
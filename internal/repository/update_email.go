@@ -95,11 +95,21 @@ func (em *UpdateEmailRepository) DeleteAllRequest(ctx context.Context, db types.
 	return nil
 }
 
+// PurgeExpired deletes up to batchSize email change tickets whose revert
+// window has passed and returns how many rows were deleted.
+func (em *UpdateEmailRepository) PurgeExpired(ctx context.Context, db types.SQLExecutor, batchSize int) (int, error) {
+	tableName := em.app.EntityName + "_update_email"
+	query := `DELETE FROM ` + tableName + ` WHERE uuid IN (
+			  SELECT uuid FROM ` + tableName + ` WHERE expired_at < NOW() LIMIT $1 FOR UPDATE SKIP LOCKED)`
+	return execCount(ctx, db, query, batchSize)
+}
+
 func NewUpdateEmailManager(readDB *sql.DB, app *config.App) *UpdateEmailRepository {
 	tableName := app.EntityName + "_update_email"
 
 	// always find the most recent ticket
-	findByAccountStmt, errPrepare := readDB.Prepare(`SELECT * FROM ` + tableName + ` WHERE account_uuid = $1 ORDER BY created_at DESC LIMIT 1`)
+	findByAccountStmt, errPrepare := readDB.Prepare(`SELECT uuid, randid, created_at, updated_at, account_uuid, previous_email_address, new_email_address, 
+       reset_token, revoke_token, processed, expired_at FROM ` + tableName + ` WHERE account_uuid = $1 ORDER BY created_at DESC LIMIT 1`)
 	if errPrepare != nil {
 		panic(errPrepare)
 	}
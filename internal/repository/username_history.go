@@ -0,0 +1,139 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"github.com/21strive/commonuser/config"
+	"github.com/21strive/commonuser/internal/model"
+	"github.com/21strive/commonuser/internal/types"
+	"time"
+)
+
+type UsernameHistoryRepository struct {
+	app          *config.App
+	findHeldStmt *sql.Stmt
+}
+
+func (r *UsernameHistoryRepository) Close() {
+	r.findHeldStmt.Close()
+}
+
+func (r *UsernameHistoryRepository) Record(ctx context.Context, db types.SQLExecutor, change *model.UsernameChange) error {
+	tableName := r.app.EntityName + "_username_history"
+	query := "INSERT INTO " + tableName + " (account_uuid, username, username_canonical, username_skeleton, changed_at, held_until) VALUES ($1, $2, $3, $4, $5, $6)"
+	_, errExec := db.ExecContext(ctx,
+		query,
+		change.AccountUUID,
+		change.Username,
+		change.UsernameCanonical,
+		change.UsernameSkeleton,
+		change.ChangedAt,
+		change.HeldUntil)
+	return errExec
+}
+
+// LastChangedAt returns when the account last gave up a username, or the
+// zero time when it never did.
+func (r *UsernameHistoryRepository) LastChangedAt(ctx context.Context, db types.SQLExecutor, accountUUID string) (time.Time, error) {
+	tableName := r.app.EntityName + "_username_history"
+	var changedAt sql.NullTime
+	errScan := db.QueryRowContext(ctx,
+		"SELECT MAX(changed_at) FROM "+tableName+" WHERE account_uuid = $1",
+		accountUUID).Scan(&changedAt)
+	if errScan != nil {
+		return time.Time{}, errScan
+	}
+	return changedAt.Time, nil
+}
+
+// FindByAccount lists the usernames the account gave up, latest first.
+func (r *UsernameHistoryRepository) FindByAccount(ctx context.Context, db types.SQLExecutor, accountUUID string) ([]*model.UsernameChange, error) {
+	tableName := r.app.EntityName + "_username_history"
+	rows, errQuery := db.QueryContext(ctx,
+		"SELECT account_uuid, username, username_canonical, username_skeleton, changed_at, held_until FROM "+tableName+
+			" WHERE account_uuid = $1 ORDER BY changed_at DESC, id DESC",
+		accountUUID)
+	if errQuery != nil {
+		return nil, errQuery
+	}
+	defer rows.Close()
+
+	var changes []*model.UsernameChange
+	for rows.Next() {
+		change := &model.UsernameChange{}
+		errScan := rows.Scan(
+			&change.AccountUUID,
+			&change.Username,
+			&change.UsernameCanonical,
+			&change.UsernameSkeleton,
+			&change.ChangedAt,
+			&change.HeldUntil)
+		if errScan != nil {
+			return nil, errScan
+		}
+		changes = append(changes, change)
+	}
+
+	return changes, rows.Err()
+}
+
+// FindHeld returns the latest hold on the canonical username, or nil when no
+// account holds it.
+func (r *UsernameHistoryRepository) FindHeld(ctx context.Context, canonical string) (*model.UsernameChange, error) {
+	change := &model.UsernameChange{}
+	errScan := r.findHeldStmt.QueryRowContext(ctx, canonical).Scan(
+		&change.AccountUUID,
+		&change.Username,
+		&change.UsernameCanonical,
+		&change.UsernameSkeleton,
+		&change.ChangedAt,
+		&change.HeldUntil)
+	if errScan != nil {
+		if errScan == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, errScan
+	}
+	return change, nil
+}
+
+// HeldConflict returns UsernameHeld when another account holds the username
+// or one that looks like it.
+func (r *UsernameHistoryRepository) HeldConflict(ctx context.Context, db types.SQLExecutor, account *model.Account) error {
+	tableName := r.app.EntityName + "_username_history"
+	query := "SELECT 1 FROM " + tableName +
+		" WHERE (username_canonical = $1 OR username_skeleton = $2) AND account_uuid <> $3 AND held_until > NOW() LIMIT 1"
+	var held int
+	errScan := db.QueryRowContext(ctx, query, account.UsernameCanonical, account.UsernameSkeleton, account.GetUUID()).Scan(&held)
+	if errScan != nil {
+		if errScan == sql.ErrNoRows {
+			return nil
+		}
+		return errScan
+	}
+	return model.UsernameHeld
+}
+
+// Release ends the holds other accounts have on the username and its
+// lookalikes.
+func (r *UsernameHistoryRepository) Release(ctx context.Context, db types.SQLExecutor, account *model.Account) error {
+	tableName := r.app.EntityName + "_username_history"
+	_, errExec := db.ExecContext(ctx,
+		"UPDATE "+tableName+" SET held_until = NOW() WHERE (username_canonical = $1 OR username_skeleton = $2) AND account_uuid <> $3 AND held_until > NOW()",
+		account.UsernameCanonical, account.UsernameSkeleton, account.GetUUID())
+	return errExec
+}
+
+func NewUsernameHistoryRepository(readDB *sql.DB, app *config.App) *UsernameHistoryRepository {
+	tableName := app.EntityName + "_username_history"
+	findHeldStmt, errPrepare := readDB.Prepare("SELECT account_uuid, username, username_canonical, username_skeleton, changed_at, held_until FROM " + tableName +
+		" WHERE username_canonical = $1 AND held_until > NOW() ORDER BY changed_at DESC, id DESC LIMIT 1")
+	if errPrepare != nil {
+		panic(errPrepare)
+	}
+
+	return &UsernameHistoryRepository{
+		app:          app,
+		findHeldStmt: findHeldStmt,
+	}
+}
@@ -6,8 +6,12 @@ import (
 	"github.com/21strive/commonuser/config"
 	"github.com/21strive/commonuser/internal/model"
 	"github.com/21strive/commonuser/internal/types"
+	"strconv"
+	"time"
 )
 
+const reserveLockTimeout = 5 * time.Second
+
 type VerificationRepository struct {
 	app               *config.App
 	findByAccountStmt *sql.Stmt
@@ -19,7 +23,7 @@ func (r *VerificationRepository) Close() {
 
 func (r *VerificationRepository) Create(ctx context.Context, db types.SQLExecutor, verification *model.Verification) error {
 	tableName := r.app.EntityName + "_verification"
-	query := "INSERT INTO " + tableName + " VALUES ($1, $2, $3, $4, $5, $6)"
+	query := "INSERT INTO " + tableName + " (uuid, randid, created_at, updated_at, account_uuid, purpose, code, expires_at, attempts) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)"
 	_, errExec := db.ExecContext(ctx,
 		query,
 		verification.GetUUID(),
@@ -27,7 +31,10 @@ func (r *VerificationRepository) Create(ctx context.Context, db types.SQLExecuto
 		verification.GetCreatedAt(),
 		verification.GetUpdatedAt(),
 		verification.AccountUUID,
-		verification.Code)
+		verification.Purpose,
+		verification.Code,
+		verification.ExpiresAt,
+		verification.Attempts)
 	if errExec != nil {
 		return errExec
 	}
@@ -37,10 +44,13 @@ func (r *VerificationRepository) Create(ctx context.Context, db types.SQLExecuto
 
 func (r *VerificationRepository) Update(ctx context.Context, db types.SQLExecutor, verification *model.Verification) error {
 	tableName := r.app.EntityName + "_verification"
-	query := "UPDATE " + tableName + " SET verification_hash = $1 WHERE uuid = $2"
+	query := "UPDATE " + tableName + " SET updated_at = $1, code = $2, expires_at = $3, attempts = $4 WHERE uuid = $5"
 	_, errExec := db.ExecContext(ctx,
 		query,
+		verification.GetUpdatedAt(),
 		verification.Code,
+		verification.ExpiresAt,
+		verification.Attempts,
 		verification.GetUUID(),
 	)
 	if errExec != nil {
@@ -50,6 +60,51 @@ func (r *VerificationRepository) Update(ctx context.Context, db types.SQLExecuto
 	return nil
 }
 
+// ReserveAttempt counts a guess before the code is compared, so concurrent
+// guesses cannot share one attempt, and stores the new count on
+// verification. It fails with VerificationAttemptsExceeded once maxAttempts
+// guesses were made; zero maxAttempts means unlimited. Run it on its own
+// connection rather than a transaction that may roll back, or a wrong guess
+// would not count. On a *sql.DB it waits at most reserveLockTimeout for the
+// row, so a transaction of the caller that holds it fails the guess instead
+// of blocking it for good.
+func (r *VerificationRepository) ReserveAttempt(ctx context.Context, db types.SQLExecutor, verification *model.Verification, maxAttempts int) error {
+	sqlDB, ok := db.(*sql.DB)
+	if !ok {
+		return r.reserveAttempt(ctx, db, verification, maxAttempts)
+	}
+
+	tx, errBegin := sqlDB.BeginTx(ctx, nil)
+	if errBegin != nil {
+		return errBegin
+	}
+	defer tx.Rollback()
+
+	_, errTimeout := tx.ExecContext(ctx, "SET LOCAL lock_timeout = '"+strconv.FormatInt(reserveLockTimeout.Milliseconds(), 10)+"ms'")
+	if errTimeout != nil {
+		return errTimeout
+	}
+	errReserve := r.reserveAttempt(ctx, tx, verification, maxAttempts)
+	if errReserve != nil {
+		return errReserve
+	}
+	return tx.Commit()
+}
+
+func (r *VerificationRepository) reserveAttempt(ctx context.Context, db types.SQLExecutor, verification *model.Verification, maxAttempts int) error {
+	tableName := r.app.EntityName + "_verification"
+	query := "UPDATE " + tableName + " SET attempts = attempts + 1 WHERE uuid = $1 AND ($2::int <= 0 OR attempts < $2::int) RETURNING attempts"
+	errScan := db.QueryRowContext(ctx, query, verification.GetUUID(), maxAttempts).Scan(&verification.Attempts)
+	if errScan != nil {
+		if errScan == sql.ErrNoRows {
+			return model.VerificationAttemptsExceeded
+		}
+		return errScan
+	}
+
+	return nil
+}
+
 func (r *VerificationRepository) Delete(ctx context.Context, db types.SQLExecutor, verification *model.Verification) error {
 	tableName := r.app.EntityName + "_verification"
 	query := "DELETE FROM " + tableName + " WHERE uuid = $1"
@@ -61,8 +116,22 @@ func (r *VerificationRepository) Delete(ctx context.Context, db types.SQLExecuto
 	return nil
 }
 
-func (r *VerificationRepository) FindByAccount(account *model.Account) (*model.Verification, error) {
-	return VerificationRowScanner(r.findByAccountStmt.QueryRow(account.GetUUID()))
+func (r *VerificationRepository) FindByAccount(account *model.Account, purpose model.Purpose) (*model.Verification, error) {
+	return VerificationRowScanner(r.findByAccountStmt.QueryRow(account.GetUUID(), purpose))
+}
+
+// PurgeStale deletes up to batchSize verification codes that have expired or
+// verify an address the account has already verified, and returns how many
+// rows were deleted.
+func (r *VerificationRepository) PurgeStale(ctx context.Context, db types.SQLExecutor, batchSize int) (int, error) {
+	tableName := r.app.EntityName + "_verification"
+	query := `DELETE FROM ` + tableName + ` WHERE uuid IN (
+			  SELECT v.uuid FROM ` + tableName + ` v JOIN ` + r.app.EntityName + ` a ON a.uuid = v.account_uuid 
+			  WHERE v.expires_at < NOW()
+			  OR (v.purpose = 'email' AND a.email_verified = true)
+			  OR (v.purpose = 'phone' AND a.phone_verified = true)
+			  LIMIT $1 FOR UPDATE OF v SKIP LOCKED)`
+	return execCount(ctx, db, query, batchSize)
 }
 
 func VerificationRowScanner(row *sql.Row) (*model.Verification, error) {
@@ -73,7 +142,10 @@ func VerificationRowScanner(row *sql.Row) (*model.Verification, error) {
 		&verification.CreatedAt,
 		&verification.UpdatedAt,
 		&verification.AccountUUID,
+		&verification.Purpose,
 		&verification.Code,
+		&verification.ExpiresAt,
+		&verification.Attempts,
 	)
 	if err != nil {
 		if err == sql.ErrNoRows {
@@ -88,7 +160,7 @@ func VerificationRowScanner(row *sql.Row) (*model.Verification, error) {
 
 func NewVerificationRepository(readDB *sql.DB, app *config.App) *VerificationRepository {
 	tableName := app.EntityName + "_verification"
-	findByAccountStmt, errPrepare := readDB.Prepare("SELECT * FROM " + tableName + " WHERE account_uuid = $1")
+	findByAccountStmt, errPrepare := readDB.Prepare("SELECT uuid, randid, created_at, updated_at, account_uuid, purpose, code, expires_at, attempts FROM " + tableName + " WHERE account_uuid = $1 AND purpose = $2")
 	if errPrepare != nil {
 		panic(errPrepare)
 	}
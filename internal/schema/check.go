@@ -0,0 +1,199 @@
+package schema
+
+import (
+	"context"
+	"fmt"
+	"github.com/21strive/commonuser/internal/types"
+	"strings"
+)
+
+type IssueKind string
+
+const (
+	MissingTable  IssueKind = "missing_table"
+	MissingColumn IssueKind = "missing_column"
+	ExtraColumn   IssueKind = "extra_column"
+	TypeMismatch  IssueKind = "type_mismatch"
+	MissingIndex  IssueKind = "missing_index"
+)
+
+type Issue struct {
+	Kind     IssueKind `json:"kind"`
+	Table    string    `json:"table"`
+	Column   string    `json:"column,omitempty"`
+	Expected string    `json:"expected,omitempty"`
+	Actual   string    `json:"actual,omitempty"`
+}
+
+func (i Issue) String() string {
+	switch i.Kind {
+	case MissingTable:
+		return fmt.Sprintf("%s: table does not exist", i.Table)
+	case MissingColumn:
+		return fmt.Sprintf("%s.%s: column is missing (expected %s)", i.Table, i.Column, i.Expected)
+	case ExtraColumn:
+		return fmt.Sprintf("%s.%s: column is not used by the repositories (%s)", i.Table, i.Column, i.Actual)
+	case TypeMismatch:
+		return fmt.Sprintf("%s.%s: type is %s, expected %s", i.Table, i.Column, i.Actual, i.Expected)
+	case MissingIndex:
+		return fmt.Sprintf("%s(%s): index is missing", i.Table, i.Expected)
+	}
+	return fmt.Sprintf("%s: %s", i.Table, i.Kind)
+}
+
+type Report struct {
+	EntityName string  `json:"entityName"`
+	Issues     []Issue `json:"issues"`
+}
+
+// OK reports whether the database matches the repositories. Extra columns are
+// tolerated since they do not break any query.
+func (r *Report) OK() bool {
+	for _, issue := range r.Issues {
+		if issue.Kind != ExtraColumn {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *Report) String() string {
+	if len(r.Issues) == 0 {
+		return "schema is up to date"
+	}
+	lines := make([]string, 0, len(r.Issues))
+	for _, issue := range r.Issues {
+		lines = append(lines, issue.String())
+	}
+	return strings.Join(lines, "\n")
+}
+
+type liveIndex struct {
+	columns string
+	unique  bool
+}
+
+// Check compares the live database against Expected using information_schema
+// and the pg_index catalog of the current schema.
+func Check(ctx context.Context, db types.SQLExecutor, entityName string) (*Report, error) {
+	report := &Report{EntityName: entityName}
+
+	for _, table := range Expected(entityName) {
+		columns, errColumns := liveColumns(ctx, db, table.Name)
+		if errColumns != nil {
+			return nil, errColumns
+		}
+		if len(columns) == 0 {
+			report.Issues = append(report.Issues, Issue{Kind: MissingTable, Table: table.Name})
+			continue
+		}
+
+		for _, expected := range table.Columns {
+			actual, found := columns[expected.Name]
+			if !found {
+				report.Issues = append(report.Issues, Issue{
+					Kind:     MissingColumn,
+					Table:    table.Name,
+					Column:   expected.Name,
+					Expected: expected.Type,
+				})
+				continue
+			}
+			if actual != expected.Type {
+				report.Issues = append(report.Issues, Issue{
+					Kind:     TypeMismatch,
+					Table:    table.Name,
+					Column:   expected.Name,
+					Expected: expected.Type,
+					Actual:   actual,
+				})
+			}
+		}
+		for name, actual := range columns {
+			if _, used := table.column(name); !used {
+				report.Issues = append(report.Issues, Issue{
+					Kind:   ExtraColumn,
+					Table:  table.Name,
+					Column: name,
+					Actual: actual,
+				})
+			}
+		}
+
+		indexes, errIndexes := liveIndexes(ctx, db, table.Name)
+		if errIndexes != nil {
+			return nil, errIndexes
+		}
+		for _, expected := range table.Indexes {
+			if !hasIndex(indexes, expected) {
+				report.Issues = append(report.Issues, Issue{
+					Kind:     MissingIndex,
+					Table:    table.Name,
+					Expected: strings.Join(expected.Columns, ", "),
+				})
+			}
+		}
+	}
+
+	return report, nil
+}
+
+func hasIndex(indexes []liveIndex, expected Index) bool {
+	columns := strings.Join(expected.Columns, ",")
+	for _, index := range indexes {
+		if index.columns != columns {
+			continue
+		}
+		if expected.Unique && !index.unique {
+			continue
+		}
+		return true
+	}
+	return false
+}
+
+func liveColumns(ctx context.Context, db types.SQLExecutor, tableName string) (map[string]string, error) {
+	rows, errQuery := db.QueryContext(ctx, `SELECT column_name, udt_name FROM information_schema.columns
+		WHERE table_schema = current_schema() AND table_name = $1`, tableName)
+	if errQuery != nil {
+		return nil, errQuery
+	}
+	defer rows.Close()
+
+	columns := make(map[string]string)
+	for rows.Next() {
+		var name, udtName string
+		if errScan := rows.Scan(&name, &udtName); errScan != nil {
+			return nil, errScan
+		}
+		columns[name] = udtName
+	}
+
+	return columns, rows.Err()
+}
+
+func liveIndexes(ctx context.Context, db types.SQLExecutor, tableName string) ([]liveIndex, error) {
+	rows, errQuery := db.QueryContext(ctx, `SELECT ix.indisunique, string_agg(a.attname, ',' ORDER BY k.n)
+		FROM pg_index ix
+		JOIN pg_class t ON t.oid = ix.indrelid
+		JOIN pg_namespace ns ON ns.oid = t.relnamespace
+		CROSS JOIN LATERAL unnest(ix.indkey) WITH ORDINALITY AS k(attnum, n)
+		JOIN pg_attribute a ON a.attrelid = t.oid AND a.attnum = k.attnum
+		WHERE ns.nspname = current_schema() AND t.relname = $1
+		GROUP BY ix.indexrelid, ix.indisunique`, tableName)
+	if errQuery != nil {
+		return nil, errQuery
+	}
+	defer rows.Close()
+
+	var indexes []liveIndex
+	for rows.Next() {
+		var index liveIndex
+		if errScan := rows.Scan(&index.unique, &index.columns); errScan != nil {
+			return nil, errScan
+		}
+		indexes = append(indexes, index)
+	}
+
+	return indexes, rows.Err()
+}
@@ -0,0 +1,171 @@
+package schema
+
+func CreateResetPasswordTableSQL(entityName string) string {
+	tableName := entityName + "_reset_password"
+	query := `CREATE TABLE IF NOT EXISTS ` + tableName + ` (
+		uuid VARCHAR(255) PRIMARY KEY,
+		randid VARCHAR(255) UNIQUE,
+		created_at TIMESTAMP DEFAULT NOW(),
+		updated_at TIMESTAMP DEFAULT NOW(),
+		account_uuid VARCHAR(255) NOT NULL,
+		token VARCHAR(255) UNIQUE NOT NULL,
+		expired_at TIMESTAMP
+    );
+    
+    CREATE INDEX IF NOT EXISTS idx_` + tableName + `_token ON ` + tableName + `(token);
+    CREATE INDEX IF NOT EXISTS idx_` + tableName + `_account_uuid ON ` + tableName + `(account_uuid);`
+
+	return query
+}
+
+func CreateAccountTableSQL(entityName string) string {
+	query := `CREATE TABLE IF NOT EXISTS ` + entityName + ` (
+		uuid VARCHAR(255) PRIMARY KEY,
+		randid VARCHAR(255) UNIQUE,
+		created_at TIMESTAMP DEFAULT NOW(),
+		updated_at TIMESTAMP DEFAULT NOW(),
+		name VARCHAR(255),
+		username VARCHAR(255) UNIQUE,
+		password VARCHAR(255) NOT NULL,
+		email VARCHAR(255) UNIQUE NOT NULL,
+		avatar VARCHAR(255),
+		email_verified BOOLEAN DEFAULT FALSE
+    );
+    CREATE INDEX IF NOT EXISTS idx_` + entityName + `_email ON ` + entityName + `(email);
+	CREATE INDEX IF NOT EXISTS idx_` + entityName + `_randid ON ` + entityName + `(randid);
+	CREATE INDEX IF NOT EXISTS idx_` + entityName + `_uuid ON ` + entityName + `(uuid);
+    CREATE INDEX IF NOT EXISTS idx_` + entityName + `_username ON ` + entityName + `(username);`
+
+	return query
+}
+
+func CreateUpdateEmailTableSQL(entityName string) string {
+	tableName := entityName + "_update_email"
+	query := `CREATE TABLE IF NOT EXISTS ` + tableName + ` (
+		uuid UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+		randid VARCHAR(255) UNIQUE,
+		created_at TIMESTAMP DEFAULT NOW(),
+		updated_at TIMESTAMP DEFAULT NOW(),
+		account_uuid UUID NOT NULL,
+		previous_email_address VARCHAR(255),
+		new_email_address VARCHAR(255) UNIQUE NOT NULL,
+		reset_token VARCHAR(255) NOT NULL,
+		revoke_token VARCHAR(255) NOT NULL,
+		processed BOOLEAN DEFAULT FALSE,
+		expired_at TIMESTAMP
+    );
+    CREATE INDEX IF NOT EXISTS idx_` + tableName + `_account_uuid ON ` + tableName + `(account_uuid);
+    CREATE INDEX IF NOT EXISTS idx_` + tableName + `_new_email_address ON ` + tableName + `(new_email_address);`
+
+	return query
+}
+
+func CreateSessionTableSQL(entityName string) string {
+	tableName := entityName + "_session"
+	query := `CREATE TABLE IF NOT EXISTS ` + tableName + ` (
+       uuid VARCHAR(255) PRIMARY KEY,
+       randid VARCHAR(255) UNIQUE,
+       created_at TIMESTAMP DEFAULT NOW(),
+       updated_at TIMESTAMP DEFAULT NOW(),
+       last_active_at TIMESTAMP DEFAULT NOW(),
+       account_uuid VARCHAR(255) NOT NULL,
+       device_id VARCHAR(255),
+       device_type TEXT,
+       user_agent TEXT,
+       refresh_token VARCHAR(255) UNIQUE NOT NULL,
+       expired_at TIMESTAMP NOT NULL,
+       revoked BOOLEAN DEFAULT TRUE
+    );
+    CREATE INDEX IF NOT EXISTS idx_` + tableName + `_account_uuid ON ` + tableName + `(account_uuid);
+    CREATE INDEX IF NOT EXISTS idx_` + tableName + `_refresh_token ON ` + tableName + `(refresh_token);
+    CREATE INDEX IF NOT EXISTS idx_` + tableName + `_randid ON ` + tableName + `(randid);
+    CREATE INDEX IF NOT EXISTS idx_` + tableName + `_expired_at ON ` + tableName + `(expired_at);`
+
+	return query
+}
+
+func CreateVerificationTableSQL(entityName string) string {
+	tableName := entityName + "_verification"
+	query := `CREATE TABLE IF NOT EXISTS ` + tableName + ` (
+		uuid VARCHAR(255) PRIMARY KEY,
+		randid VARCHAR(255) UNIQUE,
+		created_at TIMESTAMP DEFAULT NOW(),
+		updated_at TIMESTAMP DEFAULT NOW(),
+		account_uuid VARCHAR(255) NOT NULL,
+		code VARCHAR(255) NOT NULL
+    );
+    CREATE INDEX IF NOT EXISTS idx_` + tableName + `_account_uuid ON ` + tableName + `(account_uuid);
+    CREATE INDEX IF NOT EXISTS idx_` + tableName + `_code ON ` + tableName + `(code);`
+
+	return query
+}
+
+func CreateProviderTableSQL(entityName string) string {
+	tableName := entityName + "_provider"
+	query := `CREATE TABLE IF NOT EXISTS ` + tableName + ` (
+		uuid VARCHAR(255) PRIMARY KEY,
+		randid VARCHAR(255) UNIQUE,
+		created_at TIMESTAMP DEFAULT NOW(),
+		updated_at TIMESTAMP DEFAULT NOW(),
+		name VARCHAR(255),
+		email VARCHAR(255),
+		sub VARCHAR(255),
+		issuer VARCHAR(255),
+		account_uuid VARCHAR(255)
+    );
+    CREATE INDEX IF NOT EXISTS idx_` + tableName + `_email ON ` + tableName + `(email);
+    CREATE INDEX IF NOT EXISTS idx_` + tableName + `_sub ON ` + tableName + `(sub);
+    CREATE INDEX IF NOT EXISTS idx_` + tableName + `_issuer ON ` + tableName + `(issuer);
+    CREATE INDEX IF NOT EXISTS idx_` + tableName + `_account_uuid ON ` + tableName + `(account_uuid);`
+
+	return query
+}
+
+func CreateDeviceTableSQL(entityName string) string {
+	tableName := entityName + "_device"
+	query := `CREATE TABLE IF NOT EXISTS ` + tableName + ` (
+		account_uuid UUID NOT NULL REFERENCES ` + entityName + `(uuid) ON DELETE CASCADE,
+		device_id VARCHAR(255) NOT NULL,
+		device_type TEXT NOT NULL DEFAULT '',
+		user_agent TEXT,
+		first_seen_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		last_seen_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		PRIMARY KEY (account_uuid, device_id)
+    );`
+
+	return query
+}
+
+func CreateOutboxTableSQL(entityName string) string {
+	tableName := entityName + "_outbox"
+	query := `CREATE TABLE IF NOT EXISTS ` + tableName + ` (
+		id BIGSERIAL PRIMARY KEY,
+		event_name VARCHAR(255) NOT NULL,
+		payload JSONB NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		attempts INTEGER NOT NULL DEFAULT 0,
+		next_attempt_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		last_error TEXT
+    );
+    CREATE INDEX IF NOT EXISTS idx_` + tableName + `_next_attempt_at ON ` + tableName + `(next_attempt_at);`
+
+	return query
+}
+
+func CreateUsernameHistoryTableSQL(entityName string) string {
+	tableName := entityName + "_username_history"
+	query := `CREATE TABLE IF NOT EXISTS ` + tableName + ` (
+		id BIGSERIAL PRIMARY KEY,
+		account_uuid UUID NOT NULL REFERENCES ` + entityName + `(uuid) ON DELETE CASCADE,
+		username VARCHAR(255) NOT NULL,
+		username_canonical VARCHAR(255) NOT NULL,
+		username_skeleton VARCHAR(255) NOT NULL,
+		changed_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		held_until TIMESTAMPTZ NOT NULL DEFAULT NOW()
+    );
+    CREATE INDEX IF NOT EXISTS idx_` + tableName + `_account_uuid ON ` + tableName + `(account_uuid, changed_at);
+    CREATE INDEX IF NOT EXISTS idx_` + tableName + `_canonical ON ` + tableName + `(username_canonical, held_until);
+    CREATE INDEX IF NOT EXISTS idx_` + tableName + `_skeleton ON ` + tableName + `(username_skeleton, held_until);`
+
+	return query
+}
@@ -0,0 +1,111 @@
+package schema
+
+// hardenTables upgrades tables created by the first migration in place.
+// Every step either succeeds without touching row data or fails and rolls the
+// whole migration back: invalid uuids, emails that only differ by case and
+// orphaned rows are reported, never deleted.
+func hardenTables(entityName string) []string {
+	statements := []string{
+		`CREATE EXTENSION IF NOT EXISTS citext`,
+		`DO $$
+		BEGIN
+			IF EXISTS (SELECT lower(email) FROM ` + entityName + ` GROUP BY lower(email) HAVING COUNT(*) > 1) THEN
+				RAISE EXCEPTION 'table ` + entityName + ` has emails that only differ by case, resolve them before migrating';
+			END IF;
+		END $$`,
+		`ALTER TABLE ` + entityName + `
+			ALTER COLUMN uuid TYPE UUID USING uuid::uuid,
+			ALTER COLUMN created_at TYPE TIMESTAMPTZ USING created_at AT TIME ZONE 'UTC',
+			ALTER COLUMN updated_at TYPE TIMESTAMPTZ USING updated_at AT TIME ZONE 'UTC',
+			ALTER COLUMN email TYPE CITEXT`,
+		// already covered by the primary key and unique constraints
+		`DROP INDEX IF EXISTS idx_` + entityName + `_email`,
+		`DROP INDEX IF EXISTS idx_` + entityName + `_randid`,
+		`DROP INDEX IF EXISTS idx_` + entityName + `_uuid`,
+		`DROP INDEX IF EXISTS idx_` + entityName + `_username`,
+		`ALTER TABLE ` + entityName + `_schema_migrations
+			ALTER COLUMN applied_at TYPE TIMESTAMPTZ USING applied_at AT TIME ZONE 'UTC'`,
+	}
+
+	sessionTable := entityName + "_session"
+	statements = append(statements,
+		`ALTER TABLE `+sessionTable+`
+			ALTER COLUMN uuid TYPE UUID USING uuid::uuid,
+			ALTER COLUMN account_uuid TYPE UUID USING account_uuid::uuid,
+			ALTER COLUMN created_at TYPE TIMESTAMPTZ USING created_at AT TIME ZONE 'UTC',
+			ALTER COLUMN updated_at TYPE TIMESTAMPTZ USING updated_at AT TIME ZONE 'UTC',
+			ALTER COLUMN last_active_at TYPE TIMESTAMPTZ USING last_active_at AT TIME ZONE 'UTC',
+			ALTER COLUMN expired_at TYPE TIMESTAMPTZ USING expired_at AT TIME ZONE 'UTC'`,
+		`DROP INDEX IF EXISTS idx_`+sessionTable+`_refresh_token`,
+		`DROP INDEX IF EXISTS idx_`+sessionTable+`_randid`,
+	)
+	statements = append(statements, accountForeignKeySQL(entityName, sessionTable)...)
+
+	providerTable := entityName + "_provider"
+	statements = append(statements,
+		`ALTER TABLE `+providerTable+`
+			ALTER COLUMN uuid TYPE UUID USING uuid::uuid,
+			ALTER COLUMN account_uuid TYPE UUID USING account_uuid::uuid,
+			ALTER COLUMN created_at TYPE TIMESTAMPTZ USING created_at AT TIME ZONE 'UTC',
+			ALTER COLUMN updated_at TYPE TIMESTAMPTZ USING updated_at AT TIME ZONE 'UTC',
+			ALTER COLUMN email TYPE CITEXT`,
+	)
+	statements = append(statements, accountForeignKeySQL(entityName, providerTable)...)
+
+	verificationTable := entityName + "_verification"
+	statements = append(statements,
+		`ALTER TABLE `+verificationTable+`
+			ALTER COLUMN uuid TYPE UUID USING uuid::uuid,
+			ALTER COLUMN account_uuid TYPE UUID USING account_uuid::uuid,
+			ALTER COLUMN created_at TYPE TIMESTAMPTZ USING created_at AT TIME ZONE 'UTC',
+			ALTER COLUMN updated_at TYPE TIMESTAMPTZ USING updated_at AT TIME ZONE 'UTC'`,
+	)
+	statements = append(statements, accountForeignKeySQL(entityName, verificationTable)...)
+
+	resetPasswordTable := entityName + "_reset_password"
+	statements = append(statements,
+		`ALTER TABLE `+resetPasswordTable+`
+			ALTER COLUMN uuid TYPE UUID USING uuid::uuid,
+			ALTER COLUMN account_uuid TYPE UUID USING account_uuid::uuid,
+			ALTER COLUMN created_at TYPE TIMESTAMPTZ USING created_at AT TIME ZONE 'UTC',
+			ALTER COLUMN updated_at TYPE TIMESTAMPTZ USING updated_at AT TIME ZONE 'UTC',
+			ALTER COLUMN expired_at TYPE TIMESTAMPTZ USING expired_at AT TIME ZONE 'UTC'`,
+		`DROP INDEX IF EXISTS idx_`+resetPasswordTable+`_token`,
+	)
+	statements = append(statements, accountForeignKeySQL(entityName, resetPasswordTable)...)
+
+	updateEmailTable := entityName + "_update_email"
+	statements = append(statements,
+		`ALTER TABLE `+updateEmailTable+`
+			ALTER COLUMN created_at TYPE TIMESTAMPTZ USING created_at AT TIME ZONE 'UTC',
+			ALTER COLUMN updated_at TYPE TIMESTAMPTZ USING updated_at AT TIME ZONE 'UTC',
+			ALTER COLUMN expired_at TYPE TIMESTAMPTZ USING expired_at AT TIME ZONE 'UTC',
+			ALTER COLUMN previous_email_address TYPE CITEXT,
+			ALTER COLUMN new_email_address TYPE CITEXT`,
+		`DROP INDEX IF EXISTS idx_`+updateEmailTable+`_new_email_address`,
+	)
+	statements = append(statements, accountForeignKeySQL(entityName, updateEmailTable)...)
+
+	return statements
+}
+
+// accountForeignKeySQL adds the constraint as NOT VALID so existing orphans do
+// not fail the migration, then validates it only when there are none left.
+// Deployments with orphans keep the constraint enforced for new rows and can
+// run VALIDATE CONSTRAINT themselves once the orphans are dealt with.
+func accountForeignKeySQL(entityName string, tableName string) []string {
+	constraint := tableName + "_account_uuid_fkey"
+	return []string{
+		`ALTER TABLE ` + tableName + ` ADD CONSTRAINT ` + constraint + `
+			FOREIGN KEY (account_uuid) REFERENCES ` + entityName + `(uuid) ON DELETE CASCADE NOT VALID`,
+		`DO $$
+		BEGIN
+			IF NOT EXISTS (
+				SELECT 1 FROM ` + tableName + ` t LEFT JOIN ` + entityName + ` a ON a.uuid = t.account_uuid
+				WHERE t.account_uuid IS NOT NULL AND a.uuid IS NULL
+			) THEN
+				ALTER TABLE ` + tableName + ` VALIDATE CONSTRAINT ` + constraint + `;
+			END IF;
+		END $$`,
+	}
+}
@@ -0,0 +1,279 @@
+package schema
+
+import (
+	"context"
+	"database/sql"
+	"github.com/21strive/commonuser/internal/model"
+	"time"
+)
+
+type Migration struct {
+	Version    int
+	Name       string
+	Statements func(entityName string) []string
+}
+
+type AppliedMigration struct {
+	Version int    `json:"version"`
+	Name    string `json:"name"`
+}
+
+type MigrationResult struct {
+	Applied    []AppliedMigration `json:"applied"`
+	Statements []string           `json:"statements"`
+	DryRun     bool               `json:"dryRun"`
+}
+
+// Migrations are applied in order and recorded in <entity>_schema_migrations.
+// Existing versions must never change; append a new version instead.
+var Migrations = []Migration{
+	{Version: 1, Name: "create tables", Statements: createTables},
+	{Version: 2, Name: "harden tables", Statements: hardenTables},
+	{Version: 3, Name: "add token version", Statements: addTokenVersion},
+	{Version: 4, Name: "create device table", Statements: createDeviceTable},
+	{Version: 5, Name: "create outbox table", Statements: createOutboxTable},
+	{Version: 6, Name: "add verification expiry", Statements: addVerificationExpiry},
+	{Version: 7, Name: "add phone", Statements: addPhone},
+	{Version: 8, Name: "add canonical username", Statements: addCanonicalUsername},
+	{Version: 9, Name: "add canonical email", Statements: addCanonicalEmail},
+	{Version: 10, Name: "create username history table", Statements: createUsernameHistoryTable},
+	{Version: 11, Name: "add account status", Statements: addAccountStatus},
+	{Version: 12, Name: "add account revision", Statements: addAccountRevision},
+	{Version: 13, Name: "add account attributes", Statements: addAccountAttributes},
+	{Version: 14, Name: "index legacy usernames", Statements: indexLegacyUsernames},
+	{Version: 15, Name: "index legacy emails", Statements: indexLegacyEmails},
+}
+
+func createTables(entityName string) []string {
+	return []string{
+		CreateAccountTableSQL(entityName),
+		CreateResetPasswordTableSQL(entityName),
+		CreateUpdateEmailTableSQL(entityName),
+		CreateSessionTableSQL(entityName),
+		CreateVerificationTableSQL(entityName),
+		CreateProviderTableSQL(entityName),
+	}
+}
+
+func addTokenVersion(entityName string) []string {
+	return []string{
+		`ALTER TABLE ` + entityName + ` ADD COLUMN IF NOT EXISTS token_version BIGINT NOT NULL DEFAULT 0`,
+	}
+}
+
+func createDeviceTable(entityName string) []string {
+	return []string{CreateDeviceTableSQL(entityName)}
+}
+
+func createOutboxTable(entityName string) []string {
+	return []string{CreateOutboxTableSQL(entityName)}
+}
+
+// existing codes are short and unbounded, so they expire on the spot
+// outstanding codes keep the default 15 minute TTL from when they were last
+// sent rather than expiring at deploy; timestamps are stored as UTC
+func addVerificationExpiry(entityName string) []string {
+	tableName := entityName + `_verification`
+	return []string{
+		`ALTER TABLE ` + tableName + `
+			ADD COLUMN IF NOT EXISTS expires_at TIMESTAMPTZ,
+			ADD COLUMN IF NOT EXISTS attempts INTEGER NOT NULL DEFAULT 0`,
+		`UPDATE ` + tableName + ` SET expires_at = (COALESCE(updated_at, created_at, NOW() AT TIME ZONE 'UTC') AT TIME ZONE 'UTC') + INTERVAL '15 minutes' WHERE expires_at IS NULL`,
+		`ALTER TABLE ` + tableName + `
+			ALTER COLUMN expires_at SET DEFAULT NOW(),
+			ALTER COLUMN expires_at SET NOT NULL`,
+	}
+}
+
+// phone-only accounts have no email, so email becomes nullable; empty strings
+// are stored as NULL to keep both unique constraints usable
+func addPhone(entityName string) []string {
+	return []string{
+		`ALTER TABLE ` + entityName + `
+			ADD COLUMN IF NOT EXISTS phone VARCHAR(16),
+			ADD COLUMN IF NOT EXISTS phone_verified BOOLEAN NOT NULL DEFAULT FALSE,
+			ALTER COLUMN email DROP NOT NULL`,
+		`UPDATE ` + entityName + ` SET email = NULL WHERE email = ''`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS idx_` + entityName + `_phone ON ` + entityName + `(phone)`,
+		`ALTER TABLE ` + entityName + `_verification
+			ADD COLUMN IF NOT EXISTS purpose VARCHAR(32) NOT NULL DEFAULT 'email'`,
+		`CREATE INDEX IF NOT EXISTS idx_` + entityName + `_verification_account_purpose
+			ON ` + entityName + `_verification(account_uuid, purpose)`,
+	}
+}
+
+// canonical forms are computed in Go, existing rows keep NULL until the
+// backfill-usernames admin command fills them in
+func addCanonicalUsername(entityName string) []string {
+	return []string{
+		`UPDATE ` + entityName + ` SET username = NULL WHERE username = ''`,
+		`ALTER TABLE ` + entityName + `
+			ADD COLUMN IF NOT EXISTS username_canonical VARCHAR(255),
+			ADD COLUMN IF NOT EXISTS username_skeleton VARCHAR(255)`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS idx_` + entityName + `_username_canonical ON ` + entityName + `(username_canonical)`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS idx_` + entityName + `_username_skeleton ON ` + entityName + `(username_skeleton)`,
+	}
+}
+
+// existing rows keep NULL until the backfill-emails admin command fills them in
+func addCanonicalEmail(entityName string) []string {
+	return []string{
+		`ALTER TABLE ` + entityName + ` ADD COLUMN IF NOT EXISTS email_canonical VARCHAR(255)`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS idx_` + entityName + `_email_canonical ON ` + entityName + `(email_canonical)`,
+	}
+}
+
+func createUsernameHistoryTable(entityName string) []string {
+	return []string{CreateUsernameHistoryTableSQL(entityName)}
+}
+
+// the created_at index backs the keyset pagination of AccountOps.List
+func addAccountStatus(entityName string) []string {
+	return []string{
+		`ALTER TABLE ` + entityName + ` ADD COLUMN IF NOT EXISTS status VARCHAR(32) NOT NULL DEFAULT 'active'`,
+		`CREATE INDEX IF NOT EXISTS idx_` + entityName + `_status ON ` + entityName + `(status)`,
+		`CREATE INDEX IF NOT EXISTS idx_` + entityName + `_created_at_uuid ON ` + entityName + `(created_at, uuid)`,
+	}
+}
+
+func addAccountRevision(entityName string) []string {
+	return []string{
+		`ALTER TABLE ` + entityName + ` ADD COLUMN IF NOT EXISTS revision BIGINT NOT NULL DEFAULT 0`,
+	}
+}
+
+func addAccountAttributes(entityName string) []string {
+	return []string{
+		`ALTER TABLE ` + entityName + ` ADD COLUMN IF NOT EXISTS attributes JSONB NOT NULL DEFAULT '{}'`,
+	}
+}
+
+// backs the lower(username) lookups of rows the backfill-usernames admin
+// command has not reached yet
+func indexLegacyUsernames(entityName string) []string {
+	return []string{
+		`CREATE INDEX IF NOT EXISTS idx_` + entityName + `_username_lower ON ` + entityName + `(lower(username)) WHERE username_canonical IS NULL`,
+	}
+}
+
+// backs the provider rule lookups of rows the backfill-emails admin command
+// has not reached yet; without provider rules they use the unique email index
+func indexLegacyEmails(entityName string) []string {
+	return []string{
+		`CREATE INDEX IF NOT EXISTS idx_` + entityName + `_email_legacy ON ` + entityName + `((` + model.ProviderCanonicalEmailSQL("email") + `)) WHERE email_canonical IS NULL`,
+	}
+}
+
+func migrationTableSQL(entityName string) string {
+	return `CREATE TABLE IF NOT EXISTS ` + entityName + `_schema_migrations (
+		version INTEGER PRIMARY KEY,
+		name VARCHAR(255) NOT NULL,
+		applied_at TIMESTAMP DEFAULT NOW()
+    );`
+}
+
+// Migrate applies every pending migration in a single transaction. A
+// transaction-scoped advisory lock keyed by the entity name serialises
+// concurrent replicas; the ones that wait find nothing left to apply. With
+// dryRun set, nothing is executed and the pending SQL is returned instead.
+func Migrate(ctx context.Context, db *sql.DB, entityName string, dryRun bool) (*MigrationResult, error) {
+	tx, errBegin := db.BeginTx(ctx, nil)
+	if errBegin != nil {
+		return nil, errBegin
+	}
+	defer tx.Rollback()
+
+	_, errLock := tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock(hashtext($1))", "commonuser:migrate:"+entityName)
+	if errLock != nil {
+		return nil, errLock
+	}
+
+	applied, errApplied := appliedVersions(ctx, tx, entityName)
+	if errApplied != nil {
+		return nil, errApplied
+	}
+
+	result := &MigrationResult{DryRun: dryRun}
+	if len(applied) == 0 {
+		result.Statements = append(result.Statements, migrationTableSQL(entityName))
+	}
+	for _, migration := range Migrations {
+		if applied[migration.Version] {
+			continue
+		}
+		result.Applied = append(result.Applied, AppliedMigration{Version: migration.Version, Name: migration.Name})
+		result.Statements = append(result.Statements, migration.Statements(entityName)...)
+	}
+	if dryRun || len(result.Applied) == 0 {
+		return result, nil
+	}
+
+	if len(applied) == 0 {
+		if _, errExec := tx.ExecContext(ctx, migrationTableSQL(entityName)); errExec != nil {
+			return nil, errExec
+		}
+	}
+	insertVersion := "INSERT INTO " + entityName + "_schema_migrations (version, name, applied_at) VALUES ($1, $2, $3)"
+	for _, migration := range Migrations {
+		if applied[migration.Version] {
+			continue
+		}
+		for _, statement := range migration.Statements(entityName) {
+			if _, errExec := tx.ExecContext(ctx, statement); errExec != nil {
+				return nil, &MigrationError{Version: migration.Version, Name: migration.Name, Err: errExec}
+			}
+		}
+		if _, errExec := tx.ExecContext(ctx, insertVersion, migration.Version, migration.Name, time.Now().UTC()); errExec != nil {
+			return nil, errExec
+		}
+	}
+
+	if errCommit := tx.Commit(); errCommit != nil {
+		return nil, errCommit
+	}
+
+	return result, nil
+}
+
+func appliedVersions(ctx context.Context, tx *sql.Tx, entityName string) (map[int]bool, error) {
+	var exists bool
+	errCheck := tx.QueryRowContext(ctx, "SELECT to_regclass($1) IS NOT NULL", entityName+"_schema_migrations").Scan(&exists)
+	if errCheck != nil {
+		return nil, errCheck
+	}
+
+	applied := make(map[int]bool)
+	if !exists {
+		return applied, nil
+	}
+
+	rows, errQuery := tx.QueryContext(ctx, "SELECT version FROM "+entityName+"_schema_migrations")
+	if errQuery != nil {
+		return nil, errQuery
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var version int
+		if errScan := rows.Scan(&version); errScan != nil {
+			return nil, errScan
+		}
+		applied[version] = true
+	}
+
+	return applied, rows.Err()
+}
+
+type MigrationError struct {
+	Version int
+	Name    string
+	Err     error
+}
+
+func (e *MigrationError) Error() string {
+	return "migration " + e.Name + " failed: " + e.Err.Error()
+}
+
+func (e *MigrationError) Unwrap() error {
+	return e.Err
+}
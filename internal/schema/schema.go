@@ -0,0 +1,217 @@
+package schema
+
+type Column struct {
+	Name string
+	Type string
+}
+
+type Index struct {
+	Columns []string
+	Unique  bool
+}
+
+type Table struct {
+	Name    string
+	Columns []Column
+	Indexes []Index
+}
+
+func (t Table) column(name string) (Column, bool) {
+	for _, c := range t.Columns {
+		if c.Name == name {
+			return c, true
+		}
+	}
+	return Column{}, false
+}
+
+// Expected describes the tables and columns the repositories read and write
+// for the given entity. Types are Postgres udt names as reported by
+// information_schema.columns.
+func Expected(entityName string) []Table {
+	return []Table{
+		{
+			Name: entityName,
+			Columns: []Column{
+				{"uuid", "uuid"},
+				{"randid", "varchar"},
+				{"created_at", "timestamptz"},
+				{"updated_at", "timestamptz"},
+				{"name", "varchar"},
+				{"username", "varchar"},
+				{"password", "varchar"},
+				{"email", "citext"},
+				{"avatar", "varchar"},
+				{"email_verified", "bool"},
+				{"token_version", "int8"},
+				{"phone", "varchar"},
+				{"phone_verified", "bool"},
+				{"username_canonical", "varchar"},
+				{"username_skeleton", "varchar"},
+				{"email_canonical", "varchar"},
+				{"status", "varchar"},
+				{"revision", "int8"},
+				{"attributes", "jsonb"},
+			},
+			Indexes: []Index{
+				{Columns: []string{"uuid"}, Unique: true},
+				{Columns: []string{"randid"}, Unique: true},
+				{Columns: []string{"username"}, Unique: true},
+				{Columns: []string{"email"}, Unique: true},
+				{Columns: []string{"phone"}, Unique: true},
+				{Columns: []string{"username_canonical"}, Unique: true},
+				{Columns: []string{"username_skeleton"}, Unique: true},
+				{Columns: []string{"email_canonical"}, Unique: true},
+				{Columns: []string{"status"}},
+				{Columns: []string{"created_at", "uuid"}},
+			},
+		},
+		{
+			Name: entityName + "_session",
+			Columns: []Column{
+				{"uuid", "uuid"},
+				{"randid", "varchar"},
+				{"created_at", "timestamptz"},
+				{"updated_at", "timestamptz"},
+				{"last_active_at", "timestamptz"},
+				{"account_uuid", "uuid"},
+				{"device_id", "varchar"},
+				{"device_type", "text"},
+				{"user_agent", "text"},
+				{"refresh_token", "varchar"},
+				{"expired_at", "timestamptz"},
+				{"revoked", "bool"},
+			},
+			Indexes: []Index{
+				{Columns: []string{"uuid"}, Unique: true},
+				{Columns: []string{"randid"}, Unique: true},
+				{Columns: []string{"refresh_token"}, Unique: true},
+				{Columns: []string{"account_uuid"}},
+				{Columns: []string{"expired_at"}},
+			},
+		},
+		{
+			Name: entityName + "_provider",
+			Columns: []Column{
+				{"uuid", "uuid"},
+				{"randid", "varchar"},
+				{"created_at", "timestamptz"},
+				{"updated_at", "timestamptz"},
+				{"name", "varchar"},
+				{"email", "citext"},
+				{"sub", "varchar"},
+				{"issuer", "varchar"},
+				{"account_uuid", "uuid"},
+			},
+			Indexes: []Index{
+				{Columns: []string{"uuid"}, Unique: true},
+				{Columns: []string{"sub"}},
+				{Columns: []string{"account_uuid"}},
+			},
+		},
+		{
+			Name: entityName + "_verification",
+			Columns: []Column{
+				{"uuid", "uuid"},
+				{"randid", "varchar"},
+				{"created_at", "timestamptz"},
+				{"updated_at", "timestamptz"},
+				{"account_uuid", "uuid"},
+				{"code", "varchar"},
+				{"expires_at", "timestamptz"},
+				{"attempts", "int4"},
+				{"purpose", "varchar"},
+			},
+			Indexes: []Index{
+				{Columns: []string{"uuid"}, Unique: true},
+				{Columns: []string{"account_uuid"}},
+				{Columns: []string{"account_uuid", "purpose"}},
+			},
+		},
+		{
+			Name: entityName + "_reset_password",
+			Columns: []Column{
+				{"uuid", "uuid"},
+				{"randid", "varchar"},
+				{"created_at", "timestamptz"},
+				{"updated_at", "timestamptz"},
+				{"account_uuid", "uuid"},
+				{"token", "varchar"},
+				{"expired_at", "timestamptz"},
+			},
+			Indexes: []Index{
+				{Columns: []string{"uuid"}, Unique: true},
+				{Columns: []string{"token"}, Unique: true},
+				{Columns: []string{"account_uuid"}},
+			},
+		},
+		{
+			Name: entityName + "_update_email",
+			Columns: []Column{
+				{"uuid", "uuid"},
+				{"randid", "varchar"},
+				{"created_at", "timestamptz"},
+				{"updated_at", "timestamptz"},
+				{"account_uuid", "uuid"},
+				{"previous_email_address", "citext"},
+				{"new_email_address", "citext"},
+				{"reset_token", "varchar"},
+				{"revoke_token", "varchar"},
+				{"processed", "bool"},
+				{"expired_at", "timestamptz"},
+			},
+			Indexes: []Index{
+				{Columns: []string{"uuid"}, Unique: true},
+				{Columns: []string{"account_uuid"}},
+			},
+		},
+		{
+			Name: entityName + "_device",
+			Columns: []Column{
+				{"account_uuid", "uuid"},
+				{"device_id", "varchar"},
+				{"device_type", "text"},
+				{"user_agent", "text"},
+				{"first_seen_at", "timestamptz"},
+				{"last_seen_at", "timestamptz"},
+			},
+			Indexes: []Index{
+				{Columns: []string{"account_uuid", "device_id"}, Unique: true},
+			},
+		},
+		{
+			Name: entityName + "_outbox",
+			Columns: []Column{
+				{"id", "int8"},
+				{"event_name", "varchar"},
+				{"payload", "jsonb"},
+				{"created_at", "timestamptz"},
+				{"attempts", "int4"},
+				{"next_attempt_at", "timestamptz"},
+				{"last_error", "text"},
+			},
+			Indexes: []Index{
+				{Columns: []string{"id"}, Unique: true},
+				{Columns: []string{"next_attempt_at"}},
+			},
+		},
+		{
+			Name: entityName + "_username_history",
+			Columns: []Column{
+				{"id", "int8"},
+				{"account_uuid", "uuid"},
+				{"username", "varchar"},
+				{"username_canonical", "varchar"},
+				{"username_skeleton", "varchar"},
+				{"changed_at", "timestamptz"},
+				{"held_until", "timestamptz"},
+			},
+			Indexes: []Index{
+				{Columns: []string{"id"}, Unique: true},
+				{Columns: []string{"account_uuid", "changed_at"}},
+				{Columns: []string{"username_canonical", "held_until"}},
+				{Columns: []string{"username_skeleton", "held_until"}},
+			},
+		},
+	}
+}
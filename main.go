@@ -1,14 +1,21 @@
 package commonuser
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"github.com/21strive/commonuser/config"
+	"github.com/21strive/commonuser/internal/cache"
 	"github.com/21strive/commonuser/internal/fetcher"
+	"github.com/21strive/commonuser/internal/jwt_impl"
 	"github.com/21strive/commonuser/internal/model"
 	"github.com/21strive/commonuser/internal/repository"
+	"github.com/21strive/commonuser/internal/schema"
 	"github.com/21strive/commonuser/pkg/account"
 	"github.com/21strive/commonuser/pkg/email"
+	"github.com/21strive/commonuser/pkg/event"
+	"github.com/21strive/commonuser/pkg/janitor"
+	"github.com/21strive/commonuser/pkg/outbox"
 	"github.com/21strive/commonuser/pkg/password"
 	"github.com/21strive/commonuser/pkg/session"
 	"github.com/21strive/commonuser/pkg/verification"
@@ -17,12 +24,25 @@ import (
 )
 
 type (
-	Account       = model.Account
-	Session       = model.Session
-	Verification  = model.Verification
-	Provider      = model.Provider
-	UpdateEmail   = model.UpdateEmail
-	ResetPassword = model.ResetPassword
+	Account        = model.Account
+	Session        = model.Session
+	Verification   = model.Verification
+	Provider       = model.Provider
+	UpdateEmail    = model.UpdateEmail
+	ResetPassword  = model.ResetPassword
+	SchemaReport   = schema.Report
+	SchemaIssue    = schema.Issue
+	UserClaims     = jwt_impl.UserClaims
+	DeviceInfo     = model.DeviceInfo
+	SignIn         = model.SignIn
+	SessionDevice  = model.SessionDevice
+	SessionList    = model.SessionList
+	SessionPage    = session.Page
+	UsernameChange = model.UsernameChange
+	CachePipeline  = cache.Pipeline
+	AccountFilter  = model.AccountFilter
+	AccountPage    = model.AccountPage
+	JanitorReport  = janitor.Report
 )
 
 func IsAccountNotFound(err error) bool {
@@ -37,6 +57,83 @@ func IsUnauthorized(err error) bool {
 	return errors.Is(err, model.Unauthorized)
 }
 
+func IsInvalidPhoneNumber(err error) bool {
+	return errors.Is(err, model.InvalidPhoneNumber)
+}
+
+func IsIdentifierRequired(err error) bool {
+	return errors.Is(err, model.IdentifierRequired)
+}
+
+func IsPhoneRequired(err error) bool {
+	return errors.Is(err, model.PhoneRequired)
+}
+
+func IsInvalidEmail(err error) bool {
+	return errors.Is(err, model.InvalidEmail)
+}
+
+func IsEmailTaken(err error) bool {
+	return errors.Is(err, model.EmailTaken)
+}
+
+func IsInvalidUsername(err error) bool {
+	return errors.Is(err, model.InvalidUsername)
+}
+
+func IsUsernameReserved(err error) bool {
+	return errors.Is(err, model.UsernameReserved)
+}
+
+// IsUsernameTaken also holds for usernames that only look like a taken one.
+func IsUsernameTaken(err error) bool {
+	return errors.Is(err, model.UsernameTaken)
+}
+
+// IsUsernameHeld reports a username another account gave up recently and
+// still holds. IsUsernameTaken holds for it too.
+func IsUsernameHeld(err error) bool {
+	return errors.Is(err, model.UsernameHeld)
+}
+
+func IsUsernameChangeTooSoon(err error) bool {
+	return errors.Is(err, model.UsernameChangeTooSoon)
+}
+
+func IsInvalidCursor(err error) bool {
+	return errors.Is(err, model.InvalidCursor)
+}
+
+func IsInvalidAttributes(err error) bool {
+	return errors.Is(err, model.InvalidAttributes)
+}
+
+// Attributes decodes the account's custom profile fields into T, usually a
+// struct with json tags.
+func Attributes[T any](account *Account) (T, error) {
+	return model.GetAttributes[T](account)
+}
+
+// SetAttributes replaces the account's custom profile fields; Create and
+// Update persist them. attributes has to encode to a JSON object.
+func SetAttributes[T any](account *Account, attributes T) error {
+	return model.SetAttributes(account, attributes)
+}
+
+// IsAccountSuspended reports a sign in or refresh of a suspended account.
+// IsUnauthorized holds for it too.
+func IsAccountSuspended(err error) bool {
+	return errors.Is(err, model.AccountSuspended)
+}
+
+func IsTokenRevoked(err error) bool {
+	return errors.Is(err, model.TokenRevoked)
+}
+
+func IsSweepInProgress(err error) bool {
+	return errors.Is(err, janitor.SweepInProgress)
+}
+
 func IsInvalidSession(err error) bool {
 	return errors.Is(err, model.InvalidSession)
 }
@@ -45,6 +142,26 @@ func IsSessionNotFound(err error) bool {
 	return errors.Is(err, model.SessionNotFound)
 }
 
+func IsSessionExpired(err error) bool {
+	return errors.Is(err, model.SessionExpired)
+}
+
+func IsSessionRevoked(err error) bool {
+	return errors.Is(err, model.SessionRevoked)
+}
+
+func IsSessionIdleTimeout(err error) bool {
+	return errors.Is(err, model.SessionIdleTimeout)
+}
+
+func IsSessionLifetimeExceeded(err error) bool {
+	return errors.Is(err, model.SessionLifetimeExceeded)
+}
+
+func IsSessionLimitReached(err error) bool {
+	return errors.Is(err, model.SessionLimitReached)
+}
+
 func IsProviderNotFound(err error) bool {
 	return errors.Is(err, model.ProviderNotFound)
 }
@@ -57,6 +174,18 @@ func IsInvalidVerificationCode(err error) bool {
 	return errors.Is(err, model.InvalidVerificationCode)
 }
 
+func IsVerificationCodeExpired(err error) bool {
+	return errors.Is(err, model.VerificationCodeExpired)
+}
+
+func IsVerificationAttemptsExceeded(err error) bool {
+	return errors.Is(err, model.VerificationAttemptsExceeded)
+}
+
+func IsVerificationResendTooSoon(err error) bool {
+	return errors.Is(err, model.VerificationResendTooSoon)
+}
+
 func IsRequestExpired(err error) bool {
 	return errors.Is(err, model.EmailChangeRequestExpired)
 }
@@ -87,13 +216,84 @@ type App struct {
 	verificationOps *verification.VerificationOps
 	emailOps        *email.EmailOps
 	passwordOps     *password.PasswordOps
+	janitor         *janitor.Janitor
+	events          *event.Bus
+	emitter         *outbox.Emitter
+	outboxRelay     *outbox.Relay
 	Account         *account.AccountOps
 
-	config *config.App
+	readDB     *sql.DB
+	writeDB    *sql.DB
+	redis      redis.UniversalClient
+	jwtHandler *jwt_impl.JWTHandler
+	config     *config.App
 }
 
 func (s *App) WithWriteDB(writeDB *sql.DB) {
+	s.writeDB = writeDB
 	s.accountOps.SetWriteDB(writeDB)
+	s.sessionOps.SetWriteDB(writeDB)
+	s.verificationOps.SetWriteDB(writeDB)
+	s.emailOps.SetWriteDB(writeDB)
+	s.passwordOps.SetWriteDB(writeDB)
+	s.janitor.SetWriteDB(writeDB)
+	s.outboxRelay.SetWriteDB(writeDB)
+}
+
+// StartOutboxRelay starts moving recorded events to the Redis Stream
+// configured in config.Outbox. Requires WithWriteDB.
+func (s *App) StartOutboxRelay(ctx context.Context, onError func(error)) {
+	s.outboxRelay.OnError(onError)
+	s.outboxRelay.Start(ctx)
+}
+
+func (s *App) StopOutboxRelay() {
+	s.outboxRelay.Stop()
+}
+
+func (s *App) OutboxRelay() *outbox.Relay {
+	return s.outboxRelay
+}
+
+// StartJanitor starts the background sweep of expired sessions and stale
+// tickets on this replica. Every replica may start it; a Redis lock makes sure
+// only one sweeps at a time. Requires WithWriteDB.
+func (s *App) StartJanitor(ctx context.Context, onReport func(JanitorReport)) {
+	s.janitor.OnReport(onReport)
+	s.janitor.Start(ctx)
+}
+
+func (s *App) StopJanitor() {
+	s.janitor.Stop()
+}
+
+// Events returns the bus that account and session lifecycle events are
+// published on. Subscribe with event.Subscribe or event.SubscribeAsync.
+func (s *App) Events() *event.Bus {
+	return s.events
+}
+
+func (s *App) Janitor() *janitor.Janitor {
+	return s.janitor
+}
+
+// CheckSchema compares the live tables against the columns and indexes the
+// repositories rely on. It reads from the write database when one is set.
+func (s *App) CheckSchema(ctx context.Context) (*SchemaReport, error) {
+	db := s.readDB
+	if s.writeDB != nil {
+		db = s.writeDB
+	}
+	return schema.Check(ctx, db, s.config.EntityName)
+}
+
+// Pipeline returns a pipeline for WithTransaction paths composed by hand; Begin
+// does this for you. Finish it with Commit(ctx, tx) instead of committing tx
+// yourself: the cache is only written, and events are only published on the
+// bus, once the transaction has committed, and a rolled back transaction
+// leaves both untouched.
+func (s *App) Pipeline() *CachePipeline {
+	return cache.NewPipeline(s.redis, s.emitter)
 }
 
 func (s *App) AccountBase() *redifu.Base[*model.Account] {
@@ -104,6 +304,29 @@ func (s *App) SessionBase() *redifu.Base[*model.Session] {
 	return s.sessionOps.GetSessionBase()
 }
 
+// VerifyAccessToken checks the signature and expiry of an access token issued
+// by this app and returns its claims. Tokens issued before the account's last
+// password, email or status change are rejected with TokenRevoked.
+func (s *App) VerifyAccessToken(ctx context.Context, accessToken string) (*UserClaims, error) {
+	claims, errParse := s.jwtHandler.ParseAccessToken(accessToken)
+	if errParse != nil {
+		return nil, errParse
+	}
+
+	currentVersion, errVersion := s.accountOps.TokenVersion(ctx, claims.UUID)
+	if errVersion != nil {
+		if errors.Is(errVersion, model.AccountDoesNotExists) {
+			return nil, model.TokenRevoked
+		}
+		return nil, errVersion
+	}
+	if claims.TokenVersion < currentVersion {
+		return nil, model.TokenRevoked
+	}
+
+	return claims, nil
+}
+
 func (s *App) Config() *config.App {
 	return s.config
 }
@@ -128,26 +351,52 @@ func (s *App) Password() *password.PasswordOps {
 	return s.passwordOps
 }
 
-func New(readConnection *sql.DB, redisClient redis.UniversalClient, config *config.App) *App {
+func New(readConnection *sql.DB, redisClient redis.UniversalClient, config *config.App, opts ...Option) *App {
+	appOptions := newOptions(opts)
+
 	baseAccount := redifu.NewBase[*model.Account](redisClient, config.EntityName+":%s", config.RecordAge)
 	baseAccountReference := redifu.NewBase[*model.AccountReference](redisClient, config.EntityName+":username:%s", config.RecordAge)
+	baseEmailReference := redifu.NewBase[*model.AccountReference](redisClient, config.EntityName+":email:%s", config.RecordAge)
+	baseUUIDReference := redifu.NewBase[*model.AccountReference](redisClient, config.EntityName+":uuid:%s", config.RecordAge)
+	basePhoneReference := redifu.NewBase[*model.AccountReference](redisClient, config.EntityName+":phone:%s", config.RecordAge)
 	baseSession := redifu.NewBase[*model.Session](redisClient, config.EntityName+":session:%s", config.TokenLifespan)
 
-	accountRep := repository.NewAccountRepository(readConnection, redisClient, baseAccount, baseAccountReference, config)
+	var missingBases repository.MissingBases
+	if config.MissingAge > 0 {
+		missingBases.Account = redifu.NewBase[*model.Account](redisClient, config.EntityName+":%s", config.MissingAge)
+		missingBases.Username = redifu.NewBase[*model.AccountReference](redisClient, config.EntityName+":username:%s", config.MissingAge)
+		missingBases.Email = redifu.NewBase[*model.AccountReference](redisClient, config.EntityName+":email:%s", config.MissingAge)
+		missingBases.UUID = redifu.NewBase[*model.AccountReference](redisClient, config.EntityName+":uuid:%s", config.MissingAge)
+		missingBases.Phone = redifu.NewBase[*model.AccountReference](redisClient, config.EntityName+":phone:%s", config.MissingAge)
+	}
+
+	accountVersions := cache.NewVersions(redisClient, config.EntityName+":revision:", config.RecordAge)
+	accountRep := repository.NewAccountRepository(readConnection, redisClient, baseAccount, baseAccountReference, baseEmailReference, baseUUIDReference, basePhoneReference, missingBases, accountVersions, config)
 	providerRep := repository.NewProviderRepository(readConnection, config)
+	usernameHistoryRep := repository.NewUsernameHistoryRepository(readConnection, config)
+	deviceRep := repository.NewDeviceRepository(config)
+	outboxRep := repository.NewOutboxRepository(config)
 	verificationRep := repository.NewVerificationRepository(readConnection, config)
 	sessionRep := repository.NewSessionRepository(readConnection, redisClient, baseSession, config)
 	updateEmailRep := repository.NewUpdateEmailManager(readConnection, config)
 	resetPasswordRep := repository.NewResetPasswordRepository(readConnection, config)
 
-	accountFetcher := fetcher.NewAccountFetchers(redisClient, baseAccount, baseAccountReference, config)
+	accountFetcher := fetcher.NewAccountFetchers(redisClient, baseAccount, baseAccountReference, baseEmailReference, baseUUIDReference, basePhoneReference, accountVersions, config)
 	sessionFetcher := fetcher.NewSessionFetcher(baseSession)
 
-	sessionOps := session.New(sessionRep, sessionFetcher, config)
-	accountOps := account.New(accountRep, providerRep, accountFetcher, sessionOps, config)
-	verificationOps := verification.New(verificationRep, accountOps, config)
-	emailOps := email.New(updateEmailRep, accountOps, sessionOps)
-	passwordOps := password.New(resetPasswordRep, sessionOps, accountOps)
+	emitter := outbox.NewEmitter(appOptions.eventBus, outboxRep)
+	sessionOps := session.New(redisClient, sessionRep, sessionFetcher, emitter, config)
+	accountOps := account.New(accountRep, providerRep, usernameHistoryRep, deviceRep, verificationRep, accountFetcher, sessionOps, emitter, config)
+	verificationOps := verification.New(verificationRep, accountOps, emitter, config)
+	emailOps := email.New(updateEmailRep, accountOps, sessionOps, emitter)
+	passwordOps := password.New(resetPasswordRep, sessionOps, accountOps, emitter)
+	janitorOps := janitor.New(redisClient, sessionRep, resetPasswordRep, updateEmailRep, verificationRep, config)
+
+	if appOptions.notifier != nil {
+		verificationOps.SetNotifier(appOptions.notifier)
+		emailOps.SetNotifier(appOptions.notifier)
+		passwordOps.SetNotifier(appOptions.notifier)
+	}
 
 	return &App{
 		accountOps:      accountOps,
@@ -155,6 +404,13 @@ func New(readConnection *sql.DB, redisClient redis.UniversalClient, config *conf
 		verificationOps: verificationOps,
 		emailOps:        emailOps,
 		passwordOps:     passwordOps,
+		janitor:         janitorOps,
+		events:          appOptions.eventBus,
+		emitter:         emitter,
+		outboxRelay:     outbox.NewRelay(redisClient, outboxRep, config),
+		readDB:          readConnection,
+		redis:           redisClient,
+		jwtHandler:      jwt_impl.NewJWTHandler(config.JWTSecret, config.JWTIssuer, int(config.JWTLifespan.Seconds())),
 		config:          config,
 		Account:         accountOps,
 	}
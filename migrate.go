@@ -0,0 +1,26 @@
+package commonuser
+
+import (
+	"context"
+	"database/sql"
+	"github.com/21strive/commonuser/internal/schema"
+)
+
+type (
+	MigrationResult  = schema.MigrationResult
+	AppliedMigration = schema.AppliedMigration
+	MigrationError   = schema.MigrationError
+)
+
+// Migrate creates or upgrades the tables for entityName. It is safe to call
+// from every replica at startup, and must run before New since New prepares
+// statements against these tables.
+func Migrate(ctx context.Context, db *sql.DB, entityName string) (*MigrationResult, error) {
+	return schema.Migrate(ctx, db, entityName, false)
+}
+
+// MigrateDryRun returns the statements Migrate would execute without
+// executing them.
+func MigrateDryRun(ctx context.Context, db *sql.DB, entityName string) (*MigrationResult, error) {
+	return schema.Migrate(ctx, db, entityName, true)
+}
@@ -0,0 +1,40 @@
+package commonuser
+
+import (
+	"github.com/21strive/commonuser/pkg/event"
+	"github.com/21strive/commonuser/pkg/notify"
+)
+
+type Option func(*options)
+
+type options struct {
+	eventBus *event.Bus
+	notifier notify.Notifier
+}
+
+// WithEventBus publishes lifecycle events on bus instead of a bus owned by the
+// App, e.g. to share one bus between several entities.
+func WithEventBus(bus *event.Bus) Option {
+	return func(o *options) {
+		o.eventBus = bus
+	}
+}
+
+// WithNotifier delivers verification codes, reset tokens and email change
+// tokens through notifier. Without it those secrets are never sent.
+func WithNotifier(notifier notify.Notifier) Option {
+	return func(o *options) {
+		o.notifier = notifier
+	}
+}
+
+func newOptions(opts []Option) *options {
+	o := &options{}
+	for _, opt := range opts {
+		opt(o)
+	}
+	if o.eventBus == nil {
+		o.eventBus = event.NewBus()
+	}
+	return o
+}
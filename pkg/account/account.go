@@ -3,21 +3,26 @@ package account
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"github.com/21strive/commonuser/config"
 	"github.com/21strive/commonuser/internal/fetcher"
 	"github.com/21strive/commonuser/internal/model"
 	"github.com/21strive/commonuser/internal/repository"
 	"github.com/21strive/commonuser/internal/types"
+	"github.com/21strive/commonuser/pkg/event"
+	"github.com/21strive/commonuser/pkg/outbox"
 	"github.com/21strive/commonuser/pkg/session"
 	"github.com/21strive/redifu"
 	"github.com/redis/go-redis/v9"
+	"golang.org/x/sync/singleflight"
+	"strings"
 	"time"
 )
 
 type WithTransaction struct {
 	AccountOps *AccountOps
 	Pipeline   redis.Pipeliner
-	Tx         *sql.Tx
+	Tx         types.SQLExecutor
 }
 
 func (w *WithTransaction) Register(ctx context.Context, newAccount *model.Account) error {
@@ -32,16 +37,29 @@ func (w *WithTransaction) Update(ctx context.Context, newAccount *model.Account)
 	return w.AccountOps.update(ctx, w.Pipeline, w.Tx, newAccount)
 }
 
+func (w *WithTransaction) OverrideUsername(ctx context.Context, account *model.Account, username string) error {
+	return w.AccountOps.overrideUsername(ctx, w.Pipeline, w.Tx, account, username)
+}
+
+func (w *WithTransaction) RevokeAccessTokens(ctx context.Context, account *model.Account) error {
+	return w.AccountOps.revokeAccessTokens(ctx, w.Pipeline, w.Tx, account)
+}
+
 func (w *WithTransaction) Delete(ctx context.Context, account *model.Account) error {
 	return w.AccountOps.delete(ctx, w.Pipeline, w.Tx, account)
 }
 
 type AccountOps struct {
-	writeDB            *sql.DB
-	accountRepository  *repository.AccountRepository
-	providerRepository *repository.ProviderRepository
-	accountFetcher     *fetcher.AccountFetcher
-	config             *config.App
+	writeDB                   *sql.DB
+	accountRepository         *repository.AccountRepository
+	providerRepository        *repository.ProviderRepository
+	usernameHistoryRepository *repository.UsernameHistoryRepository
+	accountFetcher            *fetcher.AccountFetcher
+	sessionOps                *session.SessionOps
+	events                    *outbox.Emitter
+	usernamePolicy            *model.UsernamePolicy
+	emailPolicy               *model.EmailPolicy
+	config                    *config.App
 
 	Authenticate *Authentication
 	Find         *Find
@@ -61,17 +79,147 @@ func (o *AccountOps) GetAccountBase() *redifu.Base[*model.Account] {
 	return o.accountRepository.GetBase()
 }
 
-func (o *AccountOps) WithTransaction(pipe redis.Pipeliner, db *sql.Tx) *WithTransaction {
+// WithTransaction queues cache writes on pipe; send them only once tx has
+// committed, as the pipeline from commonuser.App.Pipeline does.
+func (o *AccountOps) WithTransaction(pipe redis.Pipeliner, db types.SQLExecutor) *WithTransaction {
 	return &WithTransaction{AccountOps: o, Pipeline: pipe, Tx: db}
 }
 
+// prepareIdentifiers normalizes the phone number to E.164 and makes sure the
+// account can be reached by email or phone.
+func (o *AccountOps) prepareIdentifiers(account *model.Account) error {
+	if account.Email == "" && account.Phone == "" {
+		return model.IdentifierRequired
+	}
+	if account.Phone == "" {
+		return nil
+	}
+
+	phone, errNormalize := model.NormalizePhone(account.Phone, o.config.DefaultCountryCode)
+	if errNormalize != nil {
+		return errNormalize
+	}
+	account.SetPhone(phone)
+	return nil
+}
+
+// prepareUsername applies the username policy and rejects a username another
+// account holds or closely resembles. With override set, names other accounts
+// only hold since giving them up are allowed.
+func (o *AccountOps) prepareUsername(ctx context.Context, db types.SQLExecutor, account *model.Account, override bool) error {
+	errApply := o.usernamePolicy.Apply(account)
+	if errApply != nil {
+		return errApply
+	}
+	if account.UsernameCanonical == "" {
+		return nil
+	}
+	errConflict := o.accountRepository.UsernameConflict(ctx, db, account)
+	if errConflict != nil || override {
+		return errConflict
+	}
+	return o.usernameHistoryRepository.HeldConflict(ctx, db, account)
+}
+
+// checkUsernameCooldown returns UsernameChangeTooSoon while the account's last
+// username change is within the change cooldown.
+func (o *AccountOps) checkUsernameCooldown(ctx context.Context, db types.SQLExecutor, account *model.Account) error {
+	if o.config.Username.ChangeCooldown <= 0 {
+		return nil
+	}
+
+	lastChangedAt, errLast := o.usernameHistoryRepository.LastChangedAt(ctx, db, account.GetUUID())
+	if errLast != nil {
+		return errLast
+	}
+	if !lastChangedAt.IsZero() && time.Now().UTC().Before(lastChangedAt.Add(o.config.Username.ChangeCooldown)) {
+		return model.UsernameChangeTooSoon
+	}
+	return nil
+}
+
+// moveUsername records the username accountFromDB gives up and holds it for
+// the hold period, keeping its cached reference so the old name still
+// resolves to the account.
+func (o *AccountOps) moveUsername(ctx context.Context, pipe redis.Pipeliner, db types.SQLExecutor, accountFromDB *model.Account, account *model.Account, override bool) error {
+	oldUsernameKey := accountFromDB.UsernameKey()
+	if accountFromDB.Username != "" {
+		oldSkeleton := accountFromDB.UsernameSkeleton
+		if oldSkeleton == "" {
+			oldSkeleton = o.usernamePolicy.Skeleton(oldUsernameKey)
+		}
+
+		timeNow := time.Now().UTC()
+		errRecord := o.usernameHistoryRepository.Record(ctx, db, &model.UsernameChange{
+			AccountUUID:       account.GetUUID(),
+			Username:          accountFromDB.Username,
+			UsernameCanonical: oldUsernameKey,
+			UsernameSkeleton:  oldSkeleton,
+			ChangedAt:         timeNow,
+			HeldUntil:         timeNow.Add(o.config.Username.HoldPeriod),
+		})
+		if errRecord != nil {
+			return errRecord
+		}
+		if o.config.Username.HoldPeriod > 0 {
+			oldUsernameKey = ""
+		}
+	}
+
+	if override && account.UsernameCanonical != "" {
+		errRelease := o.usernameHistoryRepository.Release(ctx, db, account)
+		if errRelease != nil {
+			return errRelease
+		}
+	}
+
+	errUpdateRef := o.accountRepository.UpdateReference(ctx, pipe, account, oldUsernameKey)
+	if errUpdateRef != nil {
+		return errUpdateRef
+	}
+
+	return o.events.Emit(ctx, db, event.UsernameChanged{
+		Account:          account,
+		PreviousUsername: accountFromDB.Username,
+		NewUsername:      account.Username,
+		Overridden:       override,
+		OccurredAt:       time.Now().UTC(),
+	})
+}
+
+// prepareEmail fills in the canonical email address and rejects one another
+// account already holds.
+func (o *AccountOps) prepareEmail(ctx context.Context, db types.SQLExecutor, account *model.Account) error {
+	errApply := o.emailPolicy.Apply(account)
+	if errApply != nil {
+		return errApply
+	}
+	if account.EmailCanonical == "" {
+		return nil
+	}
+	return o.accountRepository.EmailConflict(ctx, db, account.EmailCanonical, account.GetUUID())
+}
+
+// CheckEmail returns InvalidEmail or EmailTaken when account could not move
+// to email, e.g. before an email change is requested.
+func (o *AccountOps) CheckEmail(ctx context.Context, account *model.Account, email string) error {
+	canonical, errCanonical := o.emailPolicy.Canonical(email)
+	if errCanonical != nil {
+		return errCanonical
+	}
+	return o.accountRepository.EmailConflict(ctx, o.writeDB, canonical, account.GetUUID())
+}
+
+// registerWithProvider creates the account before the provider, whose
+// account_uuid references it.
 func (o *AccountOps) registerWithProvider(ctx context.Context, pipe redis.Pipeliner, db types.SQLExecutor, newAccount *model.Account, newProvider *model.Provider) error {
-	errCreateProvider := o.providerRepository.Create(ctx, db, newProvider)
-	if errCreateProvider != nil {
-		return errCreateProvider
+	errRegister := o.register(ctx, pipe, db, newAccount)
+	if errRegister != nil {
+		return errRegister
 	}
 
-	return o.register(ctx, pipe, db, newAccount)
+	newProvider.SetAccount(newAccount)
+	return o.providerRepository.Create(ctx, db, newProvider)
 }
 
 func (o *AccountOps) RegisterWithProvider(ctx context.Context, newAccount *model.Account, newProvider *model.Provider) error {
@@ -79,7 +227,25 @@ func (o *AccountOps) RegisterWithProvider(ctx context.Context, newAccount *model
 }
 
 func (o *AccountOps) register(ctx context.Context, pipe redis.Pipeliner, db types.SQLExecutor, newAccount *model.Account) error {
-	return o.accountRepository.Create(ctx, pipe, db, newAccount)
+	errPrepare := o.prepareIdentifiers(newAccount)
+	if errPrepare != nil {
+		return errPrepare
+	}
+	errPrepare = o.prepareUsername(ctx, db, newAccount, false)
+	if errPrepare != nil {
+		return errPrepare
+	}
+	errPrepare = o.prepareEmail(ctx, db, newAccount)
+	if errPrepare != nil {
+		return errPrepare
+	}
+
+	errCreate := o.accountRepository.Create(ctx, pipe, db, newAccount)
+	if errCreate != nil {
+		return errCreate
+	}
+
+	return o.events.Emit(ctx, db, event.AccountRegistered{Account: newAccount, OccurredAt: time.Now().UTC()})
 }
 
 func (o *AccountOps) Register(ctx context.Context, newAccount *model.Account) error {
@@ -87,20 +253,97 @@ func (o *AccountOps) Register(ctx context.Context, newAccount *model.Account) er
 }
 
 func (o *AccountOps) update(ctx context.Context, pipe redis.Pipeliner, db types.SQLExecutor, account *model.Account) error {
-	accountFromDB, errFind := o.accountRepository.FindByUUID(account.GetUUID())
+	return o.updateAccount(ctx, pipe, db, account, false)
+}
+
+// updateAccount saves account. A username change is subject to the change
+// cooldown unless override is set.
+func (o *AccountOps) updateAccount(ctx context.Context, pipe redis.Pipeliner, db types.SQLExecutor, account *model.Account, override bool) error {
+	errPrepare := o.prepareIdentifiers(account)
+	if errPrepare != nil {
+		return errPrepare
+	}
+
+	// read on db rather than the replica, and locked when db is a transaction
+	accountFromDB, errFind := o.accountRepository.FindByUUIDForUpdate(ctx, db, account.GetUUID())
 	if errFind != nil {
 		return errFind
 	}
 
-	oldUsername := accountFromDB.Username
+	oldUsernameKey := accountFromDB.UsernameKey()
+	oldEmailKey := accountFromDB.EmailKey()
+	oldPhone := accountFromDB.Phone
+
+	// cached copies carry no skeleton, so the stored forms are kept unless the
+	// username itself changes
+	if account.Username != accountFromDB.Username {
+		errPrepare = o.prepareUsername(ctx, db, account, override)
+		if errPrepare != nil {
+			return errPrepare
+		}
+	} else {
+		account.UsernameCanonical = accountFromDB.UsernameCanonical
+		account.UsernameSkeleton = accountFromDB.UsernameSkeleton
+	}
+	usernameChanged := oldUsernameKey != account.UsernameKey()
+	if usernameChanged && accountFromDB.Username != "" && !override {
+		errCooldown := o.checkUsernameCooldown(ctx, db, account)
+		if errCooldown != nil {
+			return errCooldown
+		}
+	}
+	if account.Email != accountFromDB.Email {
+		errPrepare = o.prepareEmail(ctx, db, account)
+		if errPrepare != nil {
+			return errPrepare
+		}
+	} else {
+		account.EmailCanonical = accountFromDB.EmailCanonical
+	}
+
+	// a new number has to be verified again
+	if account.Phone != oldPhone {
+		account.PhoneVerified = false
+	}
+	// cached copies from before statuses carry none
+	if account.Status == "" {
+		account.Status = accountFromDB.Status
+	}
+	// nil means the attributes were never read, not that they are cleared
+	if account.Attributes == nil {
+		account.Attributes = accountFromDB.Attributes
+	}
+	// cached copies carry no password hash; only SetPassword changes it
+	if account.Password == "" {
+		account.Password = accountFromDB.Password
+	}
+
+	// the version is raised in place, never written back from a copy
+	revokeTokens := account.Password != accountFromDB.Password || account.Email != accountFromDB.Email || account.Phone != oldPhone ||
+		account.Status != accountFromDB.Status
 
-	errSet := o.accountRepository.Update(ctx, pipe, db, accountFromDB)
+	account.SetUpdatedAt(time.Now().UTC())
+	errSet := o.accountRepository.Update(ctx, pipe, db, account, revokeTokens)
 	if errSet != nil {
 		return errSet
 	}
 
-	if oldUsername != account.Username {
-		return o.accountRepository.UpdateReference(ctx, pipe, accountFromDB, oldUsername, accountFromDB.Username)
+	if usernameChanged {
+		errMove := o.moveUsername(ctx, pipe, db, accountFromDB, account, override)
+		if errMove != nil {
+			return errMove
+		}
+	}
+
+	if oldEmailKey != account.EmailKey() {
+		errUpdateRef := o.accountRepository.UpdateEmailReference(ctx, pipe, account, oldEmailKey, account.EmailKey())
+		if errUpdateRef != nil {
+			return errUpdateRef
+		}
+	}
+
+	if oldPhone != account.Phone {
+		return o.accountRepository.UpdatePhoneReference(ctx, pipe, account, oldPhone, account.Phone)
 	}
 
 	return nil
@@ -110,25 +353,283 @@ func (o *AccountOps) Update(ctx context.Context, account *model.Account) error {
 	return o.update(ctx, nil, o.writeDB, account)
 }
 
+func (o *AccountOps) overrideUsername(ctx context.Context, pipe redis.Pipeliner, db types.SQLExecutor, account *model.Account, username string) error {
+	account.SetUsername(username)
+	return o.updateAccount(ctx, pipe, db, account, true)
+}
+
+// OverrideUsername moves the account to username on an administrator's
+// behalf, skipping the change cooldown and ending any hold another account
+// has on the name. The username policy and live accounts still apply.
+func (o *AccountOps) OverrideUsername(ctx context.Context, account *model.Account, username string) error {
+	return o.overrideUsername(ctx, nil, o.writeDB, account, username)
+}
+
+// UsernameHistory lists the usernames the account gave up, latest first.
+func (o *AccountOps) UsernameHistory(ctx context.Context, account *model.Account) ([]*model.UsernameChange, error) {
+	return o.usernameHistoryRepository.FindByAccount(ctx, o.writeDB, account.GetUUID())
+}
+
+func (o *AccountOps) revokeAccessTokens(ctx context.Context, pipe redis.Pipeliner, db types.SQLExecutor, account *model.Account) error {
+	tokenVersion, errBump := o.accountRepository.BumpTokenVersion(ctx, pipe, db, account)
+	if errBump != nil {
+		return errBump
+	}
+	account.TokenVersion = tokenVersion
+	return nil
+}
+
+// RevokeAccessTokens invalidates every access token issued to the account
+// without waiting for them to expire.
+func (o *AccountOps) RevokeAccessTokens(ctx context.Context, account *model.Account) error {
+	return o.revokeAccessTokens(ctx, nil, o.writeDB, account)
+}
+
+// TokenVersion returns the account's current token version.
+func (o *AccountOps) TokenVersion(ctx context.Context, accountUUID string) (int64, error) {
+	return o.accountRepository.GetTokenVersion(ctx, accountUUID)
+}
+
 func (o *AccountOps) delete(ctx context.Context, pipe redis.Pipeliner, db types.SQLExecutor, account *model.Account) error {
+	// session rows go away through ON DELETE CASCADE, the cached ones have to be revoked
+	_, errRevoke := o.sessionOps.WithTransaction(pipe, db).RevokeAll(ctx, account)
+	if errRevoke != nil {
+		return errRevoke
+	}
+
 	errDel := o.accountRepository.Delete(ctx, pipe, db, account)
 	if errDel != nil {
 		return errDel
 	}
 
-	return nil
+	return o.events.Emit(ctx, db, event.AccountDeleted{Account: account, OccurredAt: time.Now().UTC()})
 }
 
 func (o *AccountOps) Delete(ctx context.Context, account *model.Account) error {
 	return o.delete(ctx, nil, o.writeDB, account)
 }
 
+// List pages through accounts matching filter, newest first. Pass the
+// NextCursor of a page to get the one after it. Pages are cached for
+// PaginationAge; registering, updating or deleting any account invalidates
+// them.
+func (o *AccountOps) List(ctx context.Context, filter model.AccountFilter, cursor string) (*model.AccountPage, error) {
+	var after *model.AccountCursor
+	if cursor != "" {
+		decoded, errDecode := model.DecodeAccountCursor(cursor)
+		if errDecode != nil {
+			return nil, errDecode
+		}
+		after = decoded
+	}
+
+	limit := filter.PageSize()
+	filter.Limit = limit
+	filter.UsernamePrefix = o.usernamePolicy.Fold(filter.UsernamePrefix)
+	filter.EmailPrefix = strings.ToLower(strings.TrimSpace(filter.EmailPrefix))
+
+	pageKey, errKey := o.accountRepository.PageKey(ctx, filter.CacheKey(cursor))
+	if errKey != nil {
+		return nil, errKey
+	}
+	page, errGetPage := o.accountRepository.GetPage(ctx, pageKey)
+	if errGetPage != nil {
+		return nil, errGetPage
+	}
+	if page != nil {
+		return page, nil
+	}
+
+	// one extra row tells whether another page follows
+	accounts, errFind := o.accountRepository.FindPage(ctx, filter, after, limit+1)
+	if errFind != nil {
+		return nil, errFind
+	}
+
+	page = &model.AccountPage{Accounts: accounts}
+	if len(accounts) > limit {
+		page.Accounts = accounts[:limit]
+		last := page.Accounts[limit-1]
+		page.NextCursor = model.AccountCursor{CreatedAt: last.GetCreatedAt(), UUID: last.GetUUID()}.Encode()
+	}
+	if page.Accounts == nil {
+		page.Accounts = []*model.Account{}
+	}
+
+	errSetPage := o.accountRepository.SetPage(ctx, pageKey, page)
+	if errSetPage != nil {
+		return nil, errSetPage
+	}
+	return page, nil
+}
+
+// BackfillReport reports one BackfillUsernames or BackfillEmails run. Invalid
+// and Conflicts list the uuids of accounts that have to be fixed by hand.
+type BackfillReport struct {
+	Updated   int      `json:"updated"`
+	Invalid   []string `json:"invalid"`
+	Conflicts []string `json:"conflicts"`
+}
+
+// BackfillUsernames fills in the canonical username and skeleton of accounts
+// created before the username policy, batchSize rows at a time, and moves
+// their cached reference to the canonical key. Accounts whose username breaks
+// the policy or collides with another are skipped and reported.
+func (o *AccountOps) BackfillUsernames(ctx context.Context, batchSize int) (*BackfillReport, error) {
+	report := &BackfillReport{}
+	var afterUUID string
+	for {
+		accounts, errFind := o.accountRepository.FindWithoutCanonicalUsername(ctx, o.writeDB, afterUUID, batchSize)
+		if errFind != nil {
+			return report, errFind
+		}
+		if len(accounts) == 0 {
+			return report, nil
+		}
+
+		for _, account := range accounts {
+			afterUUID = account.GetUUID()
+			oldUsernameKey := account.UsernameKey()
+
+			errApply := o.usernamePolicy.Apply(account)
+			if errApply != nil {
+				report.Invalid = append(report.Invalid, account.GetUUID())
+				continue
+			}
+			errConflict := o.accountRepository.UsernameConflict(ctx, o.writeDB, account)
+			if errors.Is(errConflict, model.UsernameTaken) {
+				report.Conflicts = append(report.Conflicts, account.GetUUID())
+				continue
+			}
+			if errConflict != nil {
+				return report, errConflict
+			}
+
+			errSet := o.accountRepository.SetCanonicalUsername(ctx, o.writeDB, account)
+			if errSet != nil {
+				return report, errSet
+			}
+			errUpdateRef := o.accountRepository.UpdateReference(ctx, nil, account, oldUsernameKey)
+			if errUpdateRef != nil {
+				return report, errUpdateRef
+			}
+			report.Updated++
+		}
+	}
+}
+
+// BackfillEmails fills in the canonical email address of accounts created
+// before canonical emails, batchSize rows at a time. Accounts with an address
+// that does not parse or that collides with another are skipped and reported.
+func (o *AccountOps) BackfillEmails(ctx context.Context, batchSize int) (*BackfillReport, error) {
+	report := &BackfillReport{}
+	var afterUUID string
+	for {
+		accounts, errFind := o.accountRepository.FindWithoutCanonicalEmail(ctx, o.writeDB, afterUUID, batchSize)
+		if errFind != nil {
+			return report, errFind
+		}
+		if len(accounts) == 0 {
+			return report, nil
+		}
+
+		for _, account := range accounts {
+			afterUUID = account.GetUUID()
+			oldEmailKey := account.EmailKey()
+
+			errApply := o.emailPolicy.Apply(account)
+			if errApply != nil {
+				report.Invalid = append(report.Invalid, account.GetUUID())
+				continue
+			}
+			errConflict := o.accountRepository.EmailConflict(ctx, o.writeDB, account.EmailCanonical, account.GetUUID())
+			if errors.Is(errConflict, model.EmailTaken) {
+				report.Conflicts = append(report.Conflicts, account.GetUUID())
+				continue
+			}
+			if errConflict != nil {
+				return report, errConflict
+			}
+
+			errSet := o.accountRepository.SetCanonicalEmail(ctx, o.writeDB, account)
+			if errSet != nil {
+				return report, errSet
+			}
+			errUpdateRef := o.accountRepository.UpdateEmailReference(ctx, nil, account, oldEmailKey, account.EmailKey())
+			if errUpdateRef != nil {
+				return report, errUpdateRef
+			}
+			report.Updated++
+		}
+	}
+}
+
+// SeedByUsername also seeds usernames an account gave up but still holds,
+// which then resolve to that account. Holds are looked up first, since a
+// username found nowhere is remembered as missing.
+func (o *AccountOps) SeedByUsername(ctx context.Context, username string) error {
+	usernameKey := o.usernamePolicy.LookupKey(username)
+	held, errFindHeld := o.usernameHistoryRepository.FindHeld(ctx, usernameKey)
+	if errFindHeld != nil {
+		return errFindHeld
+	}
+	if held != nil {
+		return o.accountRepository.SeedMovedReference(ctx, nil, held.AccountUUID, usernameKey)
+	}
+	return o.accountRepository.SeedByUsername(ctx, nil, usernameKey)
+}
+
+func (o *AccountOps) SeedByRandId(ctx context.Context, randId string) error {
+	return o.accountRepository.SeedByRandId(ctx, nil, randId)
+}
+
+func (o *AccountOps) SeedByUUID(ctx context.Context, uuid string) error {
+	return o.accountRepository.SeedByUUID(ctx, nil, uuid)
+}
+
+func (o *AccountOps) SeedByEmail(ctx context.Context, email string) error {
+	return o.accountRepository.SeedByEmail(ctx, nil, o.emailPolicy.LookupKey(email))
+}
+
+func (o *AccountOps) SeedByPhone(ctx context.Context, phone string) error {
+	normalized, errNormalize := model.NormalizePhone(phone, o.config.DefaultCountryCode)
+	if errNormalize != nil {
+		return errNormalize
+	}
+	return o.accountRepository.SeedByPhone(ctx, nil, normalized)
+}
+
 type Find struct {
-	accountRepository *repository.AccountRepository
+	accountRepository         *repository.AccountRepository
+	usernameHistoryRepository *repository.UsernameHistoryRepository
+	usernamePolicy            *model.UsernamePolicy
+	emailPolicy               *model.EmailPolicy
+	config                    *config.App
 }
 
+// ByUsername also finds accounts by a username they gave up but still hold,
+// with MovedFrom set to it.
 func (af *Find) ByUsername(username string) (*model.Account, error) {
-	return af.accountRepository.FindByUsername(username)
+	usernameKey := af.usernamePolicy.LookupKey(username)
+	accountFromDB, errFind := af.accountRepository.FindByUsername(usernameKey)
+	if !errors.Is(errFind, model.AccountDoesNotExists) {
+		return accountFromDB, errFind
+	}
+
+	held, errFindHeld := af.usernameHistoryRepository.FindHeld(context.Background(), usernameKey)
+	if errFindHeld != nil {
+		return nil, errFindHeld
+	}
+	if held == nil {
+		return nil, errFind
+	}
+
+	accountFromDB, errFind = af.accountRepository.FindByUUID(held.AccountUUID)
+	if errFind != nil {
+		return nil, errFind
+	}
+	accountFromDB.MovedFrom = username
+	return accountFromDB, nil
 }
 
 func (af *Find) ByRandId(randId string) (*model.Account, error) {
@@ -140,179 +641,418 @@ func (af *Find) ByUUID(uuid string) (*model.Account, error) {
 }
 
 func (af *Find) ByEmail(email string) (*model.Account, error) {
-	return af.accountRepository.FindByEmail(email)
+	return af.accountRepository.FindByEmail(af.emailPolicy.LookupKey(email))
 }
 
+// ByPhone accepts the number in any format NormalizePhone understands.
+func (af *Find) ByPhone(phone string) (*model.Account, error) {
+	normalized, errNormalize := model.NormalizePhone(phone, af.config.DefaultCountryCode)
+	if errNormalize != nil {
+		return nil, errNormalize
+	}
+	return af.accountRepository.FindByPhone(normalized)
+}
+
+// Fetch reads accounts from the cache. A miss returns AccountSeedRequired,
+// or with config.App.ReadThrough is seeded from the database, with
+// concurrent misses on the same key sharing one query.
 type Fetch struct {
 	accountFetcher *fetcher.AccountFetcher
+	accountOps     *AccountOps
+	usernamePolicy *model.UsernamePolicy
+	emailPolicy    *model.EmailPolicy
+	config         *config.App
+	seeding        singleflight.Group
+}
+
+func (af *Fetch) readThrough(ctx context.Context, key string, fetch func(ctx context.Context) (*model.Account, error), seed func(ctx context.Context) error) (*model.Account, error) {
+	accountFromCache, err := fetch(ctx)
+	if err != nil || accountFromCache != nil {
+		return accountFromCache, err
+	}
+	if !af.config.ReadThrough {
+		return nil, model.AccountSeedRequired
+	}
+
+	// the seed is shared, so one caller giving up must not fail the others
+	seedCtx := context.WithoutCancel(ctx)
+	seeded, errSeed, shared := af.seeding.Do(key, func() (interface{}, error) {
+		errSeed := seed(seedCtx)
+		if errSeed != nil {
+			return nil, errSeed
+		}
+		return fetch(seedCtx)
+	})
+	if errSeed != nil {
+		return nil, errSeed
+	}
+	accountFromCache, _ = seeded.(*model.Account)
+	if accountFromCache == nil {
+		return nil, model.AccountSeedRequired
+	}
+
+	// callers sharing a seed must not share the account
+	if shared {
+		return accountFromCache.Clone(), nil
+	}
+	return accountFromCache, nil
 }
 
+// ByUsername sets MovedFrom when username is one the account gave up, see
+// config.Username.HoldPeriod.
 func (af *Fetch) ByUsername(ctx context.Context, username string) (*model.Account, error) {
-	accountFromDB, err := af.accountFetcher.FetchByUsername(ctx, username)
+	usernameKey := af.usernamePolicy.LookupKey(username)
+	accountFromCache, err := af.readThrough(ctx, "username:"+usernameKey,
+		func(ctx context.Context) (*model.Account, error) {
+			return af.accountFetcher.FetchByUsername(ctx, usernameKey)
+		},
+		func(ctx context.Context) error {
+			return af.accountOps.SeedByUsername(ctx, usernameKey)
+		})
 	if err != nil {
 		return nil, err
 	}
+	if accountFromCache.UsernameKey() != usernameKey {
+		accountFromCache.MovedFrom = username
+	}
 
-	return accountFromDB, nil
+	return accountFromCache, nil
 }
 
 func (af *Fetch) ByRandId(ctx context.Context, randId string) (*model.Account, error) {
-	accountFromDB, err := af.accountFetcher.FetchByRandId(ctx, randId)
-	if err != nil {
-		return nil, err
-	}
-	if accountFromDB == nil {
-		return nil, model.AccountSeedRequired
+	return af.readThrough(ctx, "randid:"+randId,
+		func(ctx context.Context) (*model.Account, error) {
+			return af.accountFetcher.FetchByRandId(ctx, randId)
+		},
+		func(ctx context.Context) error {
+			return af.accountOps.SeedByRandId(ctx, randId)
+		})
+}
+
+func (af *Fetch) ByEmail(ctx context.Context, email string) (*model.Account, error) {
+	emailKey := af.emailPolicy.LookupKey(email)
+	return af.readThrough(ctx, "email:"+emailKey,
+		func(ctx context.Context) (*model.Account, error) {
+			return af.accountFetcher.FetchByEmail(ctx, emailKey)
+		},
+		func(ctx context.Context) error {
+			return af.accountOps.SeedByEmail(ctx, emailKey)
+		})
+}
+
+// ByUUID suits callers that only hold the uuid, e.g. from access token claims.
+func (af *Fetch) ByUUID(ctx context.Context, uuid string) (*model.Account, error) {
+	return af.readThrough(ctx, "uuid:"+uuid,
+		func(ctx context.Context) (*model.Account, error) {
+			return af.accountFetcher.FetchByUUID(ctx, uuid)
+		},
+		func(ctx context.Context) error {
+			return af.accountOps.SeedByUUID(ctx, uuid)
+		})
+}
+
+// ByPhone accepts the number in any format NormalizePhone understands.
+func (af *Fetch) ByPhone(ctx context.Context, phone string) (*model.Account, error) {
+	normalized, errNormalize := model.NormalizePhone(phone, af.config.DefaultCountryCode)
+	if errNormalize != nil {
+		return nil, errNormalize
 	}
 
-	return accountFromDB, nil
+	return af.readThrough(ctx, "phone:"+normalized,
+		func(ctx context.Context) (*model.Account, error) {
+			return af.accountFetcher.FetchByPhone(ctx, normalized)
+		},
+		func(ctx context.Context) error {
+			return af.accountOps.SeedByPhone(ctx, normalized)
+		})
 }
 
 type AuthenticationWithPipe struct {
 	authOps  *Authentication
 	pipeline redis.Pipeliner
-	tx       *sql.Tx
+	tx       types.SQLExecutor
 }
 
-func (aup *AuthenticationWithPipe) ByProvider(ctx context.Context, issuer string, sub string, deviceInfo *model.DeviceInfo) (string, string, error) {
+func (aup *AuthenticationWithPipe) ByProvider(ctx context.Context, issuer string, sub string, deviceInfo *model.DeviceInfo) (*model.SignIn, error) {
 	return aup.authOps.byProvider(ctx, aup.pipeline, aup.tx, issuer, sub, deviceInfo)
 }
 
-func (aup *AuthenticationWithPipe) ByUsername(ctx context.Context, username string, password string, deviceInfo *model.DeviceInfo) (string, string, error) {
+func (aup *AuthenticationWithPipe) ByUsername(ctx context.Context, username string, password string, deviceInfo *model.DeviceInfo) (*model.SignIn, error) {
 	return aup.authOps.byUsername(ctx, aup.pipeline, aup.tx, username, password, deviceInfo)
 }
 
-func (aup *AuthenticationWithPipe) ByEmail(ctx context.Context, email string, password string, deviceInfo *model.DeviceInfo) (string, string, error) {
+func (aup *AuthenticationWithPipe) ByEmail(ctx context.Context, email string, password string, deviceInfo *model.DeviceInfo) (*model.SignIn, error) {
 	return aup.authOps.byEmail(ctx, aup.pipeline, aup.tx, email, password, deviceInfo)
 }
 
+func (aup *AuthenticationWithPipe) ByPhone(ctx context.Context, phone string, password string, deviceInfo *model.DeviceInfo) (*model.SignIn, error) {
+	return aup.authOps.byPhone(ctx, aup.pipeline, aup.tx, phone, password, deviceInfo)
+}
+
+// ByPhoneCode counts the guess on the write database, outside the
+// transaction, so do not request the sign in code in the same transaction.
+func (aup *AuthenticationWithPipe) ByPhoneCode(ctx context.Context, phone string, code string, deviceInfo *model.DeviceInfo) (*model.SignIn, error) {
+	return aup.authOps.byPhoneCode(ctx, aup.pipeline, aup.tx, phone, code, deviceInfo)
+}
+
 // TODO: AuthenticationByTransaction belum ke isi
 
 type Authentication struct {
-	writeDB            *sql.DB
-	accountRepository  *repository.AccountRepository
-	providerRepository *repository.ProviderRepository
-	sessionOps         *session.SessionOps
-	config             *config.App
+	writeDB                *sql.DB
+	accountRepository      *repository.AccountRepository
+	providerRepository     *repository.ProviderRepository
+	deviceRepository       *repository.DeviceRepository
+	verificationRepository *repository.VerificationRepository
+	usernamePolicy         *model.UsernamePolicy
+	emailPolicy            *model.EmailPolicy
+	sessionOps             *session.SessionOps
+	events                 *outbox.Emitter
+	config                 *config.App
+	onNewSignIn            func(ctx context.Context, account *model.Account, signIn *model.SignIn)
 }
 
 func (au *Authentication) SetWriteDB(db *sql.DB) {
 	au.writeDB = db
 }
 
-func (au *Authentication) byProvider(ctx context.Context, pipe redis.Pipeliner, db types.SQLExecutor, issuer string, sub string, deviceInfo *model.DeviceInfo) (string, string, error) {
+// OnNewSignIn registers a callback for sign ins from a device or device type
+// the account has not used before, e.g. to send a "new sign-in" notice. On
+// the WithTransaction paths it runs before the caller commits.
+func (au *Authentication) OnNewSignIn(fn func(ctx context.Context, account *model.Account, signIn *model.SignIn)) {
+	au.onNewSignIn = fn
+}
+
+func (au *Authentication) byProvider(ctx context.Context, pipe redis.Pipeliner, db types.SQLExecutor, issuer string, sub string, deviceInfo *model.DeviceInfo) (*model.SignIn, error) {
 	providerFromDB, errFind := au.providerRepository.Find(sub, issuer)
 	if errFind != nil {
-		return "", "", errFind
+		return nil, errFind
 	}
 
 	accountFromDB, errFind := au.accountRepository.FindByUUID(providerFromDB.AccountUUID)
 	if errFind != nil {
-		return "", "", errFind
+		return nil, errFind
 	}
 
-	return au.generateToken(ctx, pipe, db, accountFromDB, deviceInfo.DeviceId, deviceInfo.DeviceType, deviceInfo.UserAgent)
+	return au.generateToken(ctx, pipe, db, accountFromDB, deviceInfo)
 }
 
-func (au *Authentication) ByProvider(ctx context.Context, issuer string, sub string, deviceInfo *model.DeviceInfo) (string, string, error) {
+func (au *Authentication) ByProvider(ctx context.Context, issuer string, sub string, deviceInfo *model.DeviceInfo) (*model.SignIn, error) {
 	return au.byProvider(ctx, nil, au.writeDB, issuer, sub, deviceInfo)
 }
 
-func (au *Authentication) byUsername(ctx context.Context, pipe redis.Pipeliner, db types.SQLExecutor, username string, password string, deviceInfo *model.DeviceInfo) (string, string, error) {
-	accountFromDB, errFindUser := au.accountRepository.FindByUsername(username)
+func (au *Authentication) byUsername(ctx context.Context, pipe redis.Pipeliner, db types.SQLExecutor, username string, password string, deviceInfo *model.DeviceInfo) (*model.SignIn, error) {
+	accountFromDB, errFindUser := au.accountRepository.FindByUsername(au.usernamePolicy.LookupKey(username))
 	if errFindUser != nil {
-		return "", "", errFindUser
+		return nil, errFindUser
 	}
 
 	return au.authenticatePassword(ctx, pipe, db, accountFromDB, password, deviceInfo)
 }
 
-func (au *Authentication) ByUsername(ctx context.Context, db types.SQLExecutor, username string, password string, deviceInfo *model.DeviceInfo) (string, string, error) {
+func (au *Authentication) ByUsername(ctx context.Context, db types.SQLExecutor, username string, password string, deviceInfo *model.DeviceInfo) (*model.SignIn, error) {
 	return au.byUsername(ctx, nil, db, username, password, deviceInfo)
 }
 
-func (au *Authentication) byEmail(ctx context.Context, pipe redis.Pipeliner, db types.SQLExecutor, email string, password string, deviceInfo *model.DeviceInfo) (string, string, error) {
-	accountFromDB, errFindUser := au.accountRepository.FindByEmail(email)
+func (au *Authentication) byEmail(ctx context.Context, pipe redis.Pipeliner, db types.SQLExecutor, email string, password string, deviceInfo *model.DeviceInfo) (*model.SignIn, error) {
+	accountFromDB, errFindUser := au.accountRepository.FindByEmail(au.emailPolicy.LookupKey(email))
 	if errFindUser != nil {
-		return "", "", errFindUser
+		return nil, errFindUser
 	}
 
 	return au.authenticatePassword(ctx, pipe, db, accountFromDB, password, deviceInfo)
 }
 
-func (au *Authentication) ByEmail(ctx context.Context, email string, password string, deviceInfo *model.DeviceInfo) (string, string, error) {
+func (au *Authentication) ByEmail(ctx context.Context, email string, password string, deviceInfo *model.DeviceInfo) (*model.SignIn, error) {
 	return au.byEmail(ctx, nil, au.writeDB, email, password, deviceInfo)
 }
 
-func (au *Authentication) authenticatePassword(ctx context.Context, pipe redis.Pipeliner, db types.SQLExecutor, accountFromDB *model.Account, password string, deviceInfo *model.DeviceInfo) (string, string, error) {
+func (au *Authentication) findByPhone(phone string) (*model.Account, error) {
+	normalized, errNormalize := model.NormalizePhone(phone, au.config.DefaultCountryCode)
+	if errNormalize != nil {
+		return nil, errNormalize
+	}
+	return au.accountRepository.FindByPhone(normalized)
+}
+
+func (au *Authentication) byPhone(ctx context.Context, pipe redis.Pipeliner, db types.SQLExecutor, phone string, password string, deviceInfo *model.DeviceInfo) (*model.SignIn, error) {
+	accountFromDB, errFindUser := au.findByPhone(phone)
+	if errFindUser != nil {
+		return nil, errFindUser
+	}
+
+	return au.authenticatePassword(ctx, pipe, db, accountFromDB, password, deviceInfo)
+}
+
+func (au *Authentication) ByPhone(ctx context.Context, phone string, password string, deviceInfo *model.DeviceInfo) (*model.SignIn, error) {
+	return au.byPhone(ctx, nil, au.writeDB, phone, password, deviceInfo)
+}
+
+// byPhoneCode signs in with a code sent by VerificationOps.RequestSignInCode.
+// The code is single use and burned after too many wrong guesses.
+func (au *Authentication) byPhoneCode(ctx context.Context, pipe redis.Pipeliner, db types.SQLExecutor, phone string, code string, deviceInfo *model.DeviceInfo) (*model.SignIn, error) {
+	accountFromDB, errFindUser := au.findByPhone(phone)
+	if errFindUser != nil {
+		return nil, errFindUser
+	}
+
+	verificationFromDB, errFind := au.verificationRepository.FindByAccount(accountFromDB, model.PhoneSignIn)
+	if errFind != nil {
+		if errors.Is(errFind, model.VerificationNotFound) {
+			return nil, model.Unauthorized
+		}
+		return nil, errFind
+	}
+
+	if verificationFromDB.IsExpired() {
+		return nil, model.VerificationCodeExpired
+	}
+
+	// counted outside db, so rolling it back does not give the attempt back
+	attemptDB := types.SQLExecutor(au.writeDB)
+	if au.writeDB == nil {
+		attemptDB = db
+	}
+	errReserve := au.verificationRepository.ReserveAttempt(ctx, attemptDB, verificationFromDB, au.config.Verification.MaxAttempts)
+	if errReserve != nil {
+		return nil, errReserve
+	}
+
+	errValidate := verificationFromDB.Validate(code)
+	if errValidate != nil {
+		return nil, errValidate
+	}
+
+	errDelete := au.verificationRepository.Delete(ctx, db, verificationFromDB)
+	if errDelete != nil {
+		return nil, errDelete
+	}
+
+	return au.generateToken(ctx, pipe, db, accountFromDB, deviceInfo)
+}
+
+func (au *Authentication) ByPhoneCode(ctx context.Context, phone string, code string, deviceInfo *model.DeviceInfo) (*model.SignIn, error) {
+	return au.byPhoneCode(ctx, nil, au.writeDB, phone, code, deviceInfo)
+}
+
+func (au *Authentication) authenticatePassword(ctx context.Context, pipe redis.Pipeliner, db types.SQLExecutor, accountFromDB *model.Account, password string, deviceInfo *model.DeviceInfo) (*model.SignIn, error) {
+	if !accountFromDB.IsActive() {
+		return nil, model.AccountSuspended
+	}
+
 	isAuthenticated, errVerifyPassword := accountFromDB.VerifyPassword(password)
 	if errVerifyPassword != nil {
-		return "", "", errVerifyPassword
+		return nil, errVerifyPassword
 	}
 	if !isAuthenticated {
-		return "", "", model.Unauthorized
+		return nil, model.Unauthorized
 	}
 
-	return au.generateToken(ctx, pipe, db, accountFromDB, deviceInfo.DeviceId, deviceInfo.DeviceType, deviceInfo.UserAgent)
+	return au.generateToken(ctx, pipe, db, accountFromDB, deviceInfo)
 }
 
-func (au *Authentication) generateToken(ctx context.Context, pipe redis.Pipeliner, db types.SQLExecutor, accountFromDB *model.Account, deviceId string, deviceType string, userAgent string) (string, string, error) {
+func (au *Authentication) generateToken(ctx context.Context, pipe redis.Pipeliner, db types.SQLExecutor, accountFromDB *model.Account, deviceInfo *model.DeviceInfo) (*model.SignIn, error) {
+	if !accountFromDB.IsActive() {
+		return nil, model.AccountSuspended
+	}
+
 	session := model.NewSession()
-	session.SetDeviceId(deviceId)
-	session.SetDeviceType(deviceType)
-	session.SetUserAgent(userAgent)
+	session.SetDeviceId(deviceInfo.DeviceId)
+	session.SetDeviceType(deviceInfo.DeviceType)
+	session.SetUserAgent(deviceInfo.UserAgent)
 	session.SetAccountUUID(accountFromDB.GetUUID())
 	session.SetLastActiveAt(time.Now().UTC())
 	session.SetLifeSpan(au.config.TokenLifespan)
+	session.CapLifeSpan(au.config.SessionMaxLifetime)
 	errGenerateToken := session.GenerateRefreshToken()
 	if errGenerateToken != nil {
-		return "", "", errGenerateToken
+		return nil, errGenerateToken
 	}
 
-	var errCreateSession error
-	if pipe != nil {
-		errCreateSession = au.sessionOps.WithTransaction(pipe, db.(*sql.Tx)).Create(ctx, session)
-	} else {
-		errCreateSession = au.sessionOps.Create(ctx, session)
-	}
+	errCreateSession := au.sessionOps.WithTransaction(pipe, db).Create(ctx, session)
 	if errCreateSession != nil {
-		return "", "", errCreateSession
+		return nil, errCreateSession
 	}
 
 	accessToken, errGenerateAccToken := accountFromDB.GenerateAccessToken(
 		au.config.JWTSecret,
 		au.config.JWTIssuer,
 		au.config.JWTLifespan,
-		session.GetRandId())
+		session.GetRandId(),
+		au.config.JWTAttributes)
 	if errGenerateAccToken != nil {
-		return "", "", errGenerateAccToken
+		return nil, errGenerateAccToken
 	}
 
-	return accessToken, session.RefreshToken, nil
+	signIn := &model.SignIn{
+		AccessToken:   accessToken,
+		RefreshToken:  session.RefreshToken,
+		SessionRandId: session.GetRandId(),
+		Device:        *deviceInfo,
+	}
+	if deviceInfo.DeviceId != "" {
+		newDevice, newDeviceType, errRecord := au.deviceRepository.Record(ctx, db, accountFromDB.GetUUID(), deviceInfo)
+		if errRecord != nil {
+			return nil, errRecord
+		}
+		signIn.NewDevice = newDevice
+		signIn.NewDeviceType = newDeviceType
+	}
+
+	if signIn.IsUnrecognised() {
+		if au.onNewSignIn != nil {
+			au.onNewSignIn(ctx, accountFromDB, signIn)
+		}
+		errEmit := au.events.Emit(ctx, db, event.NewDeviceSignIn{Account: accountFromDB, SignIn: signIn, OccurredAt: time.Now().UTC()})
+		if errEmit != nil {
+			return nil, errEmit
+		}
+	}
+
+	return signIn, nil
 }
 
-func (au *Authentication) WithTransaction(pipe redis.Pipeliner, db *sql.Tx) *AuthenticationWithPipe {
+func (au *Authentication) WithTransaction(pipe redis.Pipeliner, db types.SQLExecutor) *AuthenticationWithPipe {
 	return &AuthenticationWithPipe{authOps: au, pipeline: pipe, tx: db}
 }
 
-func New(accountRepository *repository.AccountRepository, providerRepository *repository.ProviderRepository, accountFetcher *fetcher.AccountFetcher, sessionOps *session.SessionOps, config *config.App) *AccountOps {
+func New(accountRepository *repository.AccountRepository, providerRepository *repository.ProviderRepository, usernameHistoryRepository *repository.UsernameHistoryRepository, deviceRepository *repository.DeviceRepository, verificationRepository *repository.VerificationRepository, accountFetcher *fetcher.AccountFetcher, sessionOps *session.SessionOps, events *outbox.Emitter, config *config.App) *AccountOps {
+	usernamePolicy := model.NewUsernamePolicy(config.Username)
+	emailPolicy := model.NewEmailPolicy(config.Email)
 	authenticate := &Authentication{
-		accountRepository:  accountRepository,
-		providerRepository: providerRepository,
-		sessionOps:         sessionOps,
-		config:             config,
+		accountRepository:      accountRepository,
+		providerRepository:     providerRepository,
+		deviceRepository:       deviceRepository,
+		verificationRepository: verificationRepository,
+		usernamePolicy:         usernamePolicy,
+		emailPolicy:            emailPolicy,
+		sessionOps:             sessionOps,
+		events:                 events,
+		config:                 config,
+	}
+	accountFinder := &Find{
+		accountRepository:         accountRepository,
+		usernameHistoryRepository: usernameHistoryRepository,
+		usernamePolicy:            usernamePolicy,
+		emailPolicy:               emailPolicy,
+		config:                    config,
 	}
-	accountFinder := &Find{accountRepository: accountRepository}
-	accountFetchers := &Fetch{accountFetcher: accountFetcher}
+	accountFetchers := &Fetch{accountFetcher: accountFetcher, usernamePolicy: usernamePolicy, emailPolicy: emailPolicy, config: config}
 
-	return &AccountOps{
-		accountRepository:  accountRepository,
-		providerRepository: providerRepository,
-		accountFetcher:     accountFetcher,
-		config:             config,
+	accountOps := &AccountOps{
+		accountRepository:         accountRepository,
+		providerRepository:        providerRepository,
+		usernameHistoryRepository: usernameHistoryRepository,
+		accountFetcher:            accountFetcher,
+		sessionOps:                sessionOps,
+		events:                    events,
+		usernamePolicy:            usernamePolicy,
+		emailPolicy:               emailPolicy,
+		config:                    config,
 
 		Authenticate: authenticate,
 		Find:         accountFinder,
 		Fetch:        accountFetchers,
 	}
+	accountFetchers.accountOps = accountOps
+	return accountOps
 }
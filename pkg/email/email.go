@@ -8,25 +8,30 @@ import (
 	"github.com/21strive/commonuser/internal/repository"
 	"github.com/21strive/commonuser/internal/types"
 	"github.com/21strive/commonuser/pkg/account"
+	"github.com/21strive/commonuser/pkg/event"
+	"github.com/21strive/commonuser/pkg/notify"
+	"github.com/21strive/commonuser/pkg/outbox"
 	"github.com/21strive/commonuser/pkg/session"
 	"github.com/redis/go-redis/v9"
+	"time"
 )
 
 type WithTransaction struct {
 	EmailOps *EmailOps
-	Tx       *sql.Tx
+	Pipeline redis.Pipeliner
+	Tx       types.SQLExecutor
 }
 
 func (w *WithTransaction) RequestEmailChange(ctx context.Context, account *model.Account, newEmailAddress string) (*model.UpdateEmail, error) {
 	return w.EmailOps.requestEmailChange(ctx, w.Tx, account, newEmailAddress)
 }
 
-func (w *WithTransaction) ConfirmEmailChange(ctx context.Context, pipe redis.Pipeliner, account *model.Account, token string) error {
-	return w.EmailOps.confirmEmailChange(ctx, pipe, w.Tx, account, token)
+func (w *WithTransaction) ConfirmEmailChange(ctx context.Context, account *model.Account, token string) error {
+	return w.EmailOps.confirmEmailChange(ctx, w.Pipeline, w.Tx, account, token)
 }
 
-func (w *WithTransaction) RevokeEmailChange(ctx context.Context, pipe redis.Pipeliner, account *model.Account, revokeToken string) error {
-	return w.EmailOps.revokeEmailChange(ctx, pipe, w.Tx, account, revokeToken)
+func (w *WithTransaction) RevokeEmailChange(ctx context.Context, account *model.Account, revokeToken string) error {
+	return w.EmailOps.revokeEmailChange(ctx, w.Pipeline, w.Tx, account, revokeToken)
 }
 
 func (w *WithTransaction) DeleteEmailChange(ctx context.Context, account *model.Account) error {
@@ -38,13 +43,54 @@ type EmailOps struct {
 	updateEmailRepository *repository.UpdateEmailRepository
 	accountOps            *account.AccountOps
 	sessionOps            *session.SessionOps
+	events                *outbox.Emitter
+	notifier              notify.Notifier
 }
 
 func (e *EmailOps) SetWriteDB(db *sql.DB) {
 	e.writeDB = db
 }
 
+func (e *EmailOps) WithTransaction(pipe redis.Pipeliner, db types.SQLExecutor) *WithTransaction {
+	return &WithTransaction{EmailOps: e, Pipeline: pipe, Tx: db}
+}
+
+// SetNotifier sends the confirmation token to the new address and the revoke
+// token to the previous one whenever an email change is requested.
+func (e *EmailOps) SetNotifier(notifier notify.Notifier) {
+	e.notifier = notifier
+}
+
+func (e *EmailOps) sendTokens(ctx context.Context, account *model.Account, request *model.UpdateEmail, token string, revokeToken string) error {
+	if e.notifier == nil {
+		return nil
+	}
+	errSend := e.notifier.Notify(ctx, notify.Notification{
+		Kind:      notify.EmailChange,
+		Channel:   notify.Email,
+		To:        request.NewEmailAddress,
+		Account:   account,
+		Secret:    token,
+		ExpiresAt: request.ExpiredAt,
+	})
+	if errSend != nil {
+		return errSend
+	}
+	return e.notifier.Notify(ctx, notify.Notification{
+		Kind:      notify.EmailChangeRevoke,
+		Channel:   notify.Email,
+		To:        request.PreviousEmailAddress,
+		Account:   account,
+		Secret:    revokeToken,
+		ExpiresAt: request.ExpiredAt,
+	})
+}
+
 func (e *EmailOps) requestEmailChange(ctx context.Context, db types.SQLExecutor, account *model.Account, newEmailAddress string) (*model.UpdateEmail, error) {
+	errCheck := e.accountOps.CheckEmail(ctx, account, newEmailAddress)
+	if errCheck != nil {
+		return nil, errCheck
+	}
 
 	requestFromDB, errFind := e.updateEmailRepository.FindRequest(account)
 	if errFind != nil {
@@ -52,14 +98,12 @@ func (e *EmailOps) requestEmailChange(ctx context.Context, db types.SQLExecutor,
 			return nil, errFind
 		}
 	}
+	// only the hashes of the tokens are stored, so a pending request is
+	// replaced to have tokens to send
 	if requestFromDB != nil {
-		if requestFromDB.IsExpired() {
-			errDeleteRequest := e.updateEmailRepository.DeleteAllRequest(ctx, db, account)
-			if errDeleteRequest != nil {
-				return nil, errDeleteRequest
-			}
-		} else {
-			return requestFromDB, nil
+		errDeleteRequest := e.updateEmailRepository.DeleteAllRequest(ctx, db, account)
+		if errDeleteRequest != nil {
+			return nil, errDeleteRequest
 		}
 	}
 
@@ -68,11 +112,11 @@ func (e *EmailOps) requestEmailChange(ctx context.Context, db types.SQLExecutor,
 	updateEmailRequest.SetPreviousEmailAddress(account.Base.Email)
 	updateEmailRequest.SetNewEmailAddress(newEmailAddress)
 	updateEmailRequest.SetExpiration()
-	_, errGen := updateEmailRequest.SetToken()
+	token, errGen := updateEmailRequest.SetToken()
 	if errGen != nil {
 		return nil, errGen
 	}
-	_, errGen = updateEmailRequest.SetRevokeToken()
+	revokeToken, errGen := updateEmailRequest.SetRevokeToken()
 	if errGen != nil {
 		return nil, errGen
 	}
@@ -82,6 +126,11 @@ func (e *EmailOps) requestEmailChange(ctx context.Context, db types.SQLExecutor,
 		return nil, errCreateTicket
 	}
 
+	errSend := e.sendTokens(ctx, account, updateEmailRequest, token, revokeToken)
+	if errSend != nil {
+		return nil, errSend
+	}
+
 	return updateEmailRequest, nil
 }
 
@@ -111,6 +160,12 @@ func (e *EmailOps) confirmEmailChange(ctx context.Context, pipe redis.Pipeliner,
 		return errValidate
 	}
 
+	// the address may have been taken since the change was requested
+	errCheck := e.accountOps.CheckEmail(ctx, account, request.NewEmailAddress)
+	if errCheck != nil {
+		return errCheck
+	}
+
 	request.SetProcessed()
 	errUpdateTicket := e.updateEmailRepository.UpdateRequest(ctx, db, request)
 	if errUpdateTicket != nil {
@@ -118,19 +173,25 @@ func (e *EmailOps) confirmEmailChange(ctx context.Context, pipe redis.Pipeliner,
 	}
 
 	// revoke all running sessions
-	var errRevoke error
-	if pipe != nil {
-		errRevoke = e.sessionOps.WithTransaction(pipe, db.(*sql.Tx)).RevokeAll(ctx, account)
-	} else {
-		errRevoke = e.sessionOps.RevokeAll(ctx, account)
-	}
+	_, errRevoke := e.sessionOps.WithTransaction(pipe, db).RevokeAll(ctx, account)
 	if errRevoke != nil {
 		return errRevoke
 	}
 
 	account.SetEmail(request.NewEmailAddress)
+	errUpdateAccount := e.accountOps.WithTransaction(pipe, db).Update(ctx, account)
+	if errUpdateAccount != nil {
+		return errUpdateAccount
+	}
 
-	return nil
+	// recorded on db, so the event only goes out when the new address is
+	// committed with it
+	return e.events.Emit(ctx, db, event.EmailChanged{
+		Account:       account,
+		PreviousEmail: request.PreviousEmailAddress,
+		NewEmail:      request.NewEmailAddress,
+		OccurredAt:    time.Now().UTC(),
+	})
 }
 
 func (e *EmailOps) ConfirmEmailChange(ctx context.Context, account *model.Account, token string) error {
@@ -156,18 +217,23 @@ func (e *EmailOps) revokeEmailChange(ctx context.Context, pipe redis.Pipeliner,
 		return errDeleteTicket
 	}
 
-	var errRevoke error
-	if pipe != nil {
-		errRevoke = e.sessionOps.WithTransaction(pipe, db.(*sql.Tx)).RevokeAll(ctx, account)
-	} else {
-		errRevoke = e.sessionOps.RevokeAll(ctx, account)
-	}
-
+	_, errRevoke := e.sessionOps.WithTransaction(pipe, db).RevokeAll(ctx, account)
 	if errRevoke != nil {
 		return errRevoke
 	}
 
-	return nil
+	errUpdateAccount := e.accountOps.WithTransaction(pipe, db).Update(ctx, account)
+	if errUpdateAccount != nil {
+		return errUpdateAccount
+	}
+
+	return e.events.Emit(ctx, db, event.EmailChanged{
+		Account:       account,
+		PreviousEmail: request.NewEmailAddress,
+		NewEmail:      request.PreviousEmailAddress,
+		Reverted:      true,
+		OccurredAt:    time.Now().UTC(),
+	})
 }
 
 func (e *EmailOps) RevokeEmailChange(ctx context.Context, account *model.Account, revokeToken string) error {
@@ -182,10 +248,11 @@ func (e *EmailOps) DeleteEmailChange(ctx context.Context, account *model.Account
 	return e.deleteEmailChange(ctx, e.writeDB, account)
 }
 
-func New(updateEmailRepository *repository.UpdateEmailRepository, accountOps *account.AccountOps, sessionOps *session.SessionOps) *EmailOps {
+func New(updateEmailRepository *repository.UpdateEmailRepository, accountOps *account.AccountOps, sessionOps *session.SessionOps, events *outbox.Emitter) *EmailOps {
 	return &EmailOps{
 		updateEmailRepository: updateEmailRepository,
 		accountOps:            accountOps,
 		sessionOps:            sessionOps,
+		events:                events,
 	}
 }
@@ -0,0 +1,118 @@
+package event
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+type handler struct {
+	fn    func(ctx context.Context, e Event) error
+	async bool
+}
+
+// Bus delivers events to the subscribers of their type. Synchronous
+// subscribers run in registration order before Publish returns; asynchronous
+// ones each run on their own goroutine. Subscriber errors never reach the
+// publisher, they go to the OnError callback instead. A nil *Bus drops every
+// event.
+type Bus struct {
+	mu       sync.RWMutex
+	handlers map[string][]handler
+	onError  func(e Event, err error)
+	inflight sync.WaitGroup
+}
+
+// OnError registers the callback that receives subscriber errors and panics.
+func (b *Bus) OnError(fn func(e Event, err error)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.onError = fn
+}
+
+func (b *Bus) subscribe(name string, h handler) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.handlers[name] = append(b.handlers[name], h)
+}
+
+// Subscribe registers fn to run synchronously for every published E.
+func Subscribe[E Event](b *Bus, fn func(ctx context.Context, e E) error) {
+	var zero E
+	b.subscribe(zero.Name(), handler{fn: typed(fn)})
+}
+
+// SubscribeAsync registers fn to run on its own goroutine for every published
+// E. The context passed to fn is detached from the publisher's cancellation.
+func SubscribeAsync[E Event](b *Bus, fn func(ctx context.Context, e E) error) {
+	var zero E
+	b.subscribe(zero.Name(), handler{fn: typed(fn), async: true})
+}
+
+func typed[E Event](fn func(ctx context.Context, e E) error) func(ctx context.Context, e Event) error {
+	return func(ctx context.Context, e Event) error {
+		typedEvent, ok := e.(E)
+		if !ok {
+			return fmt.Errorf("event %s has unexpected type %T", e.Name(), e)
+		}
+		return fn(ctx, typedEvent)
+	}
+}
+
+func (b *Bus) Publish(ctx context.Context, e Event) {
+	if b == nil {
+		return
+	}
+
+	b.mu.RLock()
+	handlers := b.handlers[e.Name()]
+	b.mu.RUnlock()
+
+	for _, h := range handlers {
+		if !h.async {
+			b.deliver(ctx, h, e)
+			continue
+		}
+
+		b.inflight.Add(1)
+		go func(h handler) {
+			defer b.inflight.Done()
+			b.deliver(context.WithoutCancel(ctx), h, e)
+		}(h)
+	}
+}
+
+func (b *Bus) deliver(ctx context.Context, h handler, e Event) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			b.reportError(e, fmt.Errorf("subscriber of %s panicked: %v", e.Name(), recovered))
+		}
+	}()
+
+	if err := h.fn(ctx, e); err != nil {
+		b.reportError(e, err)
+	}
+}
+
+func (b *Bus) reportError(e Event, err error) {
+	b.mu.RLock()
+	onError := b.onError
+	b.mu.RUnlock()
+
+	if onError != nil {
+		onError(e, err)
+	}
+}
+
+// Wait blocks until every asynchronous subscriber started so far has
+// returned. Call it on shutdown.
+func (b *Bus) Wait() {
+	if b == nil {
+		return
+	}
+	b.inflight.Wait()
+}
+
+func NewBus() *Bus {
+	return &Bus{handlers: make(map[string][]handler)}
+}
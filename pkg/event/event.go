@@ -0,0 +1,136 @@
+package event
+
+import (
+	"encoding/json"
+	"github.com/21strive/commonuser/internal/model"
+	"time"
+)
+
+// Event is anything published on a Bus. Name identifies the event type and is
+// what subscribers are keyed by.
+type Event interface {
+	Name() string
+}
+
+// Why a session was revoked, see SessionRevoked.
+const (
+	RevokedBySignOut    = "sign_out"
+	RevokedByAccount    = "sign_out_everywhere"
+	RevokedBySessionCap = "session_limit"
+)
+
+type AccountRegistered struct {
+	Account    *model.Account `json:"account"`
+	OccurredAt time.Time      `json:"occurredAt"`
+}
+
+func (AccountRegistered) Name() string { return "account.registered" }
+
+type AccountDeleted struct {
+	Account    *model.Account `json:"account"`
+	OccurredAt time.Time      `json:"occurredAt"`
+}
+
+func (AccountDeleted) Name() string { return "account.deleted" }
+
+type EmailVerified struct {
+	Account    *model.Account `json:"account"`
+	OccurredAt time.Time      `json:"occurredAt"`
+}
+
+func (EmailVerified) Name() string { return "account.email_verified" }
+
+type PhoneVerified struct {
+	Account    *model.Account `json:"account"`
+	OccurredAt time.Time      `json:"occurredAt"`
+}
+
+func (PhoneVerified) Name() string { return "account.phone_verified" }
+
+// EmailChanged is published when an email change is confirmed, and again with
+// Reverted set when the owner of the previous address revokes it.
+type EmailChanged struct {
+	Account       *model.Account `json:"account"`
+	PreviousEmail string         `json:"previousEmail"`
+	NewEmail      string         `json:"newEmail"`
+	Reverted      bool           `json:"reverted"`
+	OccurredAt    time.Time      `json:"occurredAt"`
+}
+
+func (EmailChanged) Name() string { return "account.email_changed" }
+
+// UsernameChanged is published when an account moves to another username.
+// Overridden is set when an administrator bypassed the change cooldown and
+// the hold on the new name.
+type UsernameChanged struct {
+	Account          *model.Account `json:"account"`
+	PreviousUsername string         `json:"previousUsername"`
+	NewUsername      string         `json:"newUsername"`
+	Overridden       bool           `json:"overridden"`
+	OccurredAt       time.Time      `json:"occurredAt"`
+}
+
+func (UsernameChanged) Name() string { return "account.username_changed" }
+
+// PasswordReset is published when a password is replaced through a reset
+// ticket, PasswordChanged when the owner changes it with the old password.
+type PasswordReset struct {
+	Account    *model.Account `json:"account"`
+	OccurredAt time.Time      `json:"occurredAt"`
+}
+
+func (PasswordReset) Name() string { return "account.password_reset" }
+
+type PasswordChanged struct {
+	Account    *model.Account `json:"account"`
+	OccurredAt time.Time      `json:"occurredAt"`
+}
+
+func (PasswordChanged) Name() string { return "account.password_changed" }
+
+type SessionCreated struct {
+	Session    *model.Session `json:"session"`
+	OccurredAt time.Time      `json:"occurredAt"`
+}
+
+func (SessionCreated) Name() string { return "session.created" }
+
+// MarshalJSON leaves the refresh token out of serialised events.
+func (e SessionCreated) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		AccountUUID string              `json:"accountUUID"`
+		Session     model.SessionDevice `json:"session"`
+		OccurredAt  time.Time           `json:"occurredAt"`
+	}{e.Session.AccountUUID, e.Session.Device(""), e.OccurredAt})
+}
+
+type SessionRevoked struct {
+	AccountUUID    string    `json:"accountUUID"`
+	SessionRandIds []string  `json:"sessionRandIds"`
+	Reason         string    `json:"reason"`
+	OccurredAt     time.Time `json:"occurredAt"`
+}
+
+func (SessionRevoked) Name() string { return "session.revoked" }
+
+// NewDeviceSignIn is published for sign ins that model.SignIn reports as
+// unrecognised.
+type NewDeviceSignIn struct {
+	Account    *model.Account `json:"account"`
+	SignIn     *model.SignIn  `json:"signIn"`
+	OccurredAt time.Time      `json:"occurredAt"`
+}
+
+func (NewDeviceSignIn) Name() string { return "session.new_device_sign_in" }
+
+// MarshalJSON leaves the issued tokens out of serialised events.
+func (e NewDeviceSignIn) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Account       *model.Account   `json:"account"`
+		SessionRandId string           `json:"sessionRandId"`
+		Device        model.DeviceInfo `json:"device"`
+		NewDevice     bool             `json:"newDevice"`
+		NewDeviceType bool             `json:"newDeviceType"`
+		OccurredAt    time.Time        `json:"occurredAt"`
+	}{e.Account, e.SignIn.SessionRandId, e.SignIn.Device, e.SignIn.NewDevice, e.SignIn.NewDeviceType, e.OccurredAt})
+}
@@ -0,0 +1,229 @@
+package janitor
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"github.com/21strive/commonuser/config"
+	"github.com/21strive/commonuser/internal/repository"
+	"github.com/redis/go-redis/v9"
+	"sync"
+	"time"
+)
+
+const (
+	defaultInterval  = time.Minute * 10
+	defaultBatchSize = 500
+)
+
+var SweepInProgress = errors.New("another replica is sweeping")
+
+// releaseLock deletes the lock only while it still holds our token, so a
+// sweep that outlived its lock never releases another replica's.
+var releaseLock = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0`)
+
+// Report counts the rows removed by one sweep. Err is set when the sweep
+// stopped early; the counts still cover what was removed before that.
+type Report struct {
+	StartedAt      time.Time
+	Duration       time.Duration
+	Sessions       int
+	ResetPasswords int
+	UpdateEmails   int
+	Verifications  int
+	Err            error
+}
+
+type Janitor struct {
+	writeDB                 *sql.DB
+	redis                   redis.UniversalClient
+	sessionRepository       *repository.SessionRepository
+	resetPasswordRepository *repository.ResetPasswordRepository
+	updateEmailRepository   *repository.UpdateEmailRepository
+	verificationRepository  *repository.VerificationRepository
+	config                  *config.App
+	onReport                func(Report)
+
+	mu   sync.Mutex
+	stop context.CancelFunc
+	done chan struct{}
+}
+
+func (j *Janitor) SetWriteDB(db *sql.DB) {
+	j.writeDB = db
+}
+
+// OnReport registers a callback that receives the result of every sweep this
+// replica runs, including failed ones.
+func (j *Janitor) OnReport(fn func(Report)) {
+	j.onReport = fn
+}
+
+func (j *Janitor) interval() time.Duration {
+	if j.config.Janitor.Interval > 0 {
+		return j.config.Janitor.Interval
+	}
+	return defaultInterval
+}
+
+func (j *Janitor) batchSize() int {
+	if j.config.Janitor.BatchSize > 0 {
+		return j.config.Janitor.BatchSize
+	}
+	return defaultBatchSize
+}
+
+func (j *Janitor) lockKey() string {
+	return j.config.EntityName + ":janitor:lock"
+}
+
+// Start runs a sweep every interval until ctx is cancelled or Stop is called.
+// Calling Start on a running janitor does nothing.
+func (j *Janitor) Start(ctx context.Context) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.stop != nil {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	j.stop = cancel
+	j.done = make(chan struct{})
+	go j.run(ctx, j.done)
+}
+
+// Stop ends the loop started by Start and waits for a running sweep to finish.
+func (j *Janitor) Stop() {
+	j.mu.Lock()
+	stop, done := j.stop, j.done
+	j.stop, j.done = nil, nil
+	j.mu.Unlock()
+
+	if stop == nil {
+		return
+	}
+	stop()
+	<-done
+}
+
+func (j *Janitor) run(ctx context.Context, done chan struct{}) {
+	defer close(done)
+
+	ticker := time.NewTicker(j.interval())
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			report, errSweep := j.Sweep(ctx)
+			if errors.Is(errSweep, SweepInProgress) || report == nil {
+				continue
+			}
+			if j.onReport != nil {
+				j.onReport(*report)
+			}
+		}
+	}
+}
+
+// Sweep purges every expired artifact once, in batches, if no other replica
+// holds the janitor lock. It returns SweepInProgress otherwise. Any other
+// failure comes with a report carrying the error.
+func (j *Janitor) Sweep(ctx context.Context) (*Report, error) {
+	token, errToken := lockToken()
+	if errToken != nil {
+		return &Report{StartedAt: time.Now().UTC(), Err: errToken}, errToken
+	}
+
+	acquired, errLock := j.redis.SetNX(ctx, j.lockKey(), token, j.interval()).Result()
+	if errLock != nil {
+		return &Report{StartedAt: time.Now().UTC(), Err: errLock}, errLock
+	}
+	if !acquired {
+		return nil, SweepInProgress
+	}
+	defer releaseLock.Run(context.WithoutCancel(ctx), j.redis, []string{j.lockKey()}, token)
+
+	report := &Report{StartedAt: time.Now().UTC()}
+	report.Err = j.sweep(ctx, report)
+	report.Duration = time.Since(report.StartedAt)
+
+	return report, report.Err
+}
+
+func (j *Janitor) sweep(ctx context.Context, report *Report) error {
+	var errPurge error
+	report.Sessions, errPurge = j.purge(ctx, func(batchSize int) (int, error) {
+		return j.sessionRepository.PurgeExpired(ctx, j.writeDB, batchSize)
+	})
+	if errPurge != nil {
+		return errPurge
+	}
+
+	report.ResetPasswords, errPurge = j.purge(ctx, func(batchSize int) (int, error) {
+		return j.resetPasswordRepository.PurgeExpired(ctx, j.writeDB, batchSize)
+	})
+	if errPurge != nil {
+		return errPurge
+	}
+
+	report.UpdateEmails, errPurge = j.purge(ctx, func(batchSize int) (int, error) {
+		return j.updateEmailRepository.PurgeExpired(ctx, j.writeDB, batchSize)
+	})
+	if errPurge != nil {
+		return errPurge
+	}
+
+	report.Verifications, errPurge = j.purge(ctx, func(batchSize int) (int, error) {
+		return j.verificationRepository.PurgeStale(ctx, j.writeDB, batchSize)
+	})
+	return errPurge
+}
+
+// purge repeats a batch until it comes back short, so each statement holds
+// its row locks only briefly.
+func (j *Janitor) purge(ctx context.Context, batch func(batchSize int) (int, error)) (int, error) {
+	batchSize := j.batchSize()
+	var total int
+	for {
+		if errCtx := ctx.Err(); errCtx != nil {
+			return total, errCtx
+		}
+
+		purged, errBatch := batch(batchSize)
+		total += purged
+		if errBatch != nil {
+			return total, errBatch
+		}
+		if purged < batchSize {
+			return total, nil
+		}
+	}
+}
+
+func lockToken() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+func New(redis redis.UniversalClient, sessionRepository *repository.SessionRepository, resetPasswordRepository *repository.ResetPasswordRepository, updateEmailRepository *repository.UpdateEmailRepository, verificationRepository *repository.VerificationRepository, config *config.App) *Janitor {
+	return &Janitor{
+		redis:                   redis,
+		sessionRepository:       sessionRepository,
+		resetPasswordRepository: resetPasswordRepository,
+		updateEmailRepository:   updateEmailRepository,
+		verificationRepository:  verificationRepository,
+		config:                  config,
+	}
+}
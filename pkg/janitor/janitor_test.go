@@ -0,0 +1,52 @@
+package janitor
+
+import (
+	"context"
+	"github.com/21strive/commonuser/config"
+	"github.com/redis/go-redis/v9"
+	"testing"
+	"time"
+)
+
+// unreachable fails every command at once instead of retrying.
+func unreachable() redis.UniversalClient {
+	return redis.NewClient(&redis.Options{Addr: "127.0.0.1:1", MaxRetries: -1, DialTimeout: 100 * time.Millisecond})
+}
+
+func TestSweepReportsLockFailure(t *testing.T) {
+	app := config.DefaultConfig("user", "secret", "test", time.Minute)
+	janitor := New(unreachable(), nil, nil, nil, nil, app)
+
+	report, err := janitor.Sweep(context.Background())
+	if err == nil {
+		t.Fatal("Sweep succeeded without Redis")
+	}
+	if report == nil || report.Err != err {
+		t.Fatalf("Sweep report = %+v, want one carrying %v", report, err)
+	}
+}
+
+func TestRunSurvivesLockFailure(t *testing.T) {
+	app := config.DefaultConfig("user", "secret", "test", time.Minute)
+	app.Janitor.Interval = 10 * time.Millisecond
+	janitor := New(unreachable(), nil, nil, nil, nil, app)
+
+	reports := make(chan Report, 1)
+	janitor.OnReport(func(report Report) {
+		select {
+		case reports <- report:
+		default:
+		}
+	})
+	janitor.Start(context.Background())
+	defer janitor.Stop()
+
+	select {
+	case report := <-reports:
+		if report.Err == nil {
+			t.Fatal("report of a failed sweep carries no error")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no report of the failed sweep")
+	}
+}
@@ -0,0 +1,80 @@
+package notify
+
+import (
+	"context"
+	"errors"
+	"github.com/21strive/commonuser/internal/model"
+	"time"
+)
+
+type Channel string
+
+const (
+	Email Channel = "email"
+	SMS   Channel = "sms"
+)
+
+// Kind names the message being sent and selects its template.
+type Kind string
+
+const (
+	VerificationCode  Kind = "verification_code"
+	ResetPassword     Kind = "reset_password"
+	EmailChange       Kind = "email_change"
+	EmailChangeRevoke Kind = "email_change_revoke"
+	SignInCode        Kind = "sign_in_code"
+)
+
+var TemplateNotFound = errors.New("notification template not found")
+
+// Notification carries the raw secret of a verification code, reset token or
+// email change token. It is the only place the secret exists in plain text;
+// only its hash is stored.
+type Notification struct {
+	Kind      Kind
+	Channel   Channel
+	To        string
+	Account   *model.Account
+	Secret    string
+	ExpiresAt time.Time
+}
+
+// Notifier delivers notifications. The flows in pkg/verification,
+// pkg/password and pkg/email call it after storing the hashed secret and
+// return its error, so a transactional caller can roll back.
+type Notifier interface {
+	Notify(ctx context.Context, notification Notification) error
+}
+
+// Message is a rendered notification ready for a Transport.
+type Message struct {
+	Kind    Kind    `json:"kind"`
+	Channel Channel `json:"channel"`
+	To      string  `json:"to"`
+	Subject string  `json:"subject,omitempty"`
+	Body    string  `json:"body"`
+}
+
+// Transport sends rendered messages, e.g. through SMTP or an SMS gateway.
+type Transport interface {
+	Send(ctx context.Context, message Message) error
+}
+
+// TemplateNotifier renders notifications with Templates and hands the result
+// to a Transport.
+type TemplateNotifier struct {
+	templates *Templates
+	transport Transport
+}
+
+func (n *TemplateNotifier) Notify(ctx context.Context, notification Notification) error {
+	message, errRender := n.templates.Render(notification)
+	if errRender != nil {
+		return errRender
+	}
+	return n.transport.Send(ctx, *message)
+}
+
+func New(templates *Templates, transport Transport) *TemplateNotifier {
+	return &TemplateNotifier{templates: templates, transport: transport}
+}
@@ -0,0 +1,109 @@
+package notify
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"strings"
+	"sync"
+)
+
+type templateKey struct {
+	kind    Kind
+	channel Channel
+}
+
+type messageTemplate struct {
+	subject *template.Template
+	body    *template.Template
+}
+
+// Templates holds one subject and body template per message kind and
+// channel. Both are html/template templates executed with the Notification,
+// so {{.Secret}}, {{.To}}, {{.ExpiresAt}} and {{.Account.Name}} are available.
+type Templates struct {
+	mu        sync.RWMutex
+	templates map[templateKey]messageTemplate
+}
+
+// Set parses and registers the templates for kind on channel, replacing any
+// previous ones. SMS messages have no subject; pass an empty string.
+func (t *Templates) Set(kind Kind, channel Channel, subject string, body string) error {
+	name := string(kind) + "." + string(channel)
+	subjectTemplate, errSubject := template.New(name + ".subject").Parse(subject)
+	if errSubject != nil {
+		return errSubject
+	}
+	bodyTemplate, errBody := template.New(name + ".body").Parse(body)
+	if errBody != nil {
+		return errBody
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.templates[templateKey{kind, channel}] = messageTemplate{subject: subjectTemplate, body: bodyTemplate}
+	return nil
+}
+
+func (t *Templates) Render(notification Notification) (*Message, error) {
+	t.mu.RLock()
+	tmpl, found := t.templates[templateKey{notification.Kind, notification.Channel}]
+	t.mu.RUnlock()
+	if !found {
+		return nil, fmt.Errorf("%w: %s over %s", TemplateNotFound, notification.Kind, notification.Channel)
+	}
+
+	var subject, body bytes.Buffer
+	if errSubject := tmpl.subject.Execute(&subject, notification); errSubject != nil {
+		return nil, errSubject
+	}
+	if errBody := tmpl.body.Execute(&body, notification); errBody != nil {
+		return nil, errBody
+	}
+
+	return &Message{
+		Kind:    notification.Kind,
+		Channel: notification.Channel,
+		To:      notification.To,
+		Subject: strings.TrimSpace(subject.String()),
+		Body:    body.String(),
+	}, nil
+}
+
+func NewTemplates() *Templates {
+	return &Templates{templates: make(map[templateKey]messageTemplate)}
+}
+
+// DefaultTemplates returns plain English templates for every message kind,
+// meant as a starting point and for local development.
+func DefaultTemplates() *Templates {
+	t := NewTemplates()
+	defaults := []struct {
+		kind    Kind
+		channel Channel
+		subject string
+		body    string
+	}{
+		{VerificationCode, Email, `Your verification code`,
+			`<p>Your verification code is <strong>{{.Secret}}</strong>.</p>`},
+		{VerificationCode, SMS, ``,
+			`Your verification code is {{.Secret}}`},
+		{SignInCode, SMS, ``,
+			`Your sign in code is {{.Secret}}. Do not share it with anyone.`},
+		{ResetPassword, Email, `Reset your password`,
+			`<p>Use this token to reset your password: <strong>{{.Secret}}</strong></p>` +
+				`<p>It expires at {{.ExpiresAt.Format "2006-01-02 15:04 MST"}}. If you did not ask for a reset, ignore this message.</p>`},
+		{EmailChange, Email, `Confirm your new email address`,
+			`<p>Use this token to confirm {{.To}} as your new email address: <strong>{{.Secret}}</strong></p>` +
+				`<p>It expires at {{.ExpiresAt.Format "2006-01-02 15:04 MST"}}.</p>`},
+		{EmailChangeRevoke, Email, `Your email address is being changed`,
+			`<p>Someone asked to move your account to a different email address.</p>` +
+				`<p>If this was not you, use this token to cancel the change: <strong>{{.Secret}}</strong></p>`},
+	}
+	for _, d := range defaults {
+		if errSet := t.Set(d.kind, d.channel, d.subject, d.body); errSet != nil {
+			panic(errSet)
+		}
+	}
+	return t
+}
@@ -0,0 +1,77 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// FileTransport writes every message to its own JSON file in Dir, for local
+// development without a mail server.
+type FileTransport struct {
+	Dir string
+}
+
+func (t *FileTransport) Send(ctx context.Context, message Message) error {
+	if errMkdir := os.MkdirAll(t.Dir, 0o700); errMkdir != nil {
+		return errMkdir
+	}
+
+	content, errMarshal := json.MarshalIndent(message, "", "  ")
+	if errMarshal != nil {
+		return errMarshal
+	}
+
+	name := fmt.Sprintf("%d-%s-%s.json", time.Now().UTC().UnixNano(), message.Kind, message.Channel)
+	return os.WriteFile(filepath.Join(t.Dir, name), content, 0o600)
+}
+
+func NewFileTransport(dir string) *FileTransport {
+	return &FileTransport{Dir: dir}
+}
+
+// MemoryTransport keeps sent messages in memory so tests can read the secret
+// a flow sent.
+type MemoryTransport struct {
+	mu       sync.Mutex
+	messages []Message
+}
+
+func (t *MemoryTransport) Send(ctx context.Context, message Message) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.messages = append(t.messages, message)
+	return nil
+}
+
+func (t *MemoryTransport) Messages() []Message {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]Message(nil), t.messages...)
+}
+
+// Last returns the most recent message sent to the address, if any.
+func (t *MemoryTransport) Last(to string) (Message, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i := len(t.messages) - 1; i >= 0; i-- {
+		if t.messages[i].To == to {
+			return t.messages[i], true
+		}
+	}
+	return Message{}, false
+}
+
+func (t *MemoryTransport) Reset() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.messages = nil
+}
+
+func NewMemoryTransport() *MemoryTransport {
+	return &MemoryTransport{}
+}
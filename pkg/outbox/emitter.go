@@ -0,0 +1,96 @@
+package outbox
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"github.com/21strive/commonuser/internal/repository"
+	"github.com/21strive/commonuser/internal/types"
+	"github.com/21strive/commonuser/pkg/event"
+	"sync"
+)
+
+// Emitter records an event in the outbox with the executor of the operation
+// that produced it. Called with the caller's transaction, the event is stored
+// if and only if the operation commits; the relay delivers it from there.
+//
+// Events are published on the in-process bus once they are committed: right
+// away outside a transaction, and for a *sql.Tx when it is finished through a
+// UnitOfWork or a CachePipeline, which call Committed or RolledBack.
+type Emitter struct {
+	bus              *event.Bus
+	outboxRepository *repository.OutboxRepository
+
+	mu      sync.Mutex
+	pending map[types.SQLExecutor][]event.Event
+}
+
+func (e *Emitter) Emit(ctx context.Context, db types.SQLExecutor, ev event.Event) error {
+	payload, errMarshal := json.Marshal(ev)
+	if errMarshal != nil {
+		return errMarshal
+	}
+
+	errAppend := e.outboxRepository.Append(ctx, db, ev.Name(), payload)
+	if errAppend != nil {
+		return errAppend
+	}
+
+	if e.bus == nil {
+		return nil
+	}
+	if _, inTx := db.(*sql.Tx); !inTx {
+		e.bus.Publish(ctx, ev)
+		return nil
+	}
+
+	e.mu.Lock()
+	e.pending[db] = append(e.pending[db], ev)
+	e.mu.Unlock()
+	return nil
+}
+
+// Committed publishes the events emitted on tx, in the order they were
+// emitted, after tx has committed.
+func (e *Emitter) Committed(ctx context.Context, tx types.SQLExecutor) {
+	e.mu.Lock()
+	events := e.pending[tx]
+	delete(e.pending, tx)
+	e.mu.Unlock()
+
+	for _, ev := range events {
+		e.bus.Publish(ctx, ev)
+	}
+}
+
+// RolledBack drops the events emitted on tx.
+func (e *Emitter) RolledBack(tx types.SQLExecutor) {
+	e.mu.Lock()
+	delete(e.pending, tx)
+	e.mu.Unlock()
+}
+
+// Savepoint marks the events emitted on tx so far, for RollbackTo.
+func (e *Emitter) Savepoint(tx types.SQLExecutor) int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return len(e.pending[tx])
+}
+
+// RollbackTo drops the events emitted on tx after savepoint.
+func (e *Emitter) RollbackTo(tx types.SQLExecutor, savepoint int) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if savepoint < len(e.pending[tx]) {
+		e.pending[tx] = e.pending[tx][:savepoint]
+	}
+}
+
+// Bus returns the in-process bus events are published on.
+func (e *Emitter) Bus() *event.Bus {
+	return e.bus
+}
+
+func NewEmitter(bus *event.Bus, outboxRepository *repository.OutboxRepository) *Emitter {
+	return &Emitter{bus: bus, outboxRepository: outboxRepository, pending: make(map[types.SQLExecutor][]event.Event)}
+}
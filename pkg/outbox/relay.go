@@ -0,0 +1,237 @@
+package outbox
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"github.com/21strive/commonuser/config"
+	"github.com/21strive/commonuser/internal/model"
+	"github.com/21strive/commonuser/internal/repository"
+	"github.com/redis/go-redis/v9"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultInterval     = time.Second * 5
+	defaultBatchSize    = 100
+	defaultMaxAttempts  = 10
+	defaultRetryBackoff = time.Second * 10
+	maxRetryBackoff     = time.Hour
+)
+
+// Relay moves outbox rows to a Redis Stream. A row is deleted only after the
+// stream accepted it, so a crash in between delivers it again: consumers get
+// every event at least once and should deduplicate on the "id" field. Rows
+// that keep failing are retried with exponential backoff and, after
+// MaxAttempts, pushed to the "<stream>:dead" list and dropped from the outbox.
+// Several replicas can relay at once; each claims different rows.
+type Relay struct {
+	writeDB          *sql.DB
+	redis            redis.UniversalClient
+	outboxRepository *repository.OutboxRepository
+	config           *config.App
+	onError          func(error)
+
+	mu   sync.Mutex
+	stop context.CancelFunc
+	done chan struct{}
+}
+
+func (r *Relay) SetWriteDB(db *sql.DB) {
+	r.writeDB = db
+}
+
+// OnError registers a callback for failed relay passes.
+func (r *Relay) OnError(fn func(error)) {
+	r.onError = fn
+}
+
+func (r *Relay) Stream() string {
+	if r.config.Outbox.Stream != "" {
+		return r.config.Outbox.Stream
+	}
+	return r.config.EntityName + ":events"
+}
+
+func (r *Relay) DeadLetterKey() string {
+	return r.Stream() + ":dead"
+}
+
+func (r *Relay) interval() time.Duration {
+	if r.config.Outbox.Interval > 0 {
+		return r.config.Outbox.Interval
+	}
+	return defaultInterval
+}
+
+func (r *Relay) batchSize() int {
+	if r.config.Outbox.BatchSize > 0 {
+		return r.config.Outbox.BatchSize
+	}
+	return defaultBatchSize
+}
+
+func (r *Relay) maxAttempts() int {
+	if r.config.Outbox.MaxAttempts > 0 {
+		return r.config.Outbox.MaxAttempts
+	}
+	return defaultMaxAttempts
+}
+
+func (r *Relay) backoff(attempts int) time.Duration {
+	base := r.config.Outbox.RetryBackoff
+	if base <= 0 {
+		base = defaultRetryBackoff
+	}
+	delay := base
+	for i := 1; i < attempts && delay < maxRetryBackoff; i++ {
+		delay *= 2
+	}
+	if delay > maxRetryBackoff {
+		delay = maxRetryBackoff
+	}
+	return delay
+}
+
+// Start relays every interval until ctx is cancelled or Stop is called.
+// Calling Start on a running relay does nothing.
+func (r *Relay) Start(ctx context.Context) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.stop != nil {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	r.stop = cancel
+	r.done = make(chan struct{})
+	go r.run(ctx, r.done)
+}
+
+// Stop ends the loop started by Start and waits for a running pass to finish.
+func (r *Relay) Stop() {
+	r.mu.Lock()
+	stop, done := r.stop, r.done
+	r.stop, r.done = nil, nil
+	r.mu.Unlock()
+
+	if stop == nil {
+		return
+	}
+	stop()
+	<-done
+}
+
+func (r *Relay) run(ctx context.Context, done chan struct{}) {
+	defer close(done)
+
+	ticker := time.NewTicker(r.interval())
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			// keep draining while batches come back full
+			for {
+				relayed, errRelay := r.RelayOnce(ctx)
+				if errRelay != nil {
+					if r.onError != nil && ctx.Err() == nil {
+						r.onError(errRelay)
+					}
+					break
+				}
+				if relayed < r.batchSize() {
+					break
+				}
+			}
+		}
+	}
+}
+
+// RelayOnce delivers one batch of due messages and returns how many rows it
+// handled, delivered or not.
+func (r *Relay) RelayOnce(ctx context.Context) (int, error) {
+	tx, errBegin := r.writeDB.BeginTx(ctx, nil)
+	if errBegin != nil {
+		return 0, errBegin
+	}
+	defer tx.Rollback()
+
+	messages, errClaim := r.outboxRepository.ClaimDue(ctx, tx, r.batchSize())
+	if errClaim != nil {
+		return 0, errClaim
+	}
+	if len(messages) == 0 {
+		return 0, nil
+	}
+
+	pipe := r.redis.Pipeline()
+	adds := make([]*redis.StringCmd, len(messages))
+	for i, message := range messages {
+		adds[i] = pipe.XAdd(ctx, &redis.XAddArgs{
+			Stream: r.Stream(),
+			Values: map[string]interface{}{
+				"id":         strconv.FormatInt(message.Id, 10),
+				"event":      message.EventName,
+				"payload":    string(message.Payload),
+				"created_at": message.CreatedAt.UTC().Format(time.RFC3339Nano),
+			},
+		})
+	}
+	// per message errors are read from each command below
+	pipe.Exec(ctx)
+
+	for i, message := range messages {
+		errAdd := adds[i].Err()
+		if errAdd == nil {
+			errDelete := r.outboxRepository.Delete(ctx, tx, message.Id)
+			if errDelete != nil {
+				return 0, errDelete
+			}
+			continue
+		}
+
+		errFail := r.fail(ctx, tx, message, errAdd)
+		if errFail != nil {
+			return 0, errFail
+		}
+	}
+
+	errCommit := tx.Commit()
+	if errCommit != nil {
+		return 0, errCommit
+	}
+
+	return len(messages), nil
+}
+
+func (r *Relay) fail(ctx context.Context, tx *sql.Tx, message *model.OutboxMessage, cause error) error {
+	message.Attempts++
+	message.LastError = cause.Error()
+
+	if message.Attempts >= r.maxAttempts() {
+		deadLetter, errMarshal := json.Marshal(message)
+		if errMarshal != nil {
+			return errMarshal
+		}
+		// when the dead-letter list is unreachable too, keep the row and retry
+		errPush := r.redis.LPush(ctx, r.DeadLetterKey(), deadLetter).Err()
+		if errPush == nil {
+			return r.outboxRepository.Delete(ctx, tx, message.Id)
+		}
+	}
+
+	return r.outboxRepository.Reschedule(ctx, tx, message, time.Now().UTC().Add(r.backoff(message.Attempts)))
+}
+
+func NewRelay(redis redis.UniversalClient, outboxRepository *repository.OutboxRepository, config *config.App) *Relay {
+	return &Relay{
+		redis:            redis,
+		outboxRepository: outboxRepository,
+		config:           config,
+	}
+}
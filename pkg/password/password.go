@@ -8,6 +8,9 @@ import (
 	"github.com/21strive/commonuser/internal/repository"
 	"github.com/21strive/commonuser/internal/types"
 	"github.com/21strive/commonuser/pkg/account"
+	"github.com/21strive/commonuser/pkg/event"
+	"github.com/21strive/commonuser/pkg/notify"
+	"github.com/21strive/commonuser/pkg/outbox"
 	"github.com/21strive/commonuser/pkg/session"
 	"github.com/redis/go-redis/v9"
 	"time"
@@ -15,23 +18,24 @@ import (
 
 type WithTransaction struct {
 	PasswordOps *PasswordOps
-	Tx          *sql.Tx
+	Pipeline    redis.Pipeliner
+	Tx          types.SQLExecutor
 }
 
 func (w *WithTransaction) RequestResetPassword(ctx context.Context, account *model.Account, expiration *time.Time) (*model.ResetPassword, error) {
 	return w.PasswordOps.requestResetPassword(ctx, w.Tx, account, expiration)
 }
 
-func (w *WithTransaction) ValidateResetPassword(ctx context.Context, pipe redis.Pipeliner, account *model.Account, newPassword string, token string) error {
-	return w.PasswordOps.validateResetPassword(ctx, pipe, w.Tx, account, newPassword, token)
+func (w *WithTransaction) ValidateResetPassword(ctx context.Context, account *model.Account, newPassword string, token string) error {
+	return w.PasswordOps.validateResetPassword(ctx, w.Pipeline, w.Tx, account, newPassword, token)
 }
 
 func (w *WithTransaction) DeleteResetPasswordRequest(ctx context.Context, account *model.Account) error {
 	return w.PasswordOps.deleteResetPasswordRequest(ctx, w.Tx, account)
 }
 
-func (w *WithTransaction) UpdateResetPasswordRequest(ctx context.Context, pipe redis.Pipeliner, account *model.Account, oldPassword string, newPassword string) error {
-	return w.PasswordOps.updateResetPasswordRequest(ctx, pipe, w.Tx, account, oldPassword, newPassword)
+func (w *WithTransaction) UpdateResetPasswordRequest(ctx context.Context, account *model.Account, oldPassword string, newPassword string) error {
+	return w.PasswordOps.updateResetPasswordRequest(ctx, w.Pipeline, w.Tx, account, oldPassword, newPassword)
 }
 
 type PasswordOps struct {
@@ -39,12 +43,37 @@ type PasswordOps struct {
 	resetPasswordRepository *repository.ResetPasswordRepository
 	sessionOps              *session.SessionOps
 	accountOps              *account.AccountOps
+	events                  *outbox.Emitter
+	notifier                notify.Notifier
 }
 
 func (pu *PasswordOps) SetWriteDB(db *sql.DB) {
 	pu.writeDB = db
 }
 
+func (pu *PasswordOps) WithTransaction(pipe redis.Pipeliner, db types.SQLExecutor) *WithTransaction {
+	return &WithTransaction{PasswordOps: pu, Pipeline: pipe, Tx: db}
+}
+
+// SetNotifier sends every reset token to the account's email address.
+func (pu *PasswordOps) SetNotifier(notifier notify.Notifier) {
+	pu.notifier = notifier
+}
+
+func (pu *PasswordOps) sendToken(ctx context.Context, account *model.Account, ticket *model.ResetPassword) error {
+	if pu.notifier == nil {
+		return nil
+	}
+	return pu.notifier.Notify(ctx, notify.Notification{
+		Kind:      notify.ResetPassword,
+		Channel:   notify.Email,
+		To:        account.Email,
+		Account:   account,
+		Secret:    ticket.Token,
+		ExpiresAt: ticket.ExpiredAt,
+	})
+}
+
 func (pu *PasswordOps) requestResetPassword(ctx context.Context, db types.SQLExecutor, account *model.Account, expiration *time.Time) (*model.ResetPassword, error) {
 	ticketFromDB, errFind := pu.resetPasswordRepository.FindRequest(account)
 	if errFind != nil {
@@ -59,6 +88,10 @@ func (pu *PasswordOps) requestResetPassword(ctx context.Context, db types.SQLExe
 				return nil, errDeleteTicket
 			}
 		} else {
+			errSend := pu.sendToken(ctx, account, ticketFromDB)
+			if errSend != nil {
+				return nil, errSend
+			}
 			return ticketFromDB, nil
 		}
 	}
@@ -74,6 +107,11 @@ func (pu *PasswordOps) requestResetPassword(ctx context.Context, db types.SQLExe
 		return nil, errCreate
 	}
 
+	errSend := pu.sendToken(ctx, account, newResetPasswordTicket)
+	if errSend != nil {
+		return nil, errSend
+	}
+
 	return newResetPasswordTicket, nil
 }
 
@@ -98,12 +136,7 @@ func (pu *PasswordOps) validateResetPassword(ctx context.Context, pipe redis.Pip
 
 	account.SetPassword(newPassword)
 	account.SetUpdatedAt(time.Now().UTC())
-	var errUpdateAccount error
-	if pipe != nil {
-		errUpdateAccount = pu.accountOps.WithTransaction(pipe, db.(*sql.Tx)).Update(ctx, account)
-	} else {
-		errUpdateAccount = pu.accountOps.Update(ctx, account)
-	}
+	errUpdateAccount := pu.accountOps.WithTransaction(pipe, db).Update(ctx, account)
 	if errUpdateAccount != nil {
 		return errUpdateAccount
 	}
@@ -113,17 +146,12 @@ func (pu *PasswordOps) validateResetPassword(ctx context.Context, pipe redis.Pip
 		return errUpdateTicket
 	}
 
-	var errRevoke error
-	if pipe != nil {
-		errRevoke = pu.sessionOps.WithTransaction(pipe, db.(*sql.Tx)).RevokeAll(ctx, account)
-	} else {
-		errRevoke = pu.sessionOps.RevokeAll(ctx, account)
-	}
+	_, errRevoke := pu.sessionOps.WithTransaction(pipe, db).RevokeAll(ctx, account)
 	if errRevoke != nil {
 		return errRevoke
 	}
 
-	return nil
+	return pu.events.Emit(ctx, db, event.PasswordReset{Account: account, OccurredAt: time.Now().UTC()})
 }
 
 func (pu *PasswordOps) ValidateResetPassword(ctx context.Context, account *model.Account, newPassword string, token string) error {
@@ -152,31 +180,28 @@ func (pu *PasswordOps) updateResetPasswordRequest(ctx context.Context, pipe redi
 		return errSetPassword
 	}
 
-	var errRevoke error
-	if pipe != nil {
-		errRevoke = pu.sessionOps.WithTransaction(pipe, db.(*sql.Tx)).RevokeAll(ctx, account)
-	} else {
-		errRevoke = pu.sessionOps.RevokeAll(ctx, account)
-	}
+	_, errRevoke := pu.sessionOps.WithTransaction(pipe, db).RevokeAll(ctx, account)
 	if errRevoke != nil {
 		return errRevoke
 	}
 
-	if pipe != nil {
-		return pu.accountOps.WithTransaction(pipe, db.(*sql.Tx)).Update(ctx, account)
-	} else {
-		return pu.accountOps.Update(ctx, account)
+	errUpdateAccount := pu.accountOps.WithTransaction(pipe, db).Update(ctx, account)
+	if errUpdateAccount != nil {
+		return errUpdateAccount
 	}
+
+	return pu.events.Emit(ctx, db, event.PasswordChanged{Account: account, OccurredAt: time.Now().UTC()})
 }
 
 func (pu *PasswordOps) UpdateResetPasswordRequest(ctx context.Context, account *model.Account, oldPassword string, newPassword string) error {
 	return pu.updateResetPasswordRequest(ctx, nil, pu.writeDB, account, oldPassword, newPassword)
 }
 
-func New(resetPasswordRepository *repository.ResetPasswordRepository, sessionOps *session.SessionOps, accountOps *account.AccountOps) *PasswordOps {
+func New(resetPasswordRepository *repository.ResetPasswordRepository, sessionOps *session.SessionOps, accountOps *account.AccountOps, events *outbox.Emitter) *PasswordOps {
 	return &PasswordOps{
 		resetPasswordRepository: resetPasswordRepository,
 		sessionOps:              sessionOps,
 		accountOps:              accountOps,
+		events:                  events,
 	}
 }
@@ -3,50 +3,78 @@ package session
 import (
 	"context"
 	"database/sql"
+	"fmt"
 	"github.com/21strive/commonuser/config"
+	"github.com/21strive/commonuser/internal/cache"
 	"github.com/21strive/commonuser/internal/fetcher"
 	"github.com/21strive/commonuser/internal/model"
 	"github.com/21strive/commonuser/internal/repository"
 	"github.com/21strive/commonuser/internal/types"
+	"github.com/21strive/commonuser/pkg/event"
+	"github.com/21strive/commonuser/pkg/outbox"
 	"github.com/21strive/redifu"
 	"github.com/redis/go-redis/v9"
 	"time"
 )
 
-type WithTranscation struct {
+type WithTransaction struct {
 	SessionOps *SessionOps
-	Tx         *sql.Tx
+	Tx         types.SQLExecutor
 	pipe       redis.Pipeliner
 }
 
-func (w *WithTranscation) Create(ctx context.Context, session *model.Session) error {
+// Deprecated: use WithTransaction.
+type WithTranscation = WithTransaction
+
+func (w *WithTransaction) Create(ctx context.Context, session *model.Session) error {
 	return w.SessionOps.create(ctx, w.pipe, w.Tx, session)
 }
 
-func (w *WithTranscation) Ping(ctx context.Context, sessionRandId string) error {
+func (w *WithTransaction) Ping(ctx context.Context, sessionRandId string) error {
 	return w.SessionOps.ping(ctx, w.pipe, w.Tx, sessionRandId)
 }
 
-func (w *WithTranscation) Revoke(ctx context.Context, sessionUUID string) error {
+func (w *WithTransaction) Revoke(ctx context.Context, sessionUUID string) error {
 	return w.SessionOps.revoke(ctx, w.pipe, w.Tx, sessionUUID)
 }
 
-func (w *WithTranscation) RevokeAll(ctx context.Context, account *model.Account) error {
+func (w *WithTransaction) RevokeAll(ctx context.Context, account *model.Account) (int, error) {
 	return w.SessionOps.revokeAll(ctx, w.pipe, w.Tx, account)
 }
 
-func (w *WithTranscation) Refresh(ctx context.Context, account *model.Account, sessionRandId string) (string, string, error) {
+func (w *WithTransaction) RevokeOwn(ctx context.Context, account *model.Account, sessionRandId string) error {
+	return w.SessionOps.revokeOwn(ctx, w.pipe, w.Tx, account, sessionRandId)
+}
+
+func (w *WithTransaction) RevokeAllExcept(ctx context.Context, account *model.Account, currentSessionRandId string) (int, error) {
+	return w.SessionOps.revokeAllExcept(ctx, w.pipe, w.Tx, account, currentSessionRandId)
+}
+
+func (w *WithTransaction) Refresh(ctx context.Context, account *model.Account, sessionRandId string) (string, string, error) {
 	return w.SessionOps.refresh(ctx, w.pipe, w.Tx, account, sessionRandId)
 }
 
-func (w *WithTranscation) PurgeInvalid(ctx context.Context) error {
+func (w *WithTransaction) PurgeInvalid(ctx context.Context) error {
 	return w.SessionOps.purgeInvalid(ctx, w.Tx)
 }
 
+const defaultPageSize = 20
+
+// Page selects a page of List. Number starts at 1 and Size defaults to 20.
+// Current is the randId of the session making the request, as carried in the
+// access token, and is marked as the current device in the result.
+type Page struct {
+	Number  int
+	Size    int
+	Current string
+}
+
 type SessionOps struct {
 	writeDB           *sql.DB
+	redis             redis.UniversalClient
 	sessionRepository *repository.SessionRepository
 	sessionFetcher    *fetcher.SessionFetcher
+	events            *outbox.Emitter
 	config            *config.App
 }
 
@@ -58,12 +86,130 @@ func (s *SessionOps) GetSessionBase() *redifu.Base[*model.Session] {
 	return s.sessionRepository.GetBase()
 }
 
-func (s *SessionOps) WithTransaction(pipe redis.Pipeliner, tx *sql.Tx) *WithTranscation {
-	return &WithTranscation{SessionOps: s, pipe: pipe, Tx: tx}
+// WithTransaction queues cache writes on pipe; send them only once tx has
+// committed, as the pipeline from commonuser.App.Pipeline does.
+func (s *SessionOps) WithTransaction(pipe redis.Pipeliner, tx types.SQLExecutor) *WithTransaction {
+	return &WithTransaction{SessionOps: s, pipe: pipe, Tx: tx}
 }
 
 func (s *SessionOps) create(ctx context.Context, pipe redis.Pipeliner, db types.SQLExecutor, session *model.Session) error {
-	return s.sessionRepository.Create(ctx, pipe, db, session)
+	if !s.config.SessionLimit.Enabled() {
+		errCreate := s.sessionRepository.Create(ctx, pipe, db, session)
+		if errCreate != nil {
+			return errCreate
+		}
+		return s.emitCreated(ctx, db, session, nil)
+	}
+
+	sqlDB, ok := db.(*sql.DB)
+	if !ok {
+		evicted, errCreate := s.createWithinLimit(ctx, pipe, db, session)
+		if errCreate != nil {
+			return errCreate
+		}
+		return s.emitCreated(ctx, db, session, evicted)
+	}
+
+	// the per-account lock only holds inside a transaction, and the cache is
+	// written once the new session and any evictions are committed
+	tx, errBegin := sqlDB.BeginTx(ctx, nil)
+	if errBegin != nil {
+		return errBegin
+	}
+	selfPipe := cache.NewPipeline(s.redis, s.events)
+	defer selfPipe.Rollback(tx)
+
+	evicted, errCreate := s.createWithinLimit(ctx, selfPipe, tx, session)
+	if errCreate != nil {
+		return errCreate
+	}
+	errEmit := s.emitCreated(ctx, tx, session, evicted)
+	if errEmit != nil {
+		return errEmit
+	}
+	return selfPipe.Commit(ctx, tx)
+}
+
+// createWithinLimit returns the randIds of the sessions evicted to make room.
+func (s *SessionOps) createWithinLimit(ctx context.Context, pipe redis.Pipeliner, db types.SQLExecutor, session *model.Session) ([]string, error) {
+	limit := s.config.SessionLimit
+	activeSessions, errLock := s.sessionRepository.LockActiveByAccount(ctx, db, session.AccountUUID)
+	if errLock != nil {
+		return nil, errLock
+	}
+
+	var evicted []*model.Session
+	if maxPerType, found := limit.MaxPerDeviceType[session.DeviceType]; found && maxPerType > 0 {
+		var sameType []*model.Session
+		for _, activeSession := range activeSessions {
+			if activeSession.DeviceType == session.DeviceType {
+				sameType = append(sameType, activeSession)
+			}
+		}
+		if excess := len(sameType) - maxPerType + 1; excess > 0 {
+			if limit.Policy == config.RejectNew {
+				return nil, model.SessionLimitReached
+			}
+			evicted = append(evicted, sameType[:excess]...)
+		}
+	}
+
+	if limit.MaxSessions > 0 {
+		var remaining []*model.Session
+		for _, activeSession := range activeSessions {
+			if !containsSession(evicted, activeSession) {
+				remaining = append(remaining, activeSession)
+			}
+		}
+		if excess := len(remaining) - limit.MaxSessions + 1; excess > 0 {
+			if limit.Policy == config.RejectNew {
+				return nil, model.SessionLimitReached
+			}
+			evicted = append(evicted, remaining[:excess]...)
+		}
+	}
+
+	var evictedRandIds []string
+	for _, evictedSession := range evicted {
+		evictedSession.SetUpdatedAt(time.Now().UTC())
+		evictedSession.Revoke()
+		errRevoke := s.sessionRepository.Update(ctx, pipe, db, evictedSession)
+		if errRevoke != nil {
+			return nil, errRevoke
+		}
+		evictedRandIds = append(evictedRandIds, evictedSession.GetRandId())
+	}
+
+	return evictedRandIds, s.sessionRepository.Create(ctx, pipe, db, session)
+}
+
+func (s *SessionOps) emitCreated(ctx context.Context, db types.SQLExecutor, session *model.Session, evictedRandIds []string) error {
+	errEmit := s.emitRevoked(ctx, db, session.AccountUUID, evictedRandIds, event.RevokedBySessionCap)
+	if errEmit != nil {
+		return errEmit
+	}
+	return s.events.Emit(ctx, db, event.SessionCreated{Session: session, OccurredAt: time.Now().UTC()})
+}
+
+func (s *SessionOps) emitRevoked(ctx context.Context, db types.SQLExecutor, accountUUID string, randIds []string, reason string) error {
+	if len(randIds) == 0 {
+		return nil
+	}
+	return s.events.Emit(ctx, db, event.SessionRevoked{
+		AccountUUID:    accountUUID,
+		SessionRandIds: randIds,
+		Reason:         reason,
+		OccurredAt:     time.Now().UTC(),
+	})
+}
+
+func containsSession(sessions []*model.Session, session *model.Session) bool {
+	for _, candidate := range sessions {
+		if candidate.GetUUID() == session.GetUUID() {
+			return true
+		}
+	}
+	return false
 }
 
 func (s *SessionOps) Create(ctx context.Context, session *model.Session) error {
@@ -76,8 +222,9 @@ func (s *SessionOps) ping(ctx context.Context, pipe redis.Pipeliner, db types.SQ
 		return errFind
 	}
 
-	if sessionFromDB.IsValid() {
-		return model.InvalidSession
+	errValidate := sessionFromDB.Validate(s.config.SessionIdleTimeout, s.config.SessionMaxLifetime)
+	if errValidate != nil {
+		return errValidate
 	}
 
 	sessionFromDB.SetLastActiveAt(time.Now().UTC())
@@ -96,47 +243,121 @@ func (s *SessionOps) revoke(ctx context.Context, pipe redis.Pipeliner, db types.
 
 	session.SetUpdatedAt(time.Now().UTC())
 	session.Revoke()
-	return s.sessionRepository.Update(ctx, pipe, db, session)
+	errUpdate := s.sessionRepository.Update(ctx, pipe, db, session)
+	if errUpdate != nil {
+		return errUpdate
+	}
+
+	return s.emitRevoked(ctx, db, session.AccountUUID, []string{session.GetRandId()}, event.RevokedBySignOut)
 }
 
 func (s *SessionOps) Revoke(ctx context.Context, sessionUUID string) error {
 	return s.revoke(ctx, nil, s.writeDB, sessionUUID)
 }
 
-func (s *SessionOps) revokeAll(ctx context.Context, pipe redis.Pipeliner, db types.SQLExecutor, account *model.Account) error {
-	sessions, errFind := s.sessionRepository.FindManyByAccount(ctx, nil, account.GetUUID())
+// List returns the active sessions of an account, most recently active first.
+func (s *SessionOps) List(ctx context.Context, account *model.Account, page Page) (*model.SessionList, error) {
+	if page.Number < 1 {
+		page.Number = 1
+	}
+	if page.Size < 1 {
+		page.Size = defaultPageSize
+	}
+
+	// one extra row tells whether another page follows
+	sessions, errFind := s.sessionRepository.FindActiveByAccount(ctx, account.GetUUID(), page.Size+1, (page.Number-1)*page.Size)
 	if errFind != nil {
-		return errFind
+		return nil, errFind
 	}
 
+	list := &model.SessionList{Devices: []model.SessionDevice{}, Page: page.Number}
+	if len(sessions) > page.Size {
+		list.HasMore = true
+		sessions = sessions[:page.Size]
+	}
 	for _, session := range sessions {
-		session.SetUpdatedAt(time.Now().UTC())
-		session.Revoke()
-		errUpdate := s.sessionRepository.Update(ctx, pipe, db, session)
-		if errUpdate != nil {
-			return errUpdate
-		}
+		list.Devices = append(list.Devices, session.Device(page.Current))
+	}
+
+	return list, nil
+}
+
+func (s *SessionOps) revokeOwn(ctx context.Context, pipe redis.Pipeliner, db types.SQLExecutor, account *model.Account, sessionRandId string) error {
+	session, errFind := s.sessionRepository.FindByRandId(ctx, pipe, sessionRandId)
+	if errFind != nil {
+		return errFind
+	}
+	// another account's session is reported exactly like a missing one
+	if session.AccountUUID != account.GetUUID() {
+		return model.SessionNotFound
+	}
+	if session.Revoked {
+		return nil
+	}
+
+	session.SetUpdatedAt(time.Now().UTC())
+	session.Revoke()
+	errUpdate := s.sessionRepository.Update(ctx, pipe, db, session)
+	if errUpdate != nil {
+		return errUpdate
+	}
+
+	return s.emitRevoked(ctx, db, session.AccountUUID, []string{session.GetRandId()}, event.RevokedBySignOut)
+}
+
+// RevokeOwn signs out one of the account's own sessions, identified by the
+// randId shown in List.
+func (s *SessionOps) RevokeOwn(ctx context.Context, account *model.Account, sessionRandId string) error {
+	return s.revokeOwn(ctx, nil, s.writeDB, account, sessionRandId)
+}
+
+func (s *SessionOps) revokeAllExcept(ctx context.Context, pipe redis.Pipeliner, db types.SQLExecutor, account *model.Account, currentSessionRandId string) (int, error) {
+	randIds, errRevoke := s.sessionRepository.RevokeByAccount(ctx, pipe, db, account.GetUUID(), currentSessionRandId)
+	if errRevoke != nil {
+		return 0, errRevoke
 	}
 
-	return nil
+	errEmit := s.emitRevoked(ctx, db, account.GetUUID(), randIds, event.RevokedByAccount)
+	if errEmit != nil {
+		return 0, errEmit
+	}
+	return len(randIds), nil
+}
+
+// RevokeAllExcept signs out every other device of the account, keeping the
+// session making the request. It returns the number of revoked sessions.
+func (s *SessionOps) RevokeAllExcept(ctx context.Context, account *model.Account, currentSessionRandId string) (int, error) {
+	return s.revokeAllExcept(ctx, nil, s.writeDB, account, currentSessionRandId)
+}
+
+func (s *SessionOps) revokeAll(ctx context.Context, pipe redis.Pipeliner, db types.SQLExecutor, account *model.Account) (int, error) {
+	return s.revokeAllExcept(ctx, pipe, db, account, "")
 }
 
-func (s *SessionOps) RevokeAll(ctx context.Context, account *model.Account) error {
+// RevokeAll signs out every device of the account and returns the number of
+// revoked sessions.
+func (s *SessionOps) RevokeAll(ctx context.Context, account *model.Account) (int, error) {
 	return s.revokeAll(ctx, nil, s.writeDB, account)
 }
 
 func (s *SessionOps) refresh(ctx context.Context, pipe redis.Pipeliner, db types.SQLExecutor, account *model.Account, sessionRandId string) (string, string, error) {
+	if !account.IsActive() {
+		return "", "", model.AccountSuspended
+	}
+
 	sessionFromDB, errFind := s.sessionRepository.FindByRandId(ctx, pipe, sessionRandId)
 	if errFind != nil {
 		return "", "", errFind
 	}
-	if !sessionFromDB.IsValid() {
-		return "", "", model.InvalidSession
+	errValidate := sessionFromDB.Validate(s.config.SessionIdleTimeout, s.config.SessionMaxLifetime)
+	if errValidate != nil {
+		return "", "", errValidate
 	}
 
 	sessionFromDB.SetUpdatedAt(time.Now().UTC())
 	sessionFromDB.SetLastActiveAt(time.Now().UTC())
 	sessionFromDB.SetLifeSpan(s.config.TokenLifespan)
+	sessionFromDB.CapLifeSpan(s.config.SessionMaxLifetime)
 	errGenerate := sessionFromDB.GenerateRefreshToken()
 	if errGenerate != nil {
 		return "", "", errGenerate
@@ -151,6 +372,7 @@ func (s *SessionOps) refresh(ctx context.Context, pipe redis.Pipeliner, db types
 		s.config.JWTIssuer,
 		s.config.JWTLifespan,
 		sessionFromDB.GetRandId(),
+		s.config.JWTAttributes,
 	)
 	if errGenerate != nil {
 		return "", "", errGenerate
@@ -171,6 +393,10 @@ func (s *SessionOps) PurgeInvalid(ctx context.Context) error {
 	return s.purgeInvalid(ctx, s.writeDB)
 }
 
+func (s *SessionOps) FindByAccount(ctx context.Context, account *model.Account) ([]*model.Session, error) {
+	return s.sessionRepository.FindManyByAccount(ctx, nil, account.GetUUID())
+}
+
 func (s *SessionOps) PingByCache(ctx context.Context, sessionRandId string) (*model.Session, error) {
 	sessionFromCache, err := s.sessionFetcher.FetchByRandId(ctx, sessionRandId)
 	if err != nil {
@@ -179,17 +405,21 @@ func (s *SessionOps) PingByCache(ctx context.Context, sessionRandId string) (*mo
 	if sessionFromCache == nil {
 		return nil, model.Unauthorized
 	}
-	if !sessionFromCache.IsValid() {
-		return nil, model.Unauthorized
+	errValidate := sessionFromCache.Validate(s.config.SessionIdleTimeout, s.config.SessionMaxLifetime)
+	if errValidate != nil {
+		// still Unauthorized for existing callers, with the reason attached
+		return nil, fmt.Errorf("%w: %w", model.Unauthorized, errValidate)
 	}
 
 	return sessionFromCache, nil
 }
 
-func New(sessionRepository *repository.SessionRepository, sessionFetcher *fetcher.SessionFetcher, config *config.App) *SessionOps {
+func New(redis redis.UniversalClient, sessionRepository *repository.SessionRepository, sessionFetcher *fetcher.SessionFetcher, events *outbox.Emitter, config *config.App) *SessionOps {
 	return &SessionOps{
+		redis:             redis,
 		sessionRepository: sessionRepository,
 		sessionFetcher:    sessionFetcher,
+		events:            events,
 		config:            config,
 	}
 }
@@ -9,30 +9,54 @@ import (
 	"github.com/21strive/commonuser/internal/repository"
 	"github.com/21strive/commonuser/internal/types"
 	"github.com/21strive/commonuser/pkg/account"
+	"github.com/21strive/commonuser/pkg/event"
+	"github.com/21strive/commonuser/pkg/notify"
+	"github.com/21strive/commonuser/pkg/outbox"
 	"github.com/redis/go-redis/v9"
+	"time"
 )
 
 type WithTransaction struct {
 	VerificationOps *VerificationOps
-	Tx              *sql.Tx
+	Pipeline        redis.Pipeliner
+	Tx              types.SQLExecutor
 }
 
 func (w *WithTransaction) Request(ctx context.Context, newAccount *model.Account) (*model.Verification, error) {
 	return w.VerificationOps.request(ctx, w.Tx, newAccount)
 }
 
-func (w *WithTransaction) Verify(ctx context.Context, pipe redis.Pipeliner, newAccount *model.Account, code string, sessionId string) (string, error) {
-	return w.VerificationOps.verify(ctx, pipe, w.Tx, newAccount, code, sessionId)
+// Verify counts the guess on the write database, outside the transaction.
+// Do not request or resend the code in the same transaction: the guess would
+// wait on the row the transaction holds and fail once the lock timeout runs
+// out.
+func (w *WithTransaction) Verify(ctx context.Context, newAccount *model.Account, code string, sessionId string) (string, error) {
+	return w.VerificationOps.verify(ctx, w.Pipeline, w.Tx, newAccount, code, sessionId)
 }
 
 func (w *WithTransaction) Resend(ctx context.Context, newAccount *model.Account) (*model.Verification, error) {
 	return w.VerificationOps.resend(ctx, w.Tx, newAccount)
 }
 
+func (w *WithTransaction) RequestPhone(ctx context.Context, account *model.Account) (*model.Verification, error) {
+	return w.VerificationOps.requestPhone(ctx, w.Tx, account)
+}
+
+// VerifyPhone counts the guess like Verify.
+func (w *WithTransaction) VerifyPhone(ctx context.Context, account *model.Account, code string) error {
+	return w.VerificationOps.verifyPhone(ctx, w.Pipeline, w.Tx, account, code)
+}
+
+func (w *WithTransaction) RequestSignInCode(ctx context.Context, phone string) (*model.Verification, error) {
+	return w.VerificationOps.requestSignInCode(ctx, w.Tx, phone)
+}
+
 type VerificationOps struct {
 	writeDB                *sql.DB
 	verificationRepository *repository.VerificationRepository
 	accountOps             *account.AccountOps
+	events                 *outbox.Emitter
+	notifier               notify.Notifier
 	config                 *config.App
 }
 
@@ -40,32 +64,143 @@ func (v *VerificationOps) SetWriteDB(db *sql.DB) {
 	v.writeDB = db
 }
 
-func (v *VerificationOps) WithTransaction(tx *sql.Tx) *WithTransaction {
-	return &WithTransaction{VerificationOps: v, Tx: tx}
+// SetNotifier sends every issued code, by email for email verification and by
+// SMS for phone verification and sign in codes.
+func (v *VerificationOps) SetNotifier(notifier notify.Notifier) {
+	v.notifier = notifier
 }
 
-func (v *VerificationOps) request(ctx context.Context, db types.SQLExecutor, account *model.Account) (*model.Verification, error) {
-	verificationFromDB, errFind := v.verificationRepository.FindByAccount(account)
-	if errFind != nil {
-		if errors.Is(errFind, model.VerificationNotFound) {
-			return nil, errFind
-		}
+func (v *VerificationOps) sendCode(ctx context.Context, account *model.Account, verification *model.Verification, code string) error {
+	if v.notifier == nil {
+		return nil
+	}
+
+	notification := notify.Notification{
+		Kind:      notify.VerificationCode,
+		Channel:   notify.SMS,
+		To:        account.Phone,
+		Account:   account,
+		Secret:    code,
+		ExpiresAt: verification.ExpiresAt,
+	}
+	switch verification.Purpose {
+	case model.VerifyEmail:
+		notification.Channel = notify.Email
+		notification.To = account.Email
+	case model.PhoneSignIn:
+		notification.Kind = notify.SignInCode
+	}
+	return v.notifier.Notify(ctx, notification)
+}
+
+func (v *VerificationOps) setCode(verification *model.Verification) (string, error) {
+	return verification.SetCode(
+		v.config.Verification.CodeLength,
+		v.config.Verification.CodeAlphabet,
+		v.config.Verification.CodeTTL)
+}
+
+func (v *VerificationOps) WithTransaction(pipe redis.Pipeliner, db types.SQLExecutor) *WithTransaction {
+	return &WithTransaction{VerificationOps: v, Pipeline: pipe, Tx: db}
+}
+
+// issue sends a new code for purpose, replacing a pending one since only the
+// hash of a code is stored.
+func (v *VerificationOps) issue(ctx context.Context, db types.SQLExecutor, account *model.Account, purpose model.Purpose) (*model.Verification, error) {
+	verificationFromDB, errFind := v.verificationRepository.FindByAccount(account, purpose)
+	if errFind != nil && !errors.Is(errFind, model.VerificationNotFound) {
+		return nil, errFind
 	}
 	if verificationFromDB != nil {
-		return verificationFromDB, nil
+		return v.rotate(ctx, db, account, verificationFromDB)
 	}
 
 	verificationData := model.NewVerification()
 	verificationData.SetAccount(account)
-	verificationData.SetCode()
+	verificationData.SetPurpose(purpose)
+	code, errSetCode := v.setCode(verificationData)
+	if errSetCode != nil {
+		return nil, errSetCode
+	}
 	errCreateVerification := v.verificationRepository.Create(ctx, db, verificationData)
 	if errCreateVerification != nil {
 		return nil, errCreateVerification
 	}
 
+	errSend := v.sendCode(ctx, account, verificationData, code)
+	if errSend != nil {
+		return nil, errSend
+	}
+
 	return verificationData, nil
 }
 
+// rotate issues a fresh code in place of a pending one, at most once per
+// resend cooldown.
+func (v *VerificationOps) rotate(ctx context.Context, db types.SQLExecutor, account *model.Account, verification *model.Verification) (*model.Verification, error) {
+	if !verification.CanResend(v.config.Verification.ResendCooldown) {
+		return nil, model.VerificationResendTooSoon
+	}
+
+	code, errSetCode := v.setCode(verification)
+	if errSetCode != nil {
+		return nil, errSetCode
+	}
+	verification.SetUpdatedAt(time.Now().UTC())
+	errUpdate := v.verificationRepository.Update(ctx, db, verification)
+	if errUpdate != nil {
+		return nil, errUpdate
+	}
+
+	errSend := v.sendCode(ctx, account, verification, code)
+	if errSend != nil {
+		return nil, errSend
+	}
+
+	return verification, nil
+}
+
+// consume checks code against the pending verification for purpose and
+// deletes it on a match. Every guess takes one of the allowed attempts, which
+// is counted on the write database so rolling back db does not give it back;
+// without one it is counted on db.
+func (v *VerificationOps) consume(ctx context.Context, db types.SQLExecutor, account *model.Account, purpose model.Purpose, code string) error {
+	verificationFromDB, errFind := v.verificationRepository.FindByAccount(account, purpose)
+	if errFind != nil {
+		return errFind
+	}
+	if verificationFromDB.IsExpired() {
+		return model.VerificationCodeExpired
+	}
+
+	errReserve := v.verificationRepository.ReserveAttempt(ctx, v.attemptDB(db), verificationFromDB, v.config.Verification.MaxAttempts)
+	if errReserve != nil {
+		return errReserve
+	}
+
+	errValidate := verificationFromDB.Validate(code)
+	if errValidate != nil {
+		return errValidate
+	}
+
+	return v.verificationRepository.Delete(ctx, db, verificationFromDB)
+}
+
+func (v *VerificationOps) attemptDB(db types.SQLExecutor) types.SQLExecutor {
+	if v.writeDB == nil {
+		return db
+	}
+	return v.writeDB
+}
+
+func (v *VerificationOps) updateAccount(ctx context.Context, pipe redis.Pipeliner, db types.SQLExecutor, account *model.Account) error {
+	return v.accountOps.WithTransaction(pipe, db).Update(ctx, account)
+}
+
+func (v *VerificationOps) request(ctx context.Context, db types.SQLExecutor, account *model.Account) (*model.Verification, error) {
+	return v.issue(ctx, db, account, model.VerifyEmail)
+}
+
 func (v *VerificationOps) Request(ctx context.Context, account *model.Account) (*model.Verification, error) {
 	return v.request(ctx, v.writeDB, account)
 }
@@ -73,38 +208,28 @@ func (v *VerificationOps) Request(ctx context.Context, account *model.Account) (
 func (v *VerificationOps) verify(ctx context.Context, pipe redis.Pipeliner, db types.SQLExecutor, newAccount *model.Account, code string, sessionId string) (string, error) {
 	var newAccessToken string
 
-	verificationFromDB, errFind := v.verificationRepository.FindByAccount(newAccount)
-	if errFind != nil {
-		return newAccessToken, errFind
-	}
-
-	isValid := verificationFromDB.Validate(code)
-	if !isValid {
-		return newAccessToken, model.InvalidVerificationCode
+	errConsume := v.consume(ctx, db, newAccount, model.VerifyEmail, code)
+	if errConsume != nil {
+		return newAccessToken, errConsume
 	}
 
 	newAccount.SetEmailVerified()
-	var errUpdateAcc error
-	if pipe != nil {
-		errUpdateAcc = v.accountOps.WithTransaction(pipe, db.(*sql.Tx)).Update(ctx, newAccount)
-
-	} else {
-		errUpdateAcc = v.accountOps.Update(ctx, newAccount)
-	}
+	errUpdateAcc := v.updateAccount(ctx, pipe, db, newAccount)
 	if errUpdateAcc != nil {
 		return newAccessToken, errUpdateAcc
 	}
 
-	errDeleteVerification := v.verificationRepository.Delete(ctx, db, verificationFromDB)
-	if errDeleteVerification != nil {
-		return newAccessToken, errDeleteVerification
+	errEmit := v.events.Emit(ctx, db, event.EmailVerified{Account: newAccount, OccurredAt: time.Now().UTC()})
+	if errEmit != nil {
+		return newAccessToken, errEmit
 	}
 
 	newAccessToken, errGenerateAccToken := newAccount.GenerateAccessToken(
 		v.config.JWTSecret,
 		v.config.JWTIssuer,
 		v.config.JWTLifespan,
-		sessionId)
+		sessionId,
+		v.config.JWTAttributes)
 	if errGenerateAccToken != nil {
 		return newAccessToken, errGenerateAccToken
 	}
@@ -117,38 +242,72 @@ func (v *VerificationOps) Verify(ctx context.Context, newAccount *model.Account,
 }
 
 func (v *VerificationOps) resend(ctx context.Context, db types.SQLExecutor, newAccount *model.Account) (*model.Verification, error) {
-	verificationData, errFind := v.verificationRepository.FindByAccount(newAccount)
+	verificationData, errFind := v.verificationRepository.FindByAccount(newAccount, model.VerifyEmail)
 	if errFind != nil {
 		if errors.Is(errFind, model.VerificationNotFound) {
-			verificationData = model.NewVerification()
-			verificationData.SetAccount(newAccount)
-			verificationData.SetCode()
-			errCreateVerification := v.verificationRepository.Create(ctx, db, verificationData)
-			if errCreateVerification != nil {
-				return nil, errCreateVerification
-			}
-
-			return verificationData, nil
+			return v.request(ctx, db, newAccount)
 		}
+		return nil, errFind
 	}
 
-	verificationData.SetCode()
-	errUpdate := v.verificationRepository.Update(ctx, db, verificationData)
-	if errUpdate != nil {
-		return nil, errUpdate
-	}
-
-	return verificationData, nil
+	return v.rotate(ctx, db, newAccount, verificationData)
 }
 
 func (v *VerificationOps) Resend(ctx context.Context, newAccount *model.Account) (*model.Verification, error) {
 	return v.resend(ctx, v.writeDB, newAccount)
 }
 
-func New(verificationRepository *repository.VerificationRepository, accountOps *account.AccountOps, config *config.App) *VerificationOps {
+func (v *VerificationOps) requestPhone(ctx context.Context, db types.SQLExecutor, account *model.Account) (*model.Verification, error) {
+	if account.Phone == "" {
+		return nil, model.PhoneRequired
+	}
+	return v.issue(ctx, db, account, model.VerifyPhone)
+}
+
+// RequestPhone texts a code that confirms the account owns its phone number.
+// Calling it again resends a fresh code, subject to the resend cooldown.
+func (v *VerificationOps) RequestPhone(ctx context.Context, account *model.Account) (*model.Verification, error) {
+	return v.requestPhone(ctx, v.writeDB, account)
+}
+
+func (v *VerificationOps) verifyPhone(ctx context.Context, pipe redis.Pipeliner, db types.SQLExecutor, account *model.Account, code string) error {
+	errConsume := v.consume(ctx, db, account, model.VerifyPhone, code)
+	if errConsume != nil {
+		return errConsume
+	}
+
+	account.SetPhoneVerified()
+	errUpdateAcc := v.updateAccount(ctx, pipe, db, account)
+	if errUpdateAcc != nil {
+		return errUpdateAcc
+	}
+
+	return v.events.Emit(ctx, db, event.PhoneVerified{Account: account, OccurredAt: time.Now().UTC()})
+}
+
+func (v *VerificationOps) VerifyPhone(ctx context.Context, account *model.Account, code string) error {
+	return v.verifyPhone(ctx, nil, v.writeDB, account, code)
+}
+
+func (v *VerificationOps) requestSignInCode(ctx context.Context, db types.SQLExecutor, phone string) (*model.Verification, error) {
+	accountFromDB, errFind := v.accountOps.Find.ByPhone(phone)
+	if errFind != nil {
+		return nil, errFind
+	}
+	return v.issue(ctx, db, accountFromDB, model.PhoneSignIn)
+}
+
+// RequestSignInCode texts a one time code to phone for
+// Authentication.ByPhoneCode.
+func (v *VerificationOps) RequestSignInCode(ctx context.Context, phone string) (*model.Verification, error) {
+	return v.requestSignInCode(ctx, v.writeDB, phone)
+}
+
+func New(verificationRepository *repository.VerificationRepository, accountOps *account.AccountOps, events *outbox.Emitter, config *config.App) *VerificationOps {
 	return &VerificationOps{
 		verificationRepository: verificationRepository,
 		accountOps:             accountOps,
+		events:                 events,
 		config:                 config,
 	}
 }
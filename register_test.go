@@ -0,0 +1,180 @@
+package commonuser
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"github.com/21strive/commonuser/config"
+	"github.com/21strive/commonuser/internal/model"
+	"github.com/21strive/commonuser/pkg/event"
+	_ "github.com/lib/pq"
+	"github.com/redis/go-redis/v9"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testApp migrates a throwaway entity in the database at
+// COMMONUSER_TEST_DATABASE_URL and returns an App on it. Redis is only queued
+// on, never sent to, by tests that roll back.
+func testApp(t *testing.T) *App {
+	ctx := context.Background()
+	db := testDB(t)
+
+	suffix := make([]byte, 4)
+	_, _ = rand.Read(suffix)
+	entityName := "app_" + hex.EncodeToString(suffix)
+	if _, errMigrate := Migrate(ctx, db, entityName); errMigrate != nil {
+		t.Fatal(errMigrate)
+	}
+	t.Cleanup(func() { dropEntity(db, entityName) })
+
+	redisClient := redis.NewClient(&redis.Options{Addr: "127.0.0.1:0"})
+	app := New(db, redisClient, config.DefaultConfig(entityName, "secret", "test", time.Minute))
+	app.WithWriteDB(db)
+	return app
+}
+
+func testDB(t *testing.T) *sql.DB {
+	databaseURL := os.Getenv("COMMONUSER_TEST_DATABASE_URL")
+	if databaseURL == "" {
+		t.Skip("COMMONUSER_TEST_DATABASE_URL is not set")
+	}
+
+	db, errOpen := sql.Open("postgres", databaseURL)
+	if errOpen != nil {
+		t.Fatal(errOpen)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func dropEntity(db *sql.DB, entityName string) {
+	rows, errQuery := db.Query(`SELECT tablename FROM pg_tables WHERE schemaname = current_schema() AND (tablename = $1 OR tablename LIKE $1 || '\_%')`, entityName)
+	if errQuery != nil {
+		return
+	}
+	var tables []string
+	for rows.Next() {
+		var table string
+		if rows.Scan(&table) == nil {
+			tables = append(tables, table)
+		}
+	}
+	rows.Close()
+	if len(tables) > 0 {
+		_, _ = db.Exec(`DROP TABLE IF EXISTS ` + strings.Join(tables, ", ") + ` CASCADE`)
+	}
+}
+
+// The provider's account_uuid references the account on a migrated schema,
+// so the account has to be inserted first.
+func TestRegisterWithProviderOnMigratedSchema(t *testing.T) {
+	app := testApp(t)
+	ctx := context.Background()
+
+	unit, errBegin := app.Begin(ctx)
+	if errBegin != nil {
+		t.Fatal(errBegin)
+	}
+	defer unit.Rollback()
+
+	newAccount := app.Account.New()
+	newAccount.SetEmail("provider-" + newAccount.GetRandId() + "@example.com")
+	newProvider := model.NewProvider()
+	newProvider.SetName("google")
+	newProvider.SetEmail(newAccount.Email)
+	newProvider.SetSub(newAccount.GetRandId())
+	newProvider.SetIssuer("https://accounts.google.com")
+
+	errRegister := unit.Account.RegisterWithProvider(ctx, newAccount, newProvider)
+	if errRegister != nil {
+		t.Fatal(errRegister)
+	}
+
+	var accountUUID string
+	errScan := unit.Tx().QueryRowContext(ctx, "SELECT account_uuid::text FROM "+app.Config().EntityName+"_provider WHERE uuid = $1", newProvider.GetUUID()).Scan(&accountUUID)
+	if errScan != nil {
+		t.Fatal(errScan)
+	}
+	if accountUUID != newAccount.GetUUID() {
+		t.Fatalf("provider account_uuid = %q, want %q", accountUUID, newAccount.GetUUID())
+	}
+}
+
+// Events emitted inside a unit of work reach the bus only once it commits.
+func TestEventsPublishedAfterCommit(t *testing.T) {
+	app := testApp(t)
+	ctx := context.Background()
+
+	var published []string
+	event.Subscribe(app.Events(), func(ctx context.Context, e event.AccountRegistered) error {
+		published = append(published, e.Account.Email)
+		return nil
+	})
+
+	register := func(email string) *UnitOfWork {
+		unit, errBegin := app.Begin(ctx)
+		if errBegin != nil {
+			t.Fatal(errBegin)
+		}
+		newAccount := app.Account.New()
+		newAccount.SetEmail(email)
+		errRegister := unit.Account.Register(ctx, newAccount)
+		if errRegister != nil {
+			t.Fatal(errRegister)
+		}
+		if len(published) != 0 {
+			t.Fatalf("published %v before the transaction finished", published)
+		}
+		return unit
+	}
+
+	rolledBack := register("rolled-back@example.com")
+	if errRollback := rolledBack.Rollback(); errRollback != nil {
+		t.Fatal(errRollback)
+	}
+	if len(published) != 0 {
+		t.Fatalf("published %v for a rolled back transaction", published)
+	}
+
+	// the cache flush fails without Redis, the commit itself does not
+	committed := register("committed@example.com")
+	_ = committed.Commit(ctx)
+	if len(published) != 1 || published[0] != "committed@example.com" {
+		t.Fatalf("published %v, want the committed registration only", published)
+	}
+}
+
+// Rows stored before canonical emails are canonicalized in SQL, which has to
+// agree with EmailPolicy.
+func TestProviderCanonicalEmailSQL(t *testing.T) {
+	db := testDB(t)
+	policy := model.NewEmailPolicy(config.Email{ProviderRules: true})
+	query := "SELECT " + model.ProviderCanonicalEmailSQL("$1::citext")
+
+	for _, email := range []string{
+		"user@example.com",
+		"J.Doe+news@GoogleMail.com",
+		"j.doe+news@gmail.com",
+		"+news@gmail.com",
+		"j.doe+news@outlook.com",
+		"JDoe@Me.com",
+		"j.doe+news@example.com",
+	} {
+		want, errCanonical := policy.Canonical(email)
+		if errCanonical != nil {
+			t.Fatal(errCanonical)
+		}
+		var got string
+		errScan := db.QueryRow(query, email).Scan(&got)
+		if errScan != nil {
+			t.Fatal(errScan)
+		}
+		if got != want {
+			t.Errorf("SQL canonical form of %q = %q, want %q", email, got, want)
+		}
+	}
+}
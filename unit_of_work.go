@@ -0,0 +1,168 @@
+package commonuser
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"github.com/21strive/commonuser/internal/cache"
+	"github.com/21strive/commonuser/pkg/account"
+	"github.com/21strive/commonuser/pkg/email"
+	"github.com/21strive/commonuser/pkg/password"
+	"github.com/21strive/commonuser/pkg/session"
+	"github.com/21strive/commonuser/pkg/verification"
+	"github.com/redis/go-redis/v9"
+	"strconv"
+)
+
+var (
+	errWriteDBRequired = errors.New("begin requires a write database, see App.WithWriteDB")
+	errNestedFinish    = errors.New("a nested unit of work is finished by Nested")
+)
+
+// UnitOfWork runs operations of every group in one SQL transaction. Their
+// cache writes and in-process events are held back until Commit, which commits
+// the transaction and then sends them in the order they were made; Rollback
+// drops them.
+type UnitOfWork struct {
+	Account      *account.WithTransaction
+	Authenticate *account.AuthenticationWithPipe
+	Session      *session.WithTransaction
+	Email        *email.WithTransaction
+	Password     *password.WithTransaction
+	Verification *verification.WithTransaction
+
+	app        *App
+	tx         *sql.Tx
+	pipe       redis.Pipeliner
+	pending    []redis.Pipeliner
+	parent     *UnitOfWork
+	savepoints *int
+	done       bool
+}
+
+// Begin starts a unit of work on the write database. Defer Rollback right
+// after it; once Commit has run, Rollback does nothing.
+func (s *App) Begin(ctx context.Context) (*UnitOfWork, error) {
+	if s.writeDB == nil {
+		return nil, errWriteDBRequired
+	}
+	tx, errBegin := s.writeDB.BeginTx(ctx, nil)
+	if errBegin != nil {
+		return nil, errBegin
+	}
+
+	unit := &UnitOfWork{app: s, tx: tx, savepoints: new(int)}
+	unit.bind(s.redis.Pipeline())
+	return unit, nil
+}
+
+// bind points every operation group at pipe.
+func (u *UnitOfWork) bind(pipe redis.Pipeliner) {
+	u.pipe = pipe
+	u.Account = u.app.accountOps.WithTransaction(pipe, u.tx)
+	u.Authenticate = u.app.accountOps.Authenticate.WithTransaction(pipe, u.tx)
+	u.Session = u.app.sessionOps.WithTransaction(pipe, u.tx)
+	u.Email = u.app.emailOps.WithTransaction(pipe, u.tx)
+	u.Password = u.app.passwordOps.WithTransaction(pipe, u.tx)
+	u.Verification = u.app.verificationOps.WithTransaction(pipe, u.tx)
+}
+
+// Tx is the transaction the unit of work runs in, for statements of your own.
+func (u *UnitOfWork) Tx() *sql.Tx {
+	return u.tx
+}
+
+func (u *UnitOfWork) pipelines() []redis.Pipeliner {
+	return append(u.pending, u.pipe)
+}
+
+func (u *UnitOfWork) discard() {
+	for _, pipe := range u.pipelines() {
+		pipe.Discard()
+	}
+}
+
+// Nested runs fn in a savepoint. When fn fails, its statements are rolled back
+// to the savepoint and its cache writes dropped, and the error is returned
+// while the outer unit of work carries on. The nested unit of work is
+// finished by Nested, not by Commit or Rollback.
+func (u *UnitOfWork) Nested(ctx context.Context, fn func(nested *UnitOfWork) error) error {
+	*u.savepoints++
+	savepoint := "commonuser_" + strconv.Itoa(*u.savepoints)
+	_, errSavepoint := u.tx.ExecContext(ctx, "SAVEPOINT "+savepoint)
+	if errSavepoint != nil {
+		return errSavepoint
+	}
+
+	nested := &UnitOfWork{app: u.app, tx: u.tx, parent: u, savepoints: u.savepoints}
+	nested.bind(u.app.redis.Pipeline())
+	emitted := u.app.emitter.Savepoint(u.tx)
+
+	errFn := fn(nested)
+	if errFn != nil {
+		nested.discard()
+		u.app.emitter.RollbackTo(u.tx, emitted)
+		_, errRollback := u.tx.ExecContext(ctx, "ROLLBACK TO SAVEPOINT "+savepoint)
+		if errRollback != nil {
+			return errors.Join(errFn, errRollback)
+		}
+		return errFn
+	}
+
+	_, errRelease := u.tx.ExecContext(ctx, "RELEASE SAVEPOINT "+savepoint)
+	if errRelease != nil {
+		nested.discard()
+		u.app.emitter.RollbackTo(u.tx, emitted)
+		return errRelease
+	}
+
+	// writes made after this call go to a fresh pipeline, so they are sent
+	// after the nested ones
+	u.pending = append(u.pipelines(), nested.pipelines()...)
+	u.bind(u.app.redis.Pipeline())
+	return nil
+}
+
+// Commit commits the transaction and then sends the cache writes and publishes
+// the events. When a cache write fails, the keys involved are dropped so they
+// are read back from the database.
+func (u *UnitOfWork) Commit(ctx context.Context) error {
+	if u.parent != nil {
+		return errNestedFinish
+	}
+	if u.done {
+		return sql.ErrTxDone
+	}
+	u.done = true
+
+	errCommit := u.tx.Commit()
+	if errCommit != nil {
+		u.discard()
+		u.app.emitter.RolledBack(u.tx)
+		return errCommit
+	}
+
+	var errs []error
+	for _, pipe := range u.pipelines() {
+		errFlush := cache.Flush(ctx, u.app.redis, pipe)
+		if errFlush != nil {
+			errs = append(errs, errFlush)
+		}
+	}
+	u.app.emitter.Committed(ctx, u.tx)
+	return errors.Join(errs...)
+}
+
+func (u *UnitOfWork) Rollback() error {
+	if u.parent != nil {
+		return errNestedFinish
+	}
+	if u.done {
+		return nil
+	}
+	u.done = true
+
+	u.discard()
+	u.app.emitter.RolledBack(u.tx)
+	return u.tx.Rollback()
+}